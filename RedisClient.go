@@ -6,9 +6,79 @@ import (
 
 	"github.com/pschlump/MiscLib"
 	"github.com/pschlump/godebug"
+	"github.com/pschlump/radix.v2/cluster"
+	"github.com/pschlump/radix.v2/pool"
 	"github.com/pschlump/radix.v2/redis"
+	"github.com/pschlump/radix.v2/sentinel"
 )
 
+// RedisMonitorConn returns the get/put functions for the connection used by the
+// live monitor.  With Sentinel the connection is to the current master so that
+// it follows a fail over.  With a Cluster it is to the node that has the
+// "mon-alive" slot.  Otherwise it is the single connection from RedisClient().
+func RedisMonitorConn() (get func() *redis.Client, put func(*redis.Client)) {
+	if gCfg.RedisSentinelAddr != "" {
+		sc, err := sentinel.NewClientCustom("tcp", gCfg.RedisSentinelAddr, 1, redisMonitorDial, gCfg.RedisSentinelMaster)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%sError on connect to redis sentinel:%s, fatal%s\n", MiscLib.ColorRed, err, MiscLib.ColorReset)
+			os.Exit(1)
+		}
+		get = func() *redis.Client {
+			client, err := sc.GetMaster(gCfg.RedisSentinelMaster)
+			if err != nil {
+				fmt.Fprintf(logFilePtr, "Error: redis sentinel GetMaster: %s, %s\n", err, godebug.LF())
+			}
+			return client
+		}
+		put = func(client *redis.Client) {
+			if client != nil {
+				sc.PutMaster(gCfg.RedisSentinelMaster, client)
+			}
+		}
+		return
+	}
+	if gCfg.RedisClusterAddr != "" {
+		cc, err := cluster.NewWithOpts(cluster.Opts{Addr: gCfg.RedisClusterAddr, PoolSize: 1, Dialer: redisMonitorDial})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%sError on connect to redis cluster:%s, fatal%s\n", MiscLib.ColorRed, err, MiscLib.ColorReset)
+			os.Exit(1)
+		}
+		get = func() *redis.Client {
+			client, err := cc.GetForKey("mon-alive")
+			if err != nil {
+				fmt.Fprintf(logFilePtr, "Error: redis cluster GetForKey: %s, %s\n", err, godebug.LF())
+			}
+			return client
+		}
+		put = func(client *redis.Client) {
+			if client != nil {
+				cc.Put(client)
+			}
+		}
+		return
+	}
+	monClient, conFlag := RedisClient()
+	if db_flag["mon-conect"] {
+		fmt.Printf("conFlag=%v AT: %s\n", conFlag, godebug.LF())
+	}
+	return func() *redis.Client { return monClient }, func(conn *redis.Client) {}
+}
+
+// redisMonitorDial connects and does the AUTH for the Sentinel and Cluster clients.
+var redisMonitorDial pool.DialFunc = func(network, addr string) (*redis.Client, error) {
+	client, err := redis.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if gCfg.RedisConnectAuth != "" {
+		if err = client.Cmd("AUTH", gCfg.RedisConnectAuth).Err; err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
 func RedisClient() (client *redis.Client, conFlag bool) {
 	var err error
 	if db_flag["RedisClient"] {
@@ -0,0 +1,173 @@
+package main
+
+// Copyright (C) Philip Schlump 2018-2019.
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/American-Certified-Brands/tools/qr-short/storage"
+	"github.com/pschlump/MiscLib"
+	"github.com/pschlump/godebug"
+)
+
+// RunBackup implements `qr-short backup`.  The store is opened read only and
+// every code is written to --out, or to stdout if --out is "-".  The return
+// value is the exit code.
+//
+//	qr-short backup --from redis://:auth@localhost:6379/qr --out qr-backup.jsonl
+func RunBackup(args []string) int {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	from := fs.String("from", "", "store to back up, file:dir, bolt:file, postgres://..., redis://...")
+	out := fs.String("out", "", "archive file to write, - for stdout")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if *from == "" || *out == "" {
+		fmt.Fprintf(os.Stderr, "Usage: qr-short backup --from store --out file\n")
+		return 1
+	}
+
+	src, err := OpenStoreSpecReadOnly(*from)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%sUnable to open store: %s%s\n", MiscLib.ColorRed, err, MiscLib.ColorReset)
+		return 1
+	}
+	defer src.Close()
+
+	fp := os.Stdout
+	tmp := *out + ".tmp"
+	if *out != "-" {
+		// Written to a temporary file and renamed so a failed backup does not
+		// replace a good one.
+		fp, err = os.Create(tmp)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%sUnable to create %s: %s%s\n", MiscLib.ColorRed, tmp, err, MiscLib.ColorReset)
+			return 1
+		}
+		defer os.Remove(tmp)
+		defer fp.Close()
+	}
+	n, err := storage.WriteBackup(src, fp)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%sBackup failed: %s%s\n", MiscLib.ColorRed, err, MiscLib.ColorReset)
+		return 1
+	}
+	if *out != "-" {
+		if err = fp.Sync(); err == nil {
+			err = os.Rename(tmp, *out)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%sUnable to write %s: %s%s\n", MiscLib.ColorRed, *out, err, MiscLib.ColorReset)
+			return 1
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%sBacked up %d codes%s\n", MiscLib.ColorGreen, n, MiscLib.ColorReset)
+	return 0
+}
+
+// RunRestore implements `qr-short restore`.  The archive is checked before
+// anything is written.  The return value is the exit code.
+//
+//	qr-short restore --to bolt:~/data/qr-short.db --in qr-backup.jsonl [--mode merge|replace]
+func RunRestore(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	to := fs.String("to", "", "store to restore into, file:dir, bolt:file, postgres://..., redis://...")
+	in := fs.String("in", "", "archive file to read, - for stdin")
+	mode := fs.String("mode", string(storage.RestoreMerge), "merge: only add missing codes, replace: archived codes overwrite the store")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if *to == "" || *in == "" {
+		fmt.Fprintf(os.Stderr, "Usage: qr-short restore --to store --in file [--mode merge|replace]\n")
+		return 1
+	}
+
+	var r io.Reader = os.Stdin
+	if *in != "-" {
+		fp, err := os.Open(*in)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%sUnable to open %s: %s%s\n", MiscLib.ColorRed, *in, err, MiscLib.ColorReset)
+			return 1
+		}
+		defer fp.Close()
+		r = fp
+	}
+	dst, err := OpenStoreSpec(*to)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%sUnable to open store: %s%s\n", MiscLib.ColorRed, err, MiscLib.ColorReset)
+		return 1
+	}
+	defer dst.Close()
+
+	rr, err := storage.RestoreBackup(dst, r, storage.RestoreMode(*mode))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%sRestore failed: %s%s\n", MiscLib.ColorRed, err, MiscLib.ColorReset)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "%sRestored: %d inserted, %d replaced, %d skipped, sequence %d%s\n", MiscLib.ColorGreen, rr.Inserted, rr.Replaced, rr.Skipped, rr.Seq, MiscLib.ColorReset)
+	return 0
+}
+
+// HdlrBackup returns a closure that handles /api/v1/backup.  The archive is
+// sent as the response body.
+func HdlrBackup(cfg *ConfigType, data storage.PersistentData) http.Handler {
+	handleFunc := func(www http.ResponseWriter, req *http.Request) {
+		nReq++
+		if !CheckAuthToken(cfg, www, req) {
+			www.WriteHeader(http.StatusUnauthorized) // 401
+			fmt.Fprintf(logFilePtr, "Backup: not authorized, %s\n", godebug.LF())
+			fmt.Fprintf(www, "Error: not authorized.\n")
+			return
+		}
+		www.Header().Set("Content-Type", "application/x-ndjson")
+		www.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="qr-short-%s.jsonl"`, time.Now().UTC().Format("20060102-150405")))
+		n, err := storage.WriteBackup(data, www)
+		if err != nil {
+			// The header has been sent, the client sees a missing trailer and
+			// ReadBackup rejects the archive.
+			fmt.Fprintf(logFilePtr, "Backup: error after %d codes: %s, %s\n", n, err, godebug.LF())
+			return
+		}
+		fmt.Fprintf(logFilePtr, "Backup: %d codes\n", n)
+	}
+	return http.HandlerFunc(handleFunc)
+}
+
+// HdlrRestore returns a closure that handles /api/v1/restore.  The archive is
+// the POST body, ?mode=merge (the default) or ?mode=replace.
+func HdlrRestore(cfg *ConfigType, data storage.PersistentData) http.Handler {
+	handleFunc := func(www http.ResponseWriter, req *http.Request) {
+		nReq++
+		if !CheckAuthToken(cfg, www, req) {
+			www.WriteHeader(http.StatusUnauthorized) // 401
+			fmt.Fprintf(logFilePtr, "Restore: not authorized, %s\n", godebug.LF())
+			fmt.Fprintf(www, "Error: not authorized.\n")
+			return
+		}
+		if req.Method != "POST" {
+			www.WriteHeader(http.StatusMethodNotAllowed) // 405
+			fmt.Fprintf(www, "Error: POST the archive to restore.\n")
+			return
+		}
+		mode := storage.RestoreMode(req.URL.Query().Get("mode"))
+		if mode == "" {
+			mode = storage.RestoreMerge
+		}
+		rr, err := storage.RestoreBackup(data, req.Body, mode)
+		if err != nil {
+			www.WriteHeader(ErrorStatus(err))
+			fmt.Fprintf(logFilePtr, "Restore: %s, %s\n", err, godebug.LF())
+			fmt.Fprintf(www, "Error: restore error: %s\n", err)
+			return
+		}
+		www.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(www, "%s", godebug.SVarI(rr))
+		fmt.Fprintf(logFilePtr, "Restore: %s\n", godebug.SVar(rr))
+	}
+	return http.HandlerFunc(handleFunc)
+}
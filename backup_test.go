@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackupRestoreCLI(t *testing.T) {
+	from := newTestSource(t)
+	archive := filepath.Join(t.TempDir(), "qr.jsonl")
+	if rc := RunBackup([]string{"--from", from, "--out", archive}); rc != 0 {
+		t.Fatalf("backup returned %d", rc)
+	}
+	if _, err := os.Stat(archive + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("backup left %s.tmp behind", archive)
+	}
+
+	to := "bolt:" + filepath.Join(t.TempDir(), "dst.db")
+	if rc := RunRestore([]string{"--to", to, "--in", archive}); rc != 0 {
+		t.Fatalf("restore returned %d", rc)
+	}
+	if rc := RunMigrate([]string{"--from", from, "--to", to, "--verify-only"}); rc != 0 {
+		t.Errorf("restored store does not match the source")
+	}
+	if rc := RunRestore([]string{"--to", to, "--in", archive, "--mode", "bad"}); rc == 0 {
+		t.Errorf("restore --mode bad did not fail")
+	}
+}
+
+func TestBackupRestoreHandlers(t *testing.T) {
+	mux, data := newTestMux(t)
+	data.UpdateInsert("http://example.com/a", "2")
+	data.UpdateInsert("http://example.com/b", "3")
+
+	if rr := doReq(mux, "GET", "/api/v1/backup", nil, false); rr.Code != http.StatusUnauthorized {
+		t.Errorf("backup without auth = %d, expected 401", rr.Code)
+	}
+	rr := doReq(mux, "GET", "/api/v1/backup", nil, true)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("backup = %d %q", rr.Code, rr.Body.String())
+	}
+	archive := rr.Body.Bytes()
+
+	mux2, data2 := newTestMux(t)
+	restore := func(target string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", target, bytes.NewReader(body))
+		req.Header.Set("X-Qr-Auth", testAuthToken)
+		rr := httptest.NewRecorder()
+		mux2.ServeHTTP(rr, req)
+		return rr
+	}
+	if rr := restore("/api/v1/restore", archive[:len(archive)/2]); rr.Code != http.StatusBadRequest {
+		t.Errorf("restore of half an archive = %d, expected 400", rr.Code)
+	}
+	if rr := restore("/api/v1/restore?mode=replace", archive); rr.Code != http.StatusOK {
+		t.Fatalf("restore = %d %q", rr.Code, rr.Body.String())
+	}
+	if got, _ := data2.FetchRaw("3"); got != "http://example.com/b" {
+		t.Errorf("after restore 3 = %q, expected http://example.com/b", got)
+	}
+	if rr := doReq(mux2, "GET", "/api/v1/restore", nil, true); rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET restore = %d, expected 405", rr.Code)
+	}
+}
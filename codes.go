@@ -0,0 +1,332 @@
+package main
+
+// Copyright (C) Philip Schlump 2018-2019.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/American-Certified-Brands/tools/GetVar"
+	"github.com/American-Certified-Brands/tools/qr-short/storage"
+	"github.com/pschlump/godebug"
+)
+
+// HdlrCodes returns a closure that handles /api/v1/codes/{id}, the API for a
+// single code.  All of it requires auth.
+//
+//	GET  /api/v1/codes/{id}				the code as JSON, the same as an item from /list
+//	POST /api/v1/codes/{id}				set owner, title, tags and expiry, see GetMeta
+//	GET  /api/v1/codes/{id}/history		every change to the URL, oldest first
+//	POST /api/v1/codes/{id}/rollback	?version=N, set the URL back to version N, default the one before the last change
+//	POST /api/v1/codes/{id}/lock		the URL can not be changed until it is unlocked
+//	POST /api/v1/codes/{id}/unlock
+//	POST /api/v1/codes/{id}/disable		scans get the inactive page, see ServeInactive
+//	POST /api/v1/codes/{id}/enable
+//	DELETE /api/v1/codes/{id}			the ID is kept as a tombstone and never used again
+//	GET  /api/v1/codes/{id}/schedule	the scheduled destinations
+//	POST /api/v1/codes/{id}/schedule	?url=&from=&until=, add a scheduled destination
+//	DELETE /api/v1/codes/{id}/schedule/{n}	cancel scheduled destination n
+//	POST /api/v1/codes/{id}/pin			?pin=, scanners must enter it, see ServeUnlock
+//	DELETE /api/v1/codes/{id}/pin		remove the PIN
+func HdlrCodes(cfg *ConfigType, data storage.PersistentDataV2) http.Handler {
+	handleFunc := func(www http.ResponseWriter, req *http.Request) {
+		nReq++
+		if db1 {
+			fmt.Printf("Codes: %s, %s\n", godebug.SVarI(req), godebug.LF())
+		}
+		if !CheckAuthToken(cfg, www, req) {
+			www.WriteHeader(http.StatusUnauthorized) // 401
+			fmt.Fprintf(logFilePtr, "Codes: not authorized, %s\n", godebug.LF())
+			fmt.Fprintf(www, "Error: not authorized.\n")
+			return
+		}
+		id, action := req.URL.Path[len("/api/v1/codes/"):], ""
+		if ii := strings.Index(id, "/"); ii >= 0 {
+			id, action = id[:ii], id[ii+1:]
+		}
+		ctx := AuthContext(cfg, www, req)
+
+		var err error
+		switch {
+		case action == "" && req.Method == "GET":
+		case action == "" && req.Method == "POST":
+			var meta storage.CodeMeta
+			if meta, err = GetMeta(cfg, www, req); err == nil {
+				err = data.SetMeta(ctx, id, meta)
+			}
+		case action == "history" && req.Method == "GET":
+			var hist []storage.HistoryEntry
+			if hist, err = data.History(ctx, id); err == nil {
+				sendJSON(www, hist)
+				return
+			}
+		case action == "rollback" && req.Method == "POST":
+			var version int
+			version, err = getVersion(ctx, data, www, req, id)
+			if err == nil {
+				_, err = data.Rollback(ctx, id, version)
+			}
+		case action == "lock" && req.Method == "POST":
+			err = data.Lock(ctx, id)
+		case action == "unlock" && req.Method == "POST":
+			err = data.Unlock(ctx, id)
+		case action == "disable" && req.Method == "POST":
+			err = data.Disable(ctx, id)
+		case action == "enable" && req.Method == "POST":
+			err = data.Enable(ctx, id)
+		case action == "schedule" && req.Method == "GET":
+			var sched []storage.ScheduleEntry
+			if sched, err = data.Schedule(ctx, id); err == nil {
+				sendJSON(www, sched)
+				return
+			}
+		case action == "schedule" && req.Method == "POST":
+			var se storage.ScheduleEntry
+			if se, err = GetSchedule(www, req); err == nil {
+				if se, err = data.AddSchedule(ctx, id, se); err == nil {
+					sendJSON(www, se)
+					return
+				}
+			}
+		case strings.HasPrefix(action, "schedule/") && req.Method == "DELETE":
+			var n int
+			if n, err = strconv.Atoi(action[len("schedule/"):]); err != nil {
+				err = fmt.Errorf("%w: schedule %q", ErrInvalidParam, action[len("schedule/"):])
+			} else {
+				err = data.CancelSchedule(ctx, id, n)
+			}
+		case action == "pin" && req.Method == "POST":
+			found, pin := GetVar.GetVar("pin", www, req)
+			if !found || pin == "" {
+				err = fmt.Errorf("%w: pin is required, DELETE to remove it", ErrInvalidParam)
+			} else {
+				err = data.SetPin(ctx, id, pin)
+			}
+		case action == "pin" && req.Method == "DELETE":
+			err = data.SetPin(ctx, id, "")
+		case action == "" && req.Method == "DELETE":
+			if err = data.Delete(ctx, id); err == nil {
+				www.Header().Set("Content-Type", "application/json; charset=utf-8")
+				fmt.Fprintf(www, `{"status":"success", "id":%q, "deleted":true}`, id)
+				return
+			}
+		default:
+			www.WriteHeader(http.StatusNotFound) // 404
+			fmt.Fprintf(www, "Error: no %s for /api/v1/codes/%s\n", req.Method, req.URL.Path[len("/api/v1/codes/"):])
+			return
+		}
+		if err != nil {
+			www.WriteHeader(ErrorStatus(err))
+			fmt.Fprintf(logFilePtr, "Codes: %s %s: %s, %s\n", req.Method, req.URL.Path, err, godebug.LF())
+			fmt.Fprintf(www, "Error: %s\n", err)
+			return
+		}
+		sendCode(www, req, data, id)
+	}
+	return http.HandlerFunc(handleFunc)
+}
+
+// getVersion returns the version parameter for a rollback.  If there is none
+// it is the version before the last change.
+func getVersion(ctx context.Context, data storage.PersistentDataV2, www http.ResponseWriter, req *http.Request, id string) (int, error) {
+	if found, vs := GetVar.GetVar("version", www, req); found {
+		version, err := strconv.Atoi(vs)
+		if err != nil {
+			return 0, fmt.Errorf("%w: version %q", storage.ErrInvalidRange, vs)
+		}
+		return version, nil
+	}
+	hist, err := data.History(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	if len(hist) == 0 {
+		return 0, fmt.Errorf("%w: %s has no history", storage.ErrNotFound, id)
+	}
+	return len(hist) - 1, nil
+}
+
+// sendJSON sends v as JSON.
+func sendJSON(www http.ResponseWriter, v interface{}) {
+	www.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(www, "%s", godebug.SVarI(v))
+}
+
+// sendCode sends the current state of a code as JSON.
+func sendCode(www http.ResponseWriter, req *http.Request, data storage.PersistentDataV2, id string) {
+	ld, err := data.Code(req.Context(), id)
+	if err != nil {
+		www.WriteHeader(ErrorStatus(err))
+		fmt.Fprintf(www, "Error: %s\n", err)
+		return
+	}
+	sendJSON(www, ld)
+}
+
+// ErrInvalidParam is returned when a request parameter can not be parsed.
+var ErrInvalidParam = errors.New("invalid parameter")
+
+// GetMeta reads the metadata parameters:
+//
+//	owner, title
+//	tags			comma separated
+//	expires			RFC 3339 time or 2006-01-02 (UTC), "never" clears it
+//	ttl				expires this long from now, a Go duration or a number of days, 30d
+//	max_scans		number of scans, 0 clears it
+//	expired_url		where the code goes when it has expired
+//	ios_url, android_url, desktop_url	where that device goes, "none" removes the rule
+//	lang_urls		JSON object, BCP 47 tag -> URL, {"fr":"https://...","de":""}, "" removes the rule
+//	variants		JSON list for an A/B test, [{"Name":"a","URL":"https://...","Weight":50},...], [] removes them
+//	redirect_status	301, 302, 303, 307 or 308, "default" uses the server RedirectStatus
+//	query			what is done with the query string of a scan, append, override, drop or allow
+//	query_allow		the keys passed on with query=allow, "utm_source,ref"
+//	campaign		name of a cfg.Campaigns group of tracking parameters, "none" takes the code out
+//	tracking		JSON object, key -> value, {"utm_source":"qr","utm_content":"{id}"}, "" removes the key
+//	interstitial	template for a page in place of the redirect, "none" redirects, "default" uses the server Interstitial
+func GetMeta(cfg *ConfigType, www http.ResponseWriter, req *http.Request) (meta storage.CodeMeta, err error) {
+	_, meta.Owner = GetVar.GetVar("owner", www, req)
+	_, meta.Title = GetVar.GetVar("title", www, req)
+	if found, tags := GetVar.GetVar("tags", www, req); found {
+		meta.Tags = splitList(tags)
+	}
+	foundExpires, expires := GetVar.GetVar("expires", www, req)
+	foundTTL, ttl := GetVar.GetVar("ttl", www, req)
+	switch {
+	case foundExpires && foundTTL:
+		return meta, fmt.Errorf("%w: use expires or ttl, not both", ErrInvalidParam)
+	case foundExpires:
+		if meta.Expires, err = parseExpires(expires); err != nil {
+			return
+		}
+	case foundTTL:
+		d, err := parseTTL(ttl)
+		if err != nil {
+			return meta, err
+		}
+		exp := time.Now().Add(d).UTC()
+		meta.Expires = &exp
+	}
+	if found, ms := GetVar.GetVar("max_scans", www, req); found {
+		n, err := strconv.Atoi(ms)
+		if err != nil || n < 0 {
+			return meta, fmt.Errorf("%w: max_scans %q", ErrInvalidParam, ms)
+		}
+		meta.MaxScans = n
+		if n == 0 {
+			meta.MaxScans = -1 // clear it, see SetMeta
+		}
+	}
+	_, meta.ExpiredURL = GetVar.GetVar("expired_url", www, req)
+	for _, device := range []string{storage.DeviceIOS, storage.DeviceAndroid, storage.DeviceDesktop} {
+		if found, URL := GetVar.GetVar(device+"_url", www, req); found {
+			if meta.DeviceURLs == nil {
+				meta.DeviceURLs = make(map[string]string)
+			}
+			if URL == "none" {
+				URL = "" // remove it, see SetMeta
+			}
+			meta.DeviceURLs[device] = URL
+		}
+	}
+	if found, rs := GetVar.GetVar("redirect_status", www, req); found {
+		if rs == "default" {
+			meta.RedirectStatus = -1 // clear it, see SetMeta
+		} else if meta.RedirectStatus, err = strconv.Atoi(rs); err != nil || !storage.ValidRedirectStatus(meta.RedirectStatus) {
+			return meta, fmt.Errorf("%w: redirect_status %q, must be 301, 302, 303, 307, 308 or default", ErrInvalidParam, rs)
+		}
+	}
+	_, meta.QueryPolicy = GetVar.GetVar("query", www, req)
+	if found, keys := GetVar.GetVar("query_allow", www, req); found {
+		meta.QueryAllow = splitList(keys)
+	}
+	_, meta.Interstitial = GetVar.GetVar("interstitial", www, req)
+	if found, langURLs := GetVar.GetVar("lang_urls", www, req); found {
+		if err = json.Unmarshal([]byte(langURLs), &meta.LangURLs); err != nil {
+			return meta, fmt.Errorf("%w: lang_urls: %s", ErrInvalidParam, err)
+		}
+	}
+	_, meta.Campaign = GetVar.GetVar("campaign", www, req)
+	if _, ok := cfg.Campaigns[meta.Campaign]; !ok && meta.Campaign != "" && meta.Campaign != storage.NoCampaign {
+		return meta, fmt.Errorf("%w: campaign %q is not in the config", ErrInvalidParam, meta.Campaign)
+	}
+	if found, tracking := GetVar.GetVar("tracking", www, req); found {
+		if err = json.Unmarshal([]byte(tracking), &meta.Tracking); err != nil {
+			return meta, fmt.Errorf("%w: tracking: %s", ErrInvalidParam, err)
+		}
+	}
+	if found, variants := GetVar.GetVar("variants", www, req); found {
+		meta.Variants = []storage.Variant{}
+		if err = json.Unmarshal([]byte(variants), &meta.Variants); err != nil {
+			return meta, fmt.Errorf("%w: variants: %s", ErrInvalidParam, err)
+		}
+	}
+	return
+}
+
+// splitList splits a comma separated list, blanks are trimmed and empty
+// items left out.  The list is not nil.
+func splitList(s string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// parseExpires parses the expires parameter, "never" is a zero time which
+// SetMeta takes as clear the expiry.
+func parseExpires(s string) (*time.Time, error) {
+	if s == "never" {
+		return &time.Time{}, nil
+	}
+	return parseTime("expires", s)
+}
+
+// parseTime parses an RFC 3339 time or a 2006-01-02 date (UTC).
+func parseTime(name, s string) (*time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return &t, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s %q, expected 2006-01-02 or RFC 3339", ErrInvalidParam, name, s)
+}
+
+// GetSchedule reads a scheduled destination from the url, from and until
+// parameters.  The times are RFC 3339 or 2006-01-02.
+func GetSchedule(www http.ResponseWriter, req *http.Request) (se storage.ScheduleEntry, err error) {
+	_, se.URL = GetVar.GetVar("url", www, req)
+	if found, from := GetVar.GetVar("from", www, req); found {
+		if se.From, err = parseTime("from", from); err != nil {
+			return
+		}
+	}
+	if found, until := GetVar.GetVar("until", www, req); found {
+		se.Until, err = parseTime("until", until)
+	}
+	return
+}
+
+// parseTTL parses the ttl parameter, a Go duration, 72h, or a number of days, 30d.
+func parseTTL(s string) (d time.Duration, err error) {
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		var n int
+		if n, err = strconv.Atoi(days); err == nil {
+			d = time.Duration(n) * 24 * time.Hour
+		}
+	} else {
+		d, err = time.ParseDuration(s)
+	}
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%w: ttl %q, expected a duration, 72h, or days, 30d", ErrInvalidParam, s)
+	}
+	return d, nil
+}
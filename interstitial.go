@@ -0,0 +1,118 @@
+package main
+
+// Copyright (C) Philip Schlump 2018-2019.
+
+import (
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/American-Certified-Brands/tools/qr-short/storage"
+	"github.com/pschlump/godebug"
+)
+
+// DefaultInterstitial is the name of the built in interstitial template.
+const DefaultInterstitial = "redirect"
+
+// redirectPage is the built in interstitial.  The page works with redirects
+// or JavaScript turned off in the browser, the link is always there.
+const redirectPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta http-equiv="refresh" content="{{.Delay}};url={{.URL}}">
+<title>{{if .Title}}{{.Title}}{{else}}Redirecting{{end}}</title>
+</head>
+<body>
+{{if .Logo}}<img src="{{.Logo}}" alt="{{.Brand}}" style="max-width:200px">{{end}}
+{{if .Brand}}<h1>{{.Brand}}</h1>{{end}}
+<p>{{if .Title}}{{.Title}}, you{{else}}You{{end}} are being sent to <a href="{{.URL}}">{{.URL}}</a>.</p>
+<p><a href="{{.URL}}">Click here</a> if the page does not open.</p>
+<script>
+setTimeout(function() { window.location.replace({{.URL}}); }, {{.DelayMS}});
+</script>
+</body>
+</html>
+`
+
+// InterstitialData is passed to an interstitial template.
+type InterstitialData struct {
+	ID      string
+	URL     string // where the page goes
+	Title   string // the Title of the code
+	Brand   string // cfg.BrandName
+	Logo    string // cfg.BrandLogo
+	Delay   int    // seconds
+	DelayMS int    // milliseconds, for setTimeout
+}
+
+// LoadTemplates returns the interstitial templates, DefaultInterstitial and
+// each name.html file in cfg.TemplateDir.  A redirect.html file replaces the
+// built in one.
+func LoadTemplates(cfg *ConfigType) (*template.Template, error) {
+	tmpl := template.New("")
+	var err error
+	if cfg.TemplateDir != "" {
+		err = loadTemplateDir(tmpl, cfg.TemplateDir)
+	}
+	if tmpl.Lookup(DefaultInterstitial) == nil {
+		template.Must(tmpl.New(DefaultInterstitial).Parse(redirectPage))
+	}
+	return tmpl, err
+}
+
+func loadTemplateDir(tmpl *template.Template, dir string) error {
+	fns, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return err
+	}
+	for _, fn := range fns {
+		buf, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(filepath.Base(fn), ".html")
+		if _, err = tmpl.New(name).Parse(string(buf)); err != nil {
+			return fmt.Errorf("template %s: %s", fn, err)
+		}
+	}
+	return nil
+}
+
+// interstitialName is the template for a scan of the code, "" to redirect.
+// The code's Interstitial is used if it is set, "none" is a redirect, else
+// cfg.Interstitial.
+func interstitialName(cfg *ConfigType, ci storage.CodeInfo) string {
+	name := cfg.Interstitial
+	if ci.Interstitial != "" {
+		name = ci.Interstitial
+	}
+	if name == storage.NoInterstitial {
+		return ""
+	}
+	return name
+}
+
+// ServeInterstitial sends the interstitial page name that goes to URL.  If
+// there is no template name the DefaultInterstitial is used.
+func ServeInterstitial(cfg *ConfigType, tmpl *template.Template, www http.ResponseWriter, id, name, URL string, ci storage.CodeInfo) {
+	tt := tmpl.Lookup(name)
+	if tt == nil {
+		fmt.Fprintf(logFilePtr, "Error: code %s, no interstitial template %q, %s\n", id, name, godebug.LF())
+		tt = tmpl.Lookup(DefaultInterstitial)
+	}
+	delay := cfg.InterstitialDelay
+	if delay < 0 {
+		delay = 0
+	}
+	www.Header().Set("Content-Type", "text/html; charset=utf-8")
+	www.WriteHeader(http.StatusOK) // 200
+	err := tt.Execute(www, InterstitialData{ID: id, URL: URL, Title: ci.Title, Brand: cfg.BrandName, Logo: cfg.BrandLogo, Delay: delay, DelayMS: delay * 1000})
+	if err != nil {
+		fmt.Fprintf(logFilePtr, "Error: %s, %s\n", err, godebug.LF())
+	}
+}
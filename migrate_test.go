@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// newTestSource returns a file store spec with a few codes, counts and a
+// sequence past the last code.
+func newTestSource(t *testing.T) string {
+	spec := "file:" + filepath.Join(t.TempDir(), "src")
+	src, err := OpenStoreSpec(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	for ii := 0; ii < 5; ii++ {
+		src.Insert("http://example.com/" + strconv.Itoa(ii))
+	}
+	src.UpdateInsert("http://example.com/big", strconv.FormatInt(2500, 36)) // second batch
+	src.SetCount("3", 7)
+	src.SetInfo("3", `{"Owner":"bob"}`)
+	src.SetSeq(3000)
+	return spec
+}
+
+func TestMigrate(t *testing.T) {
+	from := newTestSource(t)
+	to := "bolt:" + filepath.Join(t.TempDir(), "dst.db")
+	cp := filepath.Join(t.TempDir(), "cp.json")
+
+	if rc := RunMigrate([]string{"--from", from, "--to", to, "--checkpoint", cp}); rc != 0 {
+		t.Fatalf("migrate returned %d", rc)
+	}
+	if _, err := os.Stat(cp); !os.IsNotExist(err) {
+		t.Errorf("checkpoint %s not removed after a successful migrate", cp)
+	}
+
+	dst, err := OpenStoreSpecReadOnly(to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if seq, _ := dst.Seq(); seq != 3000 {
+		t.Errorf("destination Seq() = %d, expected 3000", seq)
+	}
+	dat, _ := dst.List("3", "4")
+	if len(dat) != 1 || dat[0].URL != "http://example.com/1" || dat[0].Count != 7 {
+		t.Errorf("destination List(3,4) = %+v, expected http://example.com/1 with a count of 7", dat)
+	}
+	if info, _ := dst.FetchInfo("3"); info != `{"Owner":"bob"}` {
+		t.Errorf("destination FetchInfo(3) = %q, expected the source info", info)
+	}
+	dat, _ = dst.List("2500", "2501")
+	if len(dat) != 1 || dat[0].URL != "http://example.com/big" {
+		t.Errorf("destination List(2500,2501) = %+v, expected http://example.com/big", dat)
+	}
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	from := newTestSource(t)
+	seqFile := filepath.Join(from[len("file:"):], "!seq")
+	os.Remove(seqFile) // a read only source must not repair this
+
+	toDir := filepath.Join(t.TempDir(), "dst")
+	if rc := RunMigrate([]string{"--from", from, "--to", "file:" + toDir, "--dry-run"}); rc != 0 {
+		t.Fatalf("migrate --dry-run returned %d", rc)
+	}
+	if _, err := os.Stat(toDir); !os.IsNotExist(err) {
+		t.Errorf("migrate --dry-run created the destination %s", toDir)
+	}
+	if _, err := os.Stat(seqFile); !os.IsNotExist(err) {
+		t.Errorf("migrate --dry-run wrote to the source %s", seqFile)
+	}
+}
+
+func TestMigrateResumeVerify(t *testing.T) {
+	from := newTestSource(t)
+	to := "file:" + filepath.Join(t.TempDir(), "dst")
+	cp := filepath.Join(t.TempDir(), "cp.json")
+
+	// A checkpoint that says the first batch is done, only the second is copied.
+	if err := saveCheckpoint(cp, &MigrateCheckpoint{From: from, To: to, NextID: 1000, Copied: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if rc := RunMigrate([]string{"--from", from, "--to", to, "--checkpoint", cp, "--resume", "--verify=false"}); rc != 0 {
+		t.Fatalf("migrate --resume returned %d", rc)
+	}
+	if rc := RunMigrate([]string{"--from", from, "--to", to, "--verify-only"}); rc == 0 {
+		t.Errorf("migrate --verify-only did not find the codes that were skipped")
+	}
+	if rc := RunMigrate([]string{"--from", from, "--to", to}); rc != 0 {
+		t.Errorf("migrate returned %d", rc)
+	}
+	if rc := RunMigrate([]string{"--from", from, "--to", to, "--checkpoint", cp, "--resume"}); rc == 0 {
+		t.Errorf("migrate --resume with no checkpoint did not fail")
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+// Copyright (C) Philip Schlump 2018-2019.
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/American-Certified-Brands/tools/qr-short/storage"
+	"github.com/pschlump/godebug"
+)
+
+// Limits on wrong PINs, per code and client.
+const (
+	maxPinFailures = 5
+	pinFailWindow  = 15 * time.Minute
+)
+
+// unlockForm is the page that asks for the PIN of a protected code.
+var unlockForm = template.Must(template.New("unlock").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1"><title>PIN required</title></head>
+<body>
+<h1>This code is protected</h1>
+{{if .Error}}<p style="color:#b00">{{.Error}}</p>{{end}}
+<form method="POST" action="{{.Action}}">
+<label for="pin">Enter the PIN or password:</label>
+<input id="pin" name="pin" type="password" autocomplete="off" autofocus required>
+<button type="submit">Open</button>
+</form>
+</body>
+</html>
+`))
+
+// pinFailures counts the wrong PINs for each code and client.
+var pinFailures = struct {
+	sync.Mutex
+	fails map[string][]time.Time
+}{fails: make(map[string][]time.Time)}
+
+var unlockKey struct {
+	sync.Once
+	key []byte
+}
+
+// ServeUnlock handles a scan of a PIN protected code that has not been
+// unlocked.  A GET is sent the unlock form.  A POST checks the PIN, if it is
+// right the unlock cookie is set and true is returned, the caller then does
+// the redirect.  Wrong PINs are limited per code and client.
+func ServeUnlock(cfg *ConfigType, www http.ResponseWriter, req *http.Request, id string, ci storage.CodeInfo) bool {
+	www.Header().Set("Cache-Control", "no-store")
+	if req.Method != "POST" {
+		sendUnlockForm(www, req, http.StatusOK, "")
+		return false
+	}
+	key := id + "|" + clientAddr(req)
+	if retry := pinRetryAfter(key, time.Now()); retry > 0 {
+		fmt.Fprintf(logFilePtr, "Unlock: %s too many wrong PINs\n", key)
+		www.Header().Set("Retry-After", strconv.Itoa(int(retry/time.Second)+1))
+		sendUnlockForm(www, req, http.StatusTooManyRequests, "Too many wrong PINs, try again later.") // 429
+		return false
+	}
+	if !ci.CheckPin(req.PostFormValue("pin")) {
+		pinFailed(key, time.Now())
+		sendUnlockForm(www, req, http.StatusForbidden, "That PIN is not right.") // 403
+		return false
+	}
+	pinFailures.Lock()
+	delete(pinFailures.fails, key)
+	pinFailures.Unlock()
+	exp := time.Now().Add(unlockDuration(cfg))
+	http.SetCookie(www, &http.Cookie{Name: unlockCookie(id), Value: signUnlock(cfg, id, ci, exp), Path: "/", Expires: exp, HttpOnly: true, Secure: isTLS, SameSite: http.SameSiteLaxMode})
+	return true
+}
+
+func sendUnlockForm(www http.ResponseWriter, req *http.Request, status int, msg string) {
+	www.Header().Set("Content-Type", "text/html; charset=utf-8")
+	www.WriteHeader(status)
+	err := unlockForm.Execute(www, struct{ Action, Error string }{req.URL.RequestURI(), msg})
+	if err != nil {
+		fmt.Fprintf(logFilePtr, "Error: %s, %s\n", err, godebug.LF())
+	}
+}
+
+// Unlocked returns true if the request has a good unlock cookie for id.  The
+// cookie is for the current PIN, it is no good after the PIN is changed.
+func Unlocked(cfg *ConfigType, req *http.Request, id string, ci storage.CodeInfo) bool {
+	cookie, err := req.Cookie(unlockCookie(id))
+	if err != nil {
+		return false
+	}
+	ii := strings.Index(cookie.Value, ".")
+	if ii < 0 {
+		return false
+	}
+	sec, err := strconv.ParseInt(cookie.Value[:ii], 10, 64)
+	if err != nil || time.Now().Unix() >= sec {
+		return false
+	}
+	return hmac.Equal([]byte(cookie.Value), []byte(signUnlock(cfg, id, ci, time.Unix(sec, 0))))
+}
+
+// signUnlock returns the unlock cookie value, the expiry time and an
+// HMAC-SHA256 of the code, the time and the PIN hash.
+func signUnlock(cfg *ConfigType, id string, ci storage.CodeInfo, exp time.Time) string {
+	unlockKey.Do(func() {
+		unlockKey.key = []byte(cfg.UnlockKey)
+		if len(unlockKey.key) == 0 {
+			// Unlocks do not last past a restart of the server.
+			unlockKey.key = make([]byte, 32)
+			rand.Read(unlockKey.key)
+		}
+	})
+	sec := strconv.FormatInt(exp.Unix(), 10)
+	mac := hmac.New(sha256.New, unlockKey.key)
+	fmt.Fprintf(mac, "%s|%s|%s", id, sec, ci.PinHash)
+	return sec + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+func unlockDuration(cfg *ConfigType) time.Duration {
+	if cfg.UnlockMinutes <= 0 {
+		return 60 * time.Minute
+	}
+	return time.Duration(cfg.UnlockMinutes) * time.Minute
+}
+
+// unlockCookie is the name of the cookie that unlocks code id.
+func unlockCookie(id string) string {
+	return "Qr-Unlock-" + id
+}
+
+// clientAddr is the IP address of the client.
+func clientAddr(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// pinRetryAfter returns how long until key can try again, 0 if it can now.
+func pinRetryAfter(key string, now time.Time) time.Duration {
+	pinFailures.Lock()
+	defer pinFailures.Unlock()
+	fails := pinFailures.fails[key]
+	for len(fails) > 0 && now.Sub(fails[0]) >= pinFailWindow {
+		fails = fails[1:]
+	}
+	if len(fails) == 0 {
+		delete(pinFailures.fails, key)
+		return 0
+	}
+	pinFailures.fails[key] = fails
+	if len(fails) < maxPinFailures {
+		return 0
+	}
+	return pinFailWindow - now.Sub(fails[0])
+}
+
+// pinFailed records a wrong PIN for key.
+func pinFailed(key string, now time.Time) {
+	pinFailures.Lock()
+	defer pinFailures.Unlock()
+	pinFailures.fails[key] = append(pinFailures.fails[key], now)
+}
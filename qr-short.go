@@ -6,6 +6,7 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -28,7 +29,6 @@ import (
 	"github.com/pschlump/getHomeDir"
 	"github.com/pschlump/godebug"
 	MonAliveLib "github.com/pschlump/mon-alive/lib" // "github.com/pschlump/mon-alive/lib"
-	"github.com/pschlump/radix.v2/redis"
 )
 
 // xyzzy2000 Wed Mar 20 16:52:43 MDT 2019 -- PJS -- count number of redirects
@@ -40,19 +40,67 @@ import (
 // ConfigType is the global configuration that is read in from cfg.json
 type ConfigType struct {
 	lms.BaseConfigType
-	DataDir       string `default:"~/data"` // ~/data
-	HostPort      string `default:":2004"`  // 2004
-	StorageSystem string `default:"Redis"`  // --store file (default), --store Redis
+	DataDir       string `default:"~/data"`                // ~/data
+	HostPort      string `default:":2004"`                 // 2004
+	StorageSystem string `default:"Redis"`                 // --store file (default), --store Redis, --store bolt, --store postgres, --store memory
+	DBFile        string `default:"~/data/qr-short.db"`    // database file if --store bolt
+	PostgresConn  string `default:"$ENV$QR_SHORT_PG_CONN"` // connection string if --store postgres
 	//	RedisConnectHost string `json:"redis_host" default:"$ENV$REDIS_HOST"`
 	//	RedisConnectAuth string `json:"redis_auth" default:"$ENV$REDIS_AUTH"`
 	//	RedisConnectPort string `json:"redis_port" default:"6379"`
-	RedisPrefix  string `default:"qr"`                       // default "qr"
-	AuthToken    string `default:"$ENV$QR_SHORT_AUTH_TOKEN"` // authorize update/set of redirects
-	CountHits    bool   `default:"false"`                    // Count number of times referenced
-	DataFileDest string `default:"./test-data"`              // Where to store data when it is passed
+	RedisPrefix         string `default:"qr"`                       // default "qr"
+	RedisPoolSize       int    `default:"10"`                       // number of connections in the Redis pool
+	RedisDialTimeout    int    `default:"5"`                        // seconds, timeout on connect/read/write to Redis
+	RedisHealthCheck    int    `default:"30"`                       // seconds between checks of idle Redis connections
+	RedisSentinelAddr   string `default:""`                         // host:port of a Redis Sentinel, find the master through Sentinel
+	RedisSentinelMaster string `default:"mymaster"`                 // name of the master in Sentinel
+	RedisClusterAddr    string `default:""`                         // host:port of a node in a Redis Cluster, use cluster mode
+	AuthToken           string `default:"$ENV$QR_SHORT_AUTH_TOKEN"` // authorize update/set of redirects
+	CountHits           bool   `default:"false"`                    // Count number of times referenced
+	DataFileDest        string `default:"./test-data"`              // Where to store data when it is passed
 	//	LogFileName  string `json:"log_file_name"`
 	//	DebugFlag    string `json:"db_flag"`
 
+	// More auth tokens, token -> user_id (xyzzy2001).  The user_id is the default owner of new codes.
+	AuthUsers map[string]string
+
+	// A disabled code redirects to InactiveURL if it is set, otherwise the
+	// InactivePage file, or a built in page, is sent with a 410.
+	InactiveURL  string
+	InactivePage string
+
+	// An expired code redirects to its own ExpiredURL, or ExpiredURL, or the
+	// ExpiredPage file, or a built in page is sent with a 410.
+	ExpiredURL  string
+	ExpiredPage string
+
+	// Key to sign the unlock cookie for PIN protected codes, if "" a random key
+	// is made at startup.  An unlock lasts UnlockMinutes, 0 is 60.
+	UnlockKey     string `default:"$ENV$QR_SHORT_UNLOCK_KEY"`
+	UnlockMinutes int    `default:"60"`
+
+	// RedirectStatus is the status for codes that do not set their own, 301,
+	// 302, 303, 307 or 308.  A permanent redirect, 301 or 308, can be cached by
+	// scanners and CDNs for PermanentMaxAge seconds, the others are not cached.
+	RedirectStatus  int `default:"307"`
+	PermanentMaxAge int `default:"86400"`
+
+	// Interstitial is the template for a page with a meta refresh, a JavaScript
+	// redirect and a link, that /q/ sends in place of a redirect, "" redirects.
+	// A code can set its own.  The built in template is "redirect", a
+	// TemplateDir/name.html file adds or replaces a template.  The page waits
+	// InterstitialDelay seconds and shows the BrandName and BrandLogo (a URL).
+	Interstitial      string
+	TemplateDir       string
+	InterstitialDelay int `default:"3"`
+	BrandName         string
+	BrandLogo         string
+
+	// Campaigns are groups of tracking parameters, name -> key -> value,
+	// {"spring":{"utm_source":"qr","utm_campaign":"spring"}}.  A code in a
+	// campaign has them set on its URL at redirect, see TrackingParams.
+	Campaigns map[string]map[string]string
+
 	// Default file for TLS setup (Should include path), both must be specified.
 	// These can be over ridden on the command line.
 	//	TLS_crt string `json:"tls_crt" default:""`
@@ -82,8 +130,9 @@ var Note = flag.String("note", "", "User note")
 var Cfg = flag.String("cfg", "cfg.json", "config file, default ./cfg.json")
 var Cli = flag.String("cli", "", "Run as a CLI command intead of a server")
 var DataDir = flag.String("datadir", "", "set directory to put files in if storage is 'file'")
+var DBFile = flag.String("dbfile", "", "set the database file if storage is 'bolt'")
 var MaxCPU = flag.Bool("maxcpu", false, "set max number of CPUs.")
-var Store = flag.String("store", "", "which storage system to use, file, Redis.")
+var Store = flag.String("store", "", "which storage system to use, file, Redis, bolt, postgres, memory.")
 var AuthToken = flag.String("authtoken", "", "auth token for update/set")
 var TLS_crt = flag.String("tls_crt", "", "TLS Signed Publick Key")
 var TLS_key = flag.String("tls_key", "", "TLS Signed Private Key")
@@ -97,10 +146,19 @@ func main() {
 	flag.Parse() // Parse CLI arguments to this, --cfg <name>.json
 
 	fns := flag.Args()
+	if len(fns) > 0 && fns[0] == "migrate" {
+		os.Exit(RunMigrate(fns[1:]))
+	}
+	if len(fns) > 0 && fns[0] == "backup" {
+		os.Exit(RunBackup(fns[1:]))
+	}
+	if len(fns) > 0 && fns[0] == "restore" {
+		os.Exit(RunRestore(fns[1:]))
+	}
 	if *Cli != "" {
 		GetVar.SetCliOpts(Cli, fns)
 	} else if len(fns) != 0 {
-		fmt.Printf("Usage: qr-short [--cfg fn] [--port ####] [--datadir path] [--maxcpu] [--store file|Redis] [--debug flag,flag...] [--authtoken token]\n")
+		fmt.Printf("Usage: qr-short [--cfg fn] [--port ####] [--datadir path] [--dbfile path] [--maxcpu] [--store file|Redis|bolt|postgres|memory] [--debug flag,flag...] [--authtoken token]\n       qr-short migrate --from store --to store [--dry-run] [--resume] [--verify=false]\n       qr-short backup --from store --out file\n       qr-short restore --to store --in file [--mode merge|replace]\n")
 		os.Exit(1)
 	}
 
@@ -117,6 +175,14 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Unable to read confguration: %s error %s\n", *Cfg, err)
 		os.Exit(1)
 	}
+	if gCfg.RedirectStatus != 0 && !storage.ValidRedirectStatus(gCfg.RedirectStatus) {
+		fmt.Fprintf(os.Stderr, "Invalid RedirectStatus %d in %s, must be 301, 302, 303, 307 or 308\n", gCfg.RedirectStatus, *Cfg)
+		os.Exit(1)
+	}
+	if _, err = LoadTemplates(&gCfg); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read templates from %s: %s\n", gCfg.TemplateDir, err)
+		os.Exit(1)
+	}
 	db1 = true
 	db2 = true
 
@@ -197,6 +263,9 @@ func main() {
 	if *DataDir != "" {
 		gCfg.DataDir = *DataDir
 	}
+	if *DBFile != "" {
+		gCfg.DBFile = *DBFile
+	}
 	if *AuthToken != "" {
 		gCfg.AuthToken = *AuthToken
 	}
@@ -205,8 +274,14 @@ func main() {
 		gCfg.StorageSystem = *Store
 	} else if *Store != "" && *Store == "file" {
 		gCfg.StorageSystem = *Store
+	} else if *Store != "" && *Store == "bolt" {
+		gCfg.StorageSystem = *Store
+	} else if *Store != "" && *Store == "postgres" {
+		gCfg.StorageSystem = *Store
+	} else if *Store != "" && *Store == "memory" {
+		gCfg.StorageSystem = *Store
 	} else if *Store != "" {
-		fmt.Fprintf(os.Stderr, "Invalid --store, must be 'file' or 'Redis', supplied [%s]\n", *Store)
+		fmt.Fprintf(os.Stderr, "Invalid --store, must be 'file', 'Redis', 'bolt', 'postgres' or 'memory', supplied [%s]\n", *Store)
 		os.Exit(1)
 	}
 
@@ -218,45 +293,49 @@ func main() {
 	var data storage.PersistentData
 
 	if gCfg.StorageSystem == "file" {
-		data, err = storage.NewFilesystem(getHomeDir.MustExpand(gCfg.DataDir), logFilePtr)
+		data, err = storage.NewFilesystem(getHomeDir.MustExpand(gCfg.DataDir), gCfg.CountHits, logFilePtr)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Fatal: Unable to initialize file system storage: %s\n", err)
 			os.Exit(1)
 		}
-		if gCfg.CountHits {
-			fmt.Fprintf(os.Stderr, "Warning: Unable to count hits with file system storage -- not implemented.\n")
-		}
 	} else if gCfg.StorageSystem == "Redis" {
-		data, err = storage.NewRedisStore(gCfg.RedisConnectHost, gCfg.RedisConnectPort, gCfg.RedisConnectAuth, gCfg.RedisPrefix, gCfg.CountHits, logFilePtr)
+		opts := storage.RedisOptions{
+			PoolSize:    gCfg.RedisPoolSize,
+			DialTimeout: time.Duration(gCfg.RedisDialTimeout) * time.Second,
+			HealthCheck: time.Duration(gCfg.RedisHealthCheck) * time.Second,
+
+			SentinelAddr:   gCfg.RedisSentinelAddr,
+			SentinelMaster: gCfg.RedisSentinelMaster,
+			ClusterAddr:    gCfg.RedisClusterAddr,
+		}
+		data, err = storage.NewRedisStore(gCfg.RedisConnectHost, gCfg.RedisConnectPort, gCfg.RedisConnectAuth, gCfg.RedisPrefix, gCfg.CountHits, opts, logFilePtr)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Fatal: Unable to initialize Redis storage: %s\n", err)
 			os.Exit(1)
 		}
+	} else if gCfg.StorageSystem == "bolt" {
+		data, err = storage.NewBoltStore(getHomeDir.MustExpand(gCfg.DBFile), gCfg.CountHits, logFilePtr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Fatal: Unable to initialize bolt storage: %s\n", err)
+			os.Exit(1)
+		}
+	} else if gCfg.StorageSystem == "postgres" {
+		data, err = storage.NewPostgresStore(gCfg.PostgresConn, gCfg.CountHits, logFilePtr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Fatal: Unable to initialize PostgreSQL storage: %s\n", err)
+			os.Exit(1)
+		}
+	} else if gCfg.StorageSystem == "memory" {
+		fmt.Fprintf(os.Stderr, "Warning: memory storage, nothing will be saved when the server exits.\n")
+		data, _ = storage.NewMemoryStore(gCfg.CountHits, logFilePtr)
 	} else {
-		fmt.Fprintf(os.Stderr, "Internal error >%s< should be 'file' or 'Redis'\n", gCfg.StorageSystem)
+		fmt.Fprintf(os.Stderr, "Internal error >%s< should be 'file', 'Redis', 'bolt', 'postgres' or 'memory'\n", gCfg.StorageSystem)
 		os.Exit(1)
 	}
 
 	// xyzzy - AUTH /getAuth/?un=UU&pw=YY -> Auth Token / Cookie
 
-	mux := http.NewServeMux()
-	mux.Handle("/api/v1/status", http.HandlerFunc(HandleStatus))          //
-	mux.Handle("/status", http.HandlerFunc(HandleStatus))                 //
-	mux.Handle("/api/v1/exit-server", http.HandlerFunc(HandleExitServer)) //
-	mux.Handle("/api/v1/config", http.HandlerFunc(HandleConfig))          //
-
-	mux.Handle("/enc/", HdlrEncode(data))       // http.../url=ToUrl					Auth Req
-	mux.Handle("/enc", HdlrEncode(data))        // http.../url=ToUrl					Auth Req
-	mux.Handle("/upd/", HdlrUpdate(data))       // http.../url=ToUrl&id=Number		Auth Req
-	mux.Handle("/upd", HdlrUpdate(data))        // http.../url=ToUrl&id=Number		Auth Req
-	mux.Handle("/dec/", HdlrDecode(data))       // http.../id=Number
-	mux.Handle("/dec", HdlrDecode(data))        // http.../id=Number
-	mux.Handle("/list/", HdlrList(data))        // http...?beg=NUmber&end=Number		Auth Req.
-	mux.Handle("/list", HdlrList(data))         // http...?beg=NUmber&end=Number		Auth Req.
-	mux.Handle("/bulkLoad", HdlrBulkLoad(data)) //
-	mux.Handle("/q/", HdlrRedirect(data))       //
-	mux.Handle("/t/", HdlrRedirectRaw(data))    //
-	mux.Handle("/", http.FileServer(http.Dir("www")))
+	mux := NewMux(&gCfg, data)
 
 	// ------------------------------------------------------------------------------
 	// Setup signal capture
@@ -267,11 +346,8 @@ func main() {
 	// ------------------------------------------------------------------------------
 	// Live Monitor Setup
 	// ------------------------------------------------------------------------------
-	monClient, err7 := RedisClient()
-	if db_flag["mon-conect"] {
-		fmt.Printf("err7=%v AT: %s\n", err7, godebug.LF())
-	}
-	mon := MonAliveLib.NewMonIt(func() *redis.Client { return monClient }, func(conn *redis.Client) {})
+	monGet, monPut := RedisMonitorConn()
+	mon := MonAliveLib.NewMonIt(monGet, monPut)
 	mon.SendPeriodicIAmAlive("QR-Short-MS")
 
 	// ------------------------------------------------------------------------------
@@ -338,6 +414,35 @@ func main() {
 	wg.Wait()
 }
 
+// NewMux creates the handler for all the end points.  The configuration and
+// storage are passed in so this can be used from tests with a MemoryStore.
+func NewMux(cfg *ConfigType, data storage.PersistentData) *http.ServeMux {
+	ds := storage.AdaptV1(data)
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/v1/status", http.HandlerFunc(HandleStatus)) //
+	mux.Handle("/status", http.HandlerFunc(HandleStatus))        //
+	mux.Handle("/api/v1/exit-server", HandleExitServer(cfg))     //
+	mux.Handle("/api/v1/config", HandleConfig(cfg))              //
+	mux.Handle("/api/v1/backup", HdlrBackup(cfg, data))          // Auth Req
+	mux.Handle("/api/v1/restore", HdlrRestore(cfg, data))        // POST archive, ?mode=merge|replace	Auth Req
+	mux.Handle("/api/v1/codes/", HdlrCodes(cfg, ds))             // GET/POST /api/v1/codes/{id}	Auth Req
+
+	mux.Handle("/enc/", HdlrEncode(cfg, ds))       // http.../url=ToUrl					Auth Req
+	mux.Handle("/enc", HdlrEncode(cfg, ds))        // http.../url=ToUrl					Auth Req
+	mux.Handle("/upd/", HdlrUpdate(cfg, ds))       // http.../url=ToUrl&id=Number		Auth Req
+	mux.Handle("/upd", HdlrUpdate(cfg, ds))        // http.../url=ToUrl&id=Number		Auth Req
+	mux.Handle("/dec/", HdlrDecode(cfg, ds))       // http.../id=Number
+	mux.Handle("/dec", HdlrDecode(cfg, ds))        // http.../id=Number
+	mux.Handle("/list/", HdlrList(cfg, ds))        // http...?beg=NUmber&end=Number		Auth Req.
+	mux.Handle("/list", HdlrList(cfg, ds))         // http...?beg=NUmber&end=Number		Auth Req.
+	mux.Handle("/bulkLoad", HdlrBulkLoad(cfg, ds)) //
+	mux.Handle("/q/", HdlrRedirect(cfg, ds))       //
+	mux.Handle("/t/", HdlrRedirectRaw(cfg, ds))    //
+	mux.Handle("/", http.FileServer(http.Dir("www")))
+	return mux
+}
+
 var nReq = 0
 
 // HandleStatus - server to respond with a working message if up.
@@ -352,17 +457,18 @@ func HandleStatus(www http.ResponseWriter, req *http.Request) {
 }
 
 // HdlrEncode returns a closure that handles /enc/ path.
-func HdlrEncode(data storage.PersistentData) http.Handler {
+func HdlrEncode(cfg *ConfigType, data storage.PersistentDataV2) http.Handler {
 	handleFunc := func(www http.ResponseWriter, req *http.Request) {
 		nReq++
 		if db1 {
 			fmt.Printf("Encode: %s, %s\n", godebug.SVarI(req), godebug.LF())
 		}
-		if !CheckAuthToken(data, www, req) {
+		if !CheckAuthToken(cfg, www, req) {
 			www.WriteHeader(http.StatusUnauthorized) // 401
 			fmt.Fprintf(www, "Error: not authorized.\n")
 			return
 		}
+		ctx := AuthContext(cfg, www, req)
 		found, urlStr := GetVar.GetVar("url", www, req)
 		dataFound, dataStr := GetVar.GetVar("data", www, req)
 
@@ -370,16 +476,32 @@ func HdlrEncode(data storage.PersistentData) http.Handler {
 		// dataStr, _ = url.QueryUnescape(dataStr)
 
 		if found {
-			enc, err := data.Insert(urlStr)
+			meta, err := GetMeta(cfg, www, req)
+			if err != nil {
+				www.WriteHeader(ErrorStatus(err))
+				fmt.Fprintf(www, "Error: encode error: %s\n", err)
+				return
+			}
+			enc, err := data.Insert(ctx, urlStr)
 			if err != nil {
-				www.WriteHeader(http.StatusInternalServerError) // is this the correct error to return at this point?
+				www.WriteHeader(ErrorStatus(err))
 				fmt.Fprintf(logFilePtr, "Encode: list error %s, %s\n", err, godebug.LF())
 				fmt.Fprintf(www, "Error: encode error: %s\n", err)
-				os.Exit(1)
 				return
 			}
+			if meta.Owner == "" {
+				meta.Owner = AuthUser(cfg, www, req)
+			}
+			if !meta.IsZero() {
+				if err = data.SetMeta(ctx, enc, meta); err != nil {
+					www.WriteHeader(ErrorStatus(err))
+					fmt.Fprintf(logFilePtr, "Encode: metadata error %s, %s\n", err, godebug.LF())
+					fmt.Fprintf(www, "Error: encode error: %s\n", err)
+					return
+				}
+			}
 			if dataFound {
-				fn := fmt.Sprintf("%s/%s", gCfg.DataFileDest, enc)
+				fn := fmt.Sprintf("%s/%s", cfg.DataFileDest, enc)
 				ioutil.WriteFile(fn, []byte(dataStr+"\n"), 0644)
 				fmt.Fprintf(os.Stderr, "Data Written To: %s = %s\n", fn, dataStr) // PJS test
 				fmt.Fprintf(logFilePtr, "Data Written To: %s = %s\n", fn, dataStr)
@@ -396,17 +518,18 @@ func HdlrEncode(data storage.PersistentData) http.Handler {
 
 // HdlrUpdate returns a closure that handles /upd/ path.
 // This will update the specified URL.
-func HdlrUpdate(data storage.PersistentData) http.Handler {
+func HdlrUpdate(cfg *ConfigType, data storage.PersistentDataV2) http.Handler {
 	handleFunc := func(www http.ResponseWriter, req *http.Request) {
 		nReq++
 		if db1 {
 			fmt.Printf("Update: %s, %s\n", godebug.SVarI(req), godebug.LF())
 		}
-		if !CheckAuthToken(data, www, req) {
+		if !CheckAuthToken(cfg, www, req) {
 			www.WriteHeader(http.StatusUnauthorized) // 401
 			fmt.Fprintf(www, "Error: not authorized.\n")
 			return
 		}
+		ctx := AuthContext(cfg, www, req)
 
 		foundUrl, urlStr := GetVar.GetVar("url", www, req)
 		foundId, id := GetVar.GetVar("id", www, req)
@@ -416,16 +539,29 @@ func HdlrUpdate(data storage.PersistentData) http.Handler {
 		// dataStr, _ = url.QueryUnescape(dataStr)
 
 		if foundUrl && foundId {
-			enc, err := data.Update(urlStr, id)
+			meta, err := GetMeta(cfg, www, req)
 			if err != nil {
-				www.WriteHeader(http.StatusInternalServerError) // is this the correct error to return at this point?
+				www.WriteHeader(ErrorStatus(err))
+				fmt.Fprintf(www, "Error: update error: %s\n", err)
+				return
+			}
+			enc, err := data.Update(ctx, urlStr, id)
+			if err != nil {
+				www.WriteHeader(ErrorStatus(err))
 				fmt.Fprintf(logFilePtr, "Update: list error %s, %s\n", err, godebug.LF())
 				fmt.Fprintf(www, "Error: update error: %s\n", err)
-				os.Exit(1)
 				return
 			}
+			if !meta.IsZero() {
+				if err = data.SetMeta(ctx, enc, meta); err != nil {
+					www.WriteHeader(ErrorStatus(err))
+					fmt.Fprintf(logFilePtr, "Update: metadata error %s, %s\n", err, godebug.LF())
+					fmt.Fprintf(www, "Error: update error: %s\n", err)
+					return
+				}
+			}
 			if dataFound {
-				fn := fmt.Sprintf("%s/%s", gCfg.DataFileDest, enc)
+				fn := fmt.Sprintf("%s/%s", cfg.DataFileDest, enc)
 				ioutil.WriteFile(fn, []byte(dataStr+"\n"), 0644)
 				fmt.Fprintf(os.Stderr, "Data Written To: %s = %s\n", fn, dataStr) // PJS test
 				fmt.Fprintf(logFilePtr, "Data Written To: %s = %s\n", fn, dataStr)
@@ -443,8 +579,13 @@ func HdlrUpdate(data storage.PersistentData) http.Handler {
 	return http.HandlerFunc(handleFunc)
 }
 
-// HdlrDecode takes an ID and decoes it back to a URL.
-func HdlrDecode(data storage.PersistentData) http.Handler {
+// HdlrDecode takes an ID and decoes it back to a URL.  The URL is the one
+// a scan would go to.  ?at=time shows the URL at that time, see GetSchedule
+// for the format, ?ua=user-agent the URL for that User-Agent and ?lang=fr,en
+// the URL for that Accept-Language.  These are not passed on to the URL, the
+// rest of the query is merged as in a redirect.  A PIN protected code needs
+// the unlock cookie or auth.
+func HdlrDecode(cfg *ConfigType, data storage.PersistentDataV2) http.Handler {
 	handleFunc := func(www http.ResponseWriter, req *http.Request) {
 		nReq++
 		if db1 {
@@ -457,7 +598,7 @@ func HdlrDecode(data storage.PersistentData) http.Handler {
 			id = req.URL.Query().Get("id")
 		}
 
-		qry := req.URL.RawQuery
+		qry := req.URL.Query()
 
 		if id == "" {
 			www.WriteHeader(http.StatusBadRequest)
@@ -469,25 +610,56 @@ func HdlrDecode(data storage.PersistentData) http.Handler {
 			fmt.Printf("Decode: id=%s, %s\n", id, godebug.LF())
 		}
 
-		URL, err := data.Fetch(id)
+		rr := storage.ResolveRequest{Hit: true, Device: ParseDevice(req.UserAgent()), AcceptLanguage: req.Header.Get("Accept-Language")}
+		if vals := req.URL.Query(); vals.Get("at") != "" || vals.Get("ua") != "" || vals.Get("lang") != "" {
+			if vals.Get("at") != "" {
+				at, err := parseTime("at", vals.Get("at"))
+				if err != nil {
+					www.WriteHeader(ErrorStatus(err))
+					fmt.Fprintf(www, "Error: %s\n", err)
+					return
+				}
+				rr.At, rr.Hit = *at, false
+			}
+			if vals.Get("ua") != "" {
+				rr.Device, rr.Hit = ParseDevice(vals.Get("ua")), false
+			}
+			if vals.Get("lang") != "" {
+				rr.AcceptLanguage, rr.Hit = vals.Get("lang"), false
+			}
+			vals.Del("at")
+			vals.Del("ua")
+			vals.Del("lang")
+			qry = vals
+		}
+		res, err := data.Resolve(req.Context(), id, rr)
 		if err != nil {
-			www.WriteHeader(http.StatusExpectationFailed)
+			www.WriteHeader(ErrorStatus(err))
 			fmt.Fprintf(www, "URL Not Found.  Error: %s\n", err)
 			return
 		}
+		if res.Info.PinHash != "" && !Unlocked(cfg, req, id, res.Info) && !CheckAuthToken(cfg, www, req) {
+			www.WriteHeader(http.StatusForbidden) // 403
+			fmt.Fprintf(www, "Error: code %s is protected by a PIN.\n", id)
+			return
+		}
+		URL := res.URL
 
-		// Take care of URLs that arlready have prameters in them.
-		uu := string(URL)
-		sep := "?"
-		if strings.Contains(URL, "?") {
-			sep = "&"
+		uu, err := res.Info.MergeQuery(URL, qry)
+		if err != nil {
+			fmt.Fprintf(logFilePtr, "Error: %s, %s\n", err, godebug.LF())
 		}
-		if qry != "" {
-			uu += sep + qry
+		at := rr.At
+		if at.IsZero() {
+			at = time.Now()
+		}
+		tracking, _ := TrackingParams(cfg, id, res, rr.Device, at)
+		if uu, err = storage.SetQuery(uu, tracking); err != nil {
+			fmt.Fprintf(logFilePtr, "Error: %s, %s\n", err, godebug.LF())
 		}
 
 		if db_flag["db1"] {
-			fmt.Fprintf(os.Stderr, "qry [%s] sep [%s] uu(orig) [%s] final [%s]\n", qry, sep, URL, uu)
+			fmt.Fprintf(os.Stderr, "qry [%s] uu(orig) [%s] final [%s]\n", qry, URL, uu)
 		}
 
 		fmt.Fprintf(www, "%s", uu)
@@ -497,114 +669,37 @@ func HdlrDecode(data storage.PersistentData) http.Handler {
 
 // HdlrRedirect is the real worker in this.  It takes a shortened URL
 // with an ID and redirects it to its destination.
-func HdlrRedirect(data storage.PersistentData) http.Handler {
+func HdlrRedirect(cfg *ConfigType, data storage.PersistentDataV2) http.Handler {
+	tmpl, err := LoadTemplates(cfg)
+	if err != nil {
+		fmt.Fprintf(logFilePtr, "Error: %s, %s\n", err, godebug.LF())
+	}
 	handleFunc := func(www http.ResponseWriter, req *http.Request) {
 		nReq++
 		if db1 {
 			fmt.Printf("Redirect: %s, %s\n", godebug.SVarI(req), godebug.LF())
 		}
 		id := req.URL.Path[len("/q/"):]
-		qry := req.URL.RawQuery
-		fmt.Printf("AT: %s qry ->%s<-\n", godebug.LF(), qry)
-
-		fmt.Printf("id: [%s]\n", id)
-
-		URL, err := data.Fetch(id)
-		if err != nil {
-			fmt.Printf("%sRedirect occurring from [%s] to [%s] -- failed to find in Redis%s\n", MiscLib.ColorCyan, id, URL, MiscLib.ColorReset)
-			www.WriteHeader(http.StatusNotFound)
-			www.Write([]byte("URL Not Found. Error: " + err.Error() + "\n"))
-			return
-		}
-		/*
-			URL, err = url.QueryUnescape(URL)
-			if err != nil {
-				fmt.Printf("%sRedirect occurring from [%s] to [%s] -- error:%s%s\n", MiscLib.ColorCyan, id, URL, err, MiscLib.ColorReset)
-				www.WriteHeader(500)
-				www.Write([]byte("URL Not Found. Error: " + err.Error() + "\n"))
-				return
-			}
-		*/
-
-		fmt.Printf("%sRedirect occurring from [%s] to [%s]%s\n", MiscLib.ColorCyan, id, URL, MiscLib.ColorReset)
-
-		req.Header.Set("X-QR-Short", "Redirected By")
-		req.Header.Set("X-QR-Short-OrigURL", req.RequestURI)
-
-		// xyzzy2000 -- PJS -- count number of redirects
-		data.IncrementRedirectCount(id)
-
-		// Take care of URLs that arlready have prameters in them.
-		uu := string(URL)
-		sep := "?"
-		if strings.Contains(URL, "?") {
-			sep = "&"
-		}
-		if qry != "" {
-			uu += sep + qry
-		}
-
-		http.Redirect(www, req, uu, http.StatusTemporaryRedirect) // 307
+		ServeRedirect(cfg, data, tmpl, www, req, id, false)
 	}
 	return http.HandlerFunc(handleFunc)
 }
 
-// HdlrRedirect is the real worker in this.  It takes a shortened URL
-// with an ID and redirects it to its destination.
-func HdlrRedirectRaw(data storage.PersistentData) http.Handler {
+// HdlrRedirectRaw is HdlrRedirect for /t/, the URL is read with FetchRaw.
+func HdlrRedirectRaw(cfg *ConfigType, data storage.PersistentDataV2) http.Handler {
 	handleFunc := func(www http.ResponseWriter, req *http.Request) {
 		nReq++
 		if db1 {
 			fmt.Printf("Redirect: %s, %s\n", godebug.SVarI(req), godebug.LF())
 		}
 		id := req.URL.Path[len("/t/"):]
-		qry := req.URL.RawQuery
-		fmt.Printf("AT: %s qry ->%s<-\n", godebug.LF(), qry)
-
-		fmt.Printf("id: [%s]\n", id)
-
-		URL, err := data.FetchRaw(id)
-		if err != nil {
-			fmt.Printf("%sRedirect occurring from [%s] to [%s] -- failed to find in Redis%s\n", MiscLib.ColorCyan, id, URL, MiscLib.ColorReset)
-			www.WriteHeader(http.StatusNotFound)
-			www.Write([]byte("URL Not Found. Error: " + err.Error() + "\n"))
-			return
-		}
-		/*
-			URL, err = url.QueryUnescape(URL)
-			if err != nil {
-				fmt.Printf("%sRedirect occurring from [%s] to [%s] -- error:%s%s\n", MiscLib.ColorCyan, id, URL, err, MiscLib.ColorReset)
-				www.WriteHeader(500)
-				www.Write([]byte("URL Not Found. Error: " + err.Error() + "\n"))
-				return
-			}
-		*/
-
-		fmt.Printf("%sRedirect occurring from [%s] to [%s]%s\n", MiscLib.ColorCyan, id, URL, MiscLib.ColorReset)
-
-		req.Header.Set("X-QR-Short", "Redirected By")
-		req.Header.Set("X-QR-Short-OrigURL", req.RequestURI)
-
-		// xyzzy2000 -- PJS -- count number of redirects
-		data.IncrementRedirectCount(id)
-
-		// Take care of URLs that arlready have prameters in them.
-		uu := string(URL)
-		sep := "?"
-		if strings.Contains(URL, "?") {
-			sep = "&"
-		}
-		if qry != "" {
-			uu += sep + qry
-		}
-
-		http.Redirect(www, req, uu, http.StatusTemporaryRedirect) // 307
+		ServeRedirect(cfg, data, nil, www, req, id, true)
 	}
 	return http.HandlerFunc(handleFunc)
 }
 
 // HdlrList returns a closure that handles /list/ path.
-func HdlrList(data storage.PersistentData) http.Handler {
+func HdlrList(cfg *ConfigType, data storage.PersistentDataV2) http.Handler {
 	handleFunc := func(www http.ResponseWriter, req *http.Request) {
 		if db1 {
 			fmt.Printf("List: %s, %s\n", godebug.SVarI(req), godebug.LF())
@@ -612,7 +707,7 @@ func HdlrList(data storage.PersistentData) http.Handler {
 		if db_flag["db002"] {
 			fmt.Fprintf(logFilePtr, "In List at top: %s, %s\n", req.URL.Query(), godebug.LF())
 		}
-		if !CheckAuthToken(data, www, req) {
+		if !CheckAuthToken(cfg, www, req) {
 			www.WriteHeader(http.StatusUnauthorized) // 401
 			fmt.Fprintf(logFilePtr, "List: not authorized, %s\n", godebug.LF())
 			fmt.Fprintf(www, "Error: not authorized.\n")
@@ -626,9 +721,9 @@ func HdlrList(data storage.PersistentData) http.Handler {
 				if db_flag["db002"] {
 					fmt.Fprintf(logFilePtr, "have big/end: %s, %s\n", req.URL.Query(), godebug.LF())
 				}
-				data, err := data.List(begStr, endStr)
+				data, err := data.List(req.Context(), begStr, endStr)
 				if err != nil {
-					www.WriteHeader(http.StatusInternalServerError) // is this the correct error to return at this point?
+					www.WriteHeader(ErrorStatus(err))
 					fmt.Fprintf(logFilePtr, "List: list error %s, %s\n", err, godebug.LF())
 					fmt.Fprintf(www, "Error: list error: %s\n", err)
 					return
@@ -652,24 +747,26 @@ func HdlrList(data storage.PersistentData) http.Handler {
 }
 
 // HdlrBulkLoad returns a closure that handles /enc/ path.
-func HdlrBulkLoad(data storage.PersistentData) http.Handler {
+func HdlrBulkLoad(cfg *ConfigType, data storage.PersistentDataV2) http.Handler {
 	handleFunc := func(www http.ResponseWriter, req *http.Request) {
 		nReq++
 		if db1 {
 			fmt.Printf("BulkLoad: %s, %s\n", godebug.SVarI(req), godebug.LF())
 		}
-		if !CheckAuthToken(data, www, req) {
+		if !CheckAuthToken(cfg, www, req) {
 			www.WriteHeader(http.StatusUnauthorized) // 401
 			fmt.Fprintf(logFilePtr, "BulkLoad: not authorized, %s\n", godebug.LF())
 			fmt.Fprintf(www, "Error: not authorized.\n")
 			return
 		}
+		ctx := AuthContext(cfg, www, req)
 
 		fmt.Printf("%s\n", godebug.LF())
 		type UpdateData struct {
 			Data []struct {
 				URL string `json:"url"`
 				ID  string `json:"id"`
+				storage.CodeMeta
 			}
 		}
 		var respSet []storage.UpdateRespItem
@@ -691,7 +788,15 @@ func HdlrBulkLoad(data storage.PersistentData) http.Handler {
 			}
 			fmt.Printf("%s\n", godebug.LF())
 			for ii, dat := range update.Data {
-				resp := data.UpdateInsert(dat.URL, dat.ID)
+				resp, err := data.UpdateInsert(ctx, dat.URL, dat.ID)
+				if err == nil && !dat.CodeMeta.IsZero() {
+					if err = data.SetMeta(ctx, dat.ID, dat.CodeMeta); err != nil {
+						resp.Msg = fmt.Sprintf("fail:%s", err)
+					}
+				}
+				if err != nil {
+					fmt.Fprintf(logFilePtr, "BulkLoad: %s: %s, %s\n", dat.ID, err, godebug.LF())
+				}
 				resp.Pos = ii
 				respSet = append(respSet, resp)
 			}
@@ -716,11 +821,11 @@ func HdlrBulkLoad(data storage.PersistentData) http.Handler {
 
 // CheckAuthToken looks at either a header or a cookie to determine if the user is
 // authorized.
-func CheckAuthToken(data storage.PersistentData, www http.ResponseWriter, req *http.Request) bool {
+func CheckAuthToken(cfg *ConfigType, www http.ResponseWriter, req *http.Request) bool {
 	if db_flag["db-auth"] {
-		fmt.Printf("In CheckAuthToken: Looking for [%s]\n", gCfg.AuthToken)
+		fmt.Printf("In CheckAuthToken: Looking for [%s]\n", cfg.AuthToken)
 	}
-	if gCfg.AuthToken == "-none-" {
+	if cfg.AuthToken == "-none-" {
 		if db_flag["db-auth"] {
 			fmt.Fprintf(logFilePtr, "%sAuth Success - no authentication%s\n", MiscLib.ColorGreen, MiscLib.ColorReset)
 		}
@@ -733,7 +838,7 @@ func CheckAuthToken(data storage.PersistentData, www http.ResponseWriter, req *h
 		fmt.Printf("Cookie: %s\n", godebug.SVarI(cookie))
 	}
 	if err == nil {
-		if cookie.Value == gCfg.AuthToken {
+		if cookie.Value == cfg.AuthToken {
 			if db_flag["db-auth"] {
 				fmt.Fprintf(logFilePtr, "%sAuth Success - cookie%s\n", MiscLib.ColorGreen, MiscLib.ColorReset)
 			}
@@ -747,7 +852,7 @@ func CheckAuthToken(data storage.PersistentData, www http.ResponseWriter, req *h
 	if db_flag["db-auth"] {
 		fmt.Printf("Header: %s\n", godebug.SVarI(auth))
 	}
-	if auth == gCfg.AuthToken {
+	if auth == cfg.AuthToken {
 		if db_flag["db-auth"] {
 			fmt.Fprintf(logFilePtr, "%sAuth Success - header%s\n", MiscLib.ColorGreen, MiscLib.ColorReset)
 		}
@@ -758,19 +863,81 @@ func CheckAuthToken(data storage.PersistentData, www http.ResponseWriter, req *h
 	if db_flag["db-auth"] {
 		fmt.Printf("Variable: %s\n", auth_key)
 	}
-	if auth_key_found && auth_key == gCfg.AuthToken {
+	if auth_key_found && auth_key == cfg.AuthToken {
 		if db_flag["db-auth"] {
 			fmt.Fprintf(logFilePtr, "%sAuth Success - header%s\n", MiscLib.ColorGreen, MiscLib.ColorReset)
 		}
 		return true
 	}
 
+	if AuthUser(cfg, www, req) != "" {
+		if db_flag["db-auth"] {
+			fmt.Fprintf(logFilePtr, "%sAuth Success - user token%s\n", MiscLib.ColorGreen, MiscLib.ColorReset)
+		}
+		return true
+	}
+
 	if db_flag["db-auth"] {
 		fmt.Fprintf(logFilePtr, "%sAuth Fail%s\n", MiscLib.ColorRed, MiscLib.ColorReset)
 	}
 	return false
 }
 
+// AuthIdentity returns who made a request for the history of a code, the
+// user_id from AuthUser or "auth_token" for the token in the configuration.
+func AuthIdentity(cfg *ConfigType, www http.ResponseWriter, req *http.Request) string {
+	if user := AuthUser(cfg, www, req); user != "" {
+		return user
+	}
+	return "auth_token"
+}
+
+// AuthContext returns the request context with the AuthIdentity as the actor
+// for the history of any code that is changed.
+func AuthContext(cfg *ConfigType, www http.ResponseWriter, req *http.Request) context.Context {
+	return storage.WithActor(req.Context(), AuthIdentity(cfg, www, req))
+}
+
+// AuthUser returns the user_id for the auth token in the request if it is one
+// of cfg.AuthUsers.  It is "" for cfg.AuthToken or no token.  The token is
+// looked for in the same places as CheckAuthToken.
+func AuthUser(cfg *ConfigType, www http.ResponseWriter, req *http.Request) string {
+	if len(cfg.AuthUsers) == 0 {
+		return ""
+	}
+	var tokens []string
+	if cookie, err := req.Cookie("Qr-Auth"); err == nil {
+		tokens = append(tokens, cookie.Value)
+	}
+	tokens = append(tokens, req.Header.Get("X-Qr-Auth"))
+	if found, authKey := GetVar.GetVar("auth_key", www, req); found {
+		tokens = append(tokens, authKey)
+	}
+	for _, tok := range tokens {
+		if user, ok := cfg.AuthUsers[tok]; ok && tok != "" {
+			return user
+		}
+	}
+	return ""
+}
+
+// ErrorStatus returns the HTTP status code for an error from storage.
+func ErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, storage.ErrDeleted), errors.Is(err, storage.ErrExpired):
+		return http.StatusGone // 410
+	case errors.Is(err, storage.ErrNotFound):
+		return http.StatusNotFound // 404
+	case errors.Is(err, storage.ErrInvalidID), errors.Is(err, storage.ErrInvalidRange), errors.Is(err, storage.ErrInvalidBackup), errors.Is(err, ErrInvalidParam):
+		return http.StatusBadRequest // 400
+	case errors.Is(err, storage.ErrConflict):
+		return http.StatusConflict // 409
+	case errors.Is(err, storage.ErrBackendUnavailable), errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return http.StatusServiceUnavailable // 503
+	}
+	return http.StatusInternalServerError // 500
+}
+
 // SetDebugFlags convers from db_flag values to db? Variables.
 func SetDebugFlags() {
 	if db_flag["db1"] {
@@ -793,10 +960,17 @@ func LogFile(f *os.File) {
 }
 
 // HandleExitServer - graceful server shutdown.
-func HandleExitServer(www http.ResponseWriter, req *http.Request) {
+func HandleExitServer(cfg *ConfigType) http.Handler {
+	return http.HandlerFunc(func(www http.ResponseWriter, req *http.Request) {
+		handleExitServer(cfg, www, req)
+	})
+}
+
+func handleExitServer(cfg *ConfigType, www http.ResponseWriter, req *http.Request) {
 
 	// if !IsAuthKeyValid(www, req) {
-	if !CheckAuthToken(nil, www, req) {
+	if !CheckAuthToken(cfg, www, req) {
+		www.WriteHeader(http.StatusUnauthorized) // 401
 		return
 	}
 	if isTLS {
@@ -831,9 +1005,16 @@ func HandleExitServer(www http.ResponseWriter, req *http.Request) {
 	}()
 }
 
-func HandleConfig(www http.ResponseWriter, req *http.Request) {
+// HandleConfig returns the configuration as JSON.
+func HandleConfig(cfg *ConfigType) http.Handler {
+	return http.HandlerFunc(func(www http.ResponseWriter, req *http.Request) {
+		handleConfig(cfg, www, req)
+	})
+}
+
+func handleConfig(cfg *ConfigType, www http.ResponseWriter, req *http.Request) {
 
-	if !lms.IsAuthKeyValid(www, req, &(gCfg.BaseConfigType)) {
+	if !lms.IsAuthKeyValid(www, req, &(cfg.BaseConfigType)) {
 		return
 	}
 	if isTLS {
@@ -842,7 +1023,7 @@ func HandleConfig(www http.ResponseWriter, req *http.Request) {
 	www.Header().Set("Content-Type", "application/json; charset=utf-8")
 
 	www.WriteHeader(http.StatusOK) // 200
-	fmt.Fprintf(www, godebug.SVarI(gCfg))
+	fmt.Fprintf(www, godebug.SVarI(cfg))
 }
 
 // xyzzy - fix this -- really should be by function debug names.
@@ -0,0 +1,892 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/American-Certified-Brands/tools/qr-short/storage"
+)
+
+const testAuthToken = "test-token"
+
+// newTestMux returns the mux with an empty MemoryStore that counts hits.
+func newTestMux(t *testing.T) (*http.ServeMux, storage.PersistentData) {
+	data, err := storage.NewMemoryStore(true, os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &ConfigType{AuthToken: testAuthToken, AuthUsers: map[string]string{"bob-tok": "bob"}, DataFileDest: t.TempDir()}
+	return NewMux(cfg, data), data
+}
+
+// doReq runs a request through the mux.  If auth is true the X-Qr-Auth header is set.
+func doReq(mux http.Handler, method, target string, form url.Values, auth bool) *httptest.ResponseRecorder {
+	var req *http.Request
+	if form != nil {
+		req = httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req = httptest.NewRequest(method, target, nil)
+	}
+	if auth {
+		req.Header.Set("X-Qr-Auth", testAuthToken)
+	}
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestHandlers(t *testing.T) {
+	mux, data := newTestMux(t)
+	data.UpdateInsert("http://example.com/a", "2")
+	data.UpdateInsert("http://example.com/b?x=1", "3")
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		form     url.Values
+		auth     bool
+		status   int
+		body     string // if set the body must contain this
+		location string // if set the Location header must be this
+	}{
+		{"encode no auth", "GET", "/enc?url=http://example.com/c", nil, false, http.StatusUnauthorized, "not authorized", ""},
+		{"encode", "GET", "/enc?url=http://example.com/c", nil, true, http.StatusOK, "5", ""}, // UpdateInsert of 3 moved the sequence to 4, so 5 is next
+		{"encode POST", "POST", "/enc", url.Values{"url": {"http://example.com/d"}}, true, http.StatusOK, "6", ""},
+		{"encode no url", "GET", "/enc", nil, true, http.StatusBadRequest, "", ""},
+		{"update no auth", "GET", "/upd?url=http://example.com/z&id=2", nil, false, http.StatusUnauthorized, "", ""},
+		{"update", "GET", "/upd?url=http://example.com/a2&id=2", nil, true, http.StatusOK, "2", ""},
+		{"update bad id", "GET", "/upd?url=http://example.com/a2&id=a-b", nil, true, http.StatusBadRequest, "", ""},
+		{"update no id", "GET", "/upd?url=http://example.com/a2", nil, true, http.StatusBadRequest, "", ""},
+		{"decode", "GET", "/dec/2", nil, false, http.StatusOK, "http://example.com/a2", ""},
+		{"decode id param", "GET", "/dec?id=3", nil, false, http.StatusOK, "http://example.com/b?x=1&id=3", ""},
+		{"decode unknown", "GET", "/dec/zzz", nil, false, http.StatusNotFound, "", ""},
+		{"decode bad id", "GET", "/dec/a-b", nil, false, http.StatusBadRequest, "", ""},
+		{"decode no id", "GET", "/dec", nil, false, http.StatusBadRequest, "", ""},
+		{"redirect", "GET", "/q/2", nil, false, http.StatusTemporaryRedirect, "", "http://example.com/a2"},
+		{"redirect query", "GET", "/q/3?y=2", nil, false, http.StatusTemporaryRedirect, "", "http://example.com/b?x=1&y=2"},
+		{"redirect unknown", "GET", "/q/zzz", nil, false, http.StatusNotFound, "", ""},
+		{"redirect bad id", "GET", "/q/a-b", nil, false, http.StatusBadRequest, "", ""},
+		{"redirect raw", "GET", "/t/2?y=2", nil, false, http.StatusTemporaryRedirect, "", "http://example.com/a2?y=2"},
+		{"redirect raw unknown", "GET", "/t/zzz", nil, false, http.StatusNotFound, "", ""},
+		{"list no auth", "GET", "/list?beg=0&end=last", nil, false, http.StatusUnauthorized, "", ""},
+		{"list", "GET", "/list?beg=0&end=last", nil, true, http.StatusOK, `"http://example.com/d"`, ""},
+		{"list bad range", "GET", "/list?beg=9&end=2", nil, true, http.StatusBadRequest, "", ""},
+		{"list no range", "GET", "/list", nil, true, http.StatusBadRequest, "", ""},
+		{"bulk load no auth", "POST", "/bulkLoad", url.Values{"update": {`{"Data":[]}`}}, false, http.StatusUnauthorized, "", ""},
+		{"bulk load bad JSON", "POST", "/bulkLoad", url.Values{"update": {`{"Data":`}}, true, http.StatusInternalServerError, "parse error", ""},
+		{"exit server no auth", "GET", "/api/v1/exit-server", nil, false, http.StatusUnauthorized, "", ""},
+	}
+	for _, test := range tests {
+		rr := doReq(mux, test.method, test.target, test.form, test.auth)
+		if rr.Code != test.status {
+			t.Errorf("%s: %s %s status = %d, expected %d, body %q", test.name, test.method, test.target, rr.Code, test.status, rr.Body.String())
+			continue
+		}
+		if test.body != "" && !strings.Contains(rr.Body.String(), test.body) {
+			t.Errorf("%s: body = %q, expected it to contain %q", test.name, rr.Body.String(), test.body)
+		}
+		if test.location != "" && rr.Header().Get("Location") != test.location {
+			t.Errorf("%s: Location = %q, expected %q", test.name, rr.Header().Get("Location"), test.location)
+		}
+	}
+}
+
+// TestEncodeConsecutive checks that each /enc uses exactly one ID.
+func TestEncodeConsecutive(t *testing.T) {
+	mux, _ := newTestMux(t)
+	for _, expect := range []string{"2", "3", "4", "5"} {
+		rr := doReq(mux, "GET", "/enc?url=http://example.com/", nil, true)
+		if rr.Code != http.StatusOK || rr.Body.String() != expect {
+			t.Errorf("/enc = %d %q, expected 200 %q", rr.Code, rr.Body.String(), expect)
+		}
+	}
+}
+
+func TestRedirectCount(t *testing.T) {
+	mux, _ := newTestMux(t)
+	doReq(mux, "GET", "/enc?url=http://example.com/", nil, true)
+	for ii := 0; ii < 3; ii++ {
+		doReq(mux, "GET", "/q/2", nil, false)
+	}
+	rr := doReq(mux, "GET", "/list?beg=0&end=last", nil, true)
+	var dat []storage.ListData
+	if err := json.Unmarshal(rr.Body.Bytes(), &dat); err != nil {
+		t.Fatalf("/list returned %q: %s", rr.Body.String(), err)
+	}
+	if len(dat) != 1 || dat[0].Count != 3 {
+		t.Errorf("/list = %+v, expected 1 item with a count of 3", dat)
+	}
+}
+
+func TestBulkLoad(t *testing.T) {
+	mux, data := newTestMux(t)
+	data.UpdateInsert("http://example.com/old", "a")
+
+	update := `{"Data":[{"url":"http://example.com/new","id":"b"},{"url":"http://example.com/upd","id":"a"},{"url":"http://example.com/bad","id":"not-valid"}]}`
+	rr := doReq(mux, "POST", "/bulkLoad", url.Values{"update": {update}}, true)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("/bulkLoad status = %d, body %q", rr.Code, rr.Body.String())
+	}
+	var resp []storage.UpdateRespItem
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("/bulkLoad returned %q: %s", rr.Body.String(), err)
+	}
+	expect := []struct {
+		id, msgPrefix string
+	}{
+		{"b", "success/insert"},
+		{"a", "success/update"},
+		{"not-valid", "fail:"},
+	}
+	if len(resp) != len(expect) {
+		t.Fatalf("/bulkLoad returned %d items, expected %d: %+v", len(resp), len(expect), resp)
+	}
+	for ii, ex := range expect {
+		if resp[ii].ID != ex.id || resp[ii].Pos != ii || !strings.HasPrefix(resp[ii].Msg, ex.msgPrefix) {
+			t.Errorf("/bulkLoad item %d = %+v, expected ID %s, Pos %d, Msg %s...", ii, resp[ii], ex.id, ii, ex.msgPrefix)
+		}
+	}
+	if got, _ := data.FetchRaw("a"); got != "http://example.com/upd" {
+		t.Errorf("after /bulkLoad a = %q, expected http://example.com/upd", got)
+	}
+}
+
+func TestCheckAuthToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string
+		setup  func(req *http.Request)
+		target string
+		expect bool
+	}{
+		{"header", "tok", func(req *http.Request) { req.Header.Set("X-Qr-Auth", "tok") }, "/", true},
+		{"cookie", "tok", func(req *http.Request) { req.AddCookie(&http.Cookie{Name: "Qr-Auth", Value: "tok"}) }, "/", true},
+		{"auth_key", "tok", func(req *http.Request) {}, "/?auth_key=tok", true},
+		{"wrong header", "tok", func(req *http.Request) { req.Header.Set("X-Qr-Auth", "bad") }, "/", false},
+		{"wrong cookie", "tok", func(req *http.Request) { req.AddCookie(&http.Cookie{Name: "Qr-Auth", Value: "bad"}) }, "/", false},
+		{"nothing", "tok", func(req *http.Request) {}, "/", false},
+		{"none configured", "-none-", func(req *http.Request) {}, "/", true},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.target, nil)
+		test.setup(req)
+		cfg := &ConfigType{AuthToken: test.token, AuthUsers: map[string]string{"bob-tok": "bob"}}
+		if got := CheckAuthToken(cfg, httptest.NewRecorder(), req); got != test.expect {
+			t.Errorf("%s: CheckAuthToken = %v, expected %v", test.name, got, test.expect)
+		}
+	}
+}
+
+// TestMeta checks that owner, title and tags are saved by /enc, /upd and
+// /bulkLoad and returned by /list and /api/v1/codes/{id}.
+func TestMeta(t *testing.T) {
+	mux, _ := newTestMux(t)
+
+	rr := doReq(mux, "POST", "/enc", url.Values{"url": {"http://example.com/a"}, "title": {"Hemp Label"}, "tags": {"hemp, demo"}}, true)
+	if rr.Code != http.StatusOK || rr.Body.String() != "2" {
+		t.Fatalf("/enc = %d %q", rr.Code, rr.Body.String())
+	}
+	// A user token sets the owner.
+	req := httptest.NewRequest("GET", "/enc?url=http://example.com/b", nil)
+	req.Header.Set("X-Qr-Auth", "bob-tok")
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || rr.Body.String() != "3" {
+		t.Fatalf("/enc with a user token = %d %q", rr.Code, rr.Body.String())
+	}
+	rr = doReq(mux, "GET", "/upd?url=http://example.com/a2&id=2&owner=alice", nil, true)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("/upd = %d %q", rr.Code, rr.Body.String())
+	}
+	update := `{"Data":[{"url":"http://example.com/c","id":"4","Owner":"carol","Title":"Bulk","Tags":["x"]}]}`
+	if rr = doReq(mux, "POST", "/bulkLoad", url.Values{"update": {update}}, true); rr.Code != http.StatusOK {
+		t.Fatalf("/bulkLoad = %d %q", rr.Code, rr.Body.String())
+	}
+
+	rr = doReq(mux, "GET", "/list?beg=0&end=last", nil, true)
+	var dat []storage.ListData
+	if err := json.Unmarshal(rr.Body.Bytes(), &dat); err != nil {
+		t.Fatalf("/list returned %q: %s", rr.Body.String(), err)
+	}
+	expect := []struct {
+		owner, title string
+		tags         int
+	}{
+		{"alice", "Hemp Label", 2},
+		{"bob", "", 0},
+		{"carol", "Bulk", 1},
+	}
+	if len(dat) != len(expect) {
+		t.Fatalf("/list returned %d items, expected %d: %s", len(dat), len(expect), rr.Body.String())
+	}
+	for ii, ex := range expect {
+		ld := dat[ii]
+		if ld.Owner != ex.owner || ld.Title != ex.title || len(ld.Tags) != ex.tags || ld.Created == nil || ld.Updated == nil {
+			t.Errorf("/list item %d = %+v, expected owner %q, title %q, %d tags and times", ii, ld, ex.owner, ex.title, ex.tags)
+		}
+	}
+
+	rr = doReq(mux, "POST", "/api/v1/codes/3", url.Values{"title": {"Bob's code"}}, true)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"Bob's code"`) || !strings.Contains(rr.Body.String(), `"bob"`) {
+		t.Errorf("POST /api/v1/codes/3 = %d %q", rr.Code, rr.Body.String())
+	}
+	codeTests := []struct {
+		method, target string
+		auth           bool
+		status         int
+	}{
+		{"GET", "/api/v1/codes/3", false, http.StatusUnauthorized},
+		{"GET", "/api/v1/codes/3", true, http.StatusOK},
+		{"GET", "/api/v1/codes/zzz", true, http.StatusNotFound},
+		{"GET", "/api/v1/codes/a-b", true, http.StatusBadRequest},
+		{"GET", "/api/v1/codes/3/nothing", true, http.StatusNotFound},
+	}
+	for _, test := range codeTests {
+		if rr := doReq(mux, test.method, test.target, nil, test.auth); rr.Code != test.status {
+			t.Errorf("%s %s = %d, expected %d, body %q", test.method, test.target, rr.Code, test.status, rr.Body.String())
+		}
+	}
+}
+
+func TestHistoryAPI(t *testing.T) {
+	mux, _ := newTestMux(t)
+	doReq(mux, "GET", "/enc?url=http://example.com/v1", nil, true)
+	req := httptest.NewRequest("GET", "/upd?url=http://example.com/v2&id=2", nil)
+	req.Header.Set("X-Qr-Auth", "bob-tok")
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+	update := `{"Data":[{"url":"http://example.com/v3","id":"2"}]}`
+	doReq(mux, "POST", "/bulkLoad", url.Values{"update": {update}}, true)
+
+	rr := doReq(mux, "GET", "/api/v1/codes/2/history", nil, true)
+	var hist []storage.HistoryEntry
+	if err := json.Unmarshal(rr.Body.Bytes(), &hist); err != nil {
+		t.Fatalf("history returned %d %q: %s", rr.Code, rr.Body.String(), err)
+	}
+	if len(hist) != 3 || hist[0].Actor != "auth_token" || hist[1].Actor != "bob" || hist[2].NewURL != "http://example.com/v3" {
+		t.Errorf("history = %+v", hist)
+	}
+
+	// With no version the change before the last one is undone.
+	rr = doReq(mux, "POST", "/api/v1/codes/2/rollback", url.Values{}, true)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"http://example.com/v2"`) {
+		t.Errorf("rollback = %d %q", rr.Code, rr.Body.String())
+	}
+	rr = doReq(mux, "POST", "/api/v1/codes/2/rollback", url.Values{"version": {"1"}}, true)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"http://example.com/v1"`) {
+		t.Errorf("rollback to 1 = %d %q", rr.Code, rr.Body.String())
+	}
+	if rr = doReq(mux, "GET", "/q/2", nil, false); rr.Header().Get("Location") != "http://example.com/v1" {
+		t.Errorf("after rollback /q/2 goes to %q", rr.Header().Get("Location"))
+	}
+	if rr = doReq(mux, "POST", "/api/v1/codes/2/rollback", url.Values{"version": {"9"}}, true); rr.Code != http.StatusNotFound {
+		t.Errorf("rollback to 9 = %d, expected 404", rr.Code)
+	}
+	if rr = doReq(mux, "POST", "/api/v1/codes/2/rollback", url.Values{"version": {"x"}}, true); rr.Code != http.StatusBadRequest {
+		t.Errorf("rollback to x = %d, expected 400", rr.Code)
+	}
+	if rr = doReq(mux, "GET", "/api/v1/codes/2/history", nil, false); rr.Code != http.StatusUnauthorized {
+		t.Errorf("history without auth = %d, expected 401", rr.Code)
+	}
+}
+
+func TestLockAPI(t *testing.T) {
+	mux, data := newTestMux(t)
+	doReq(mux, "GET", "/enc?url=http://example.com/a", nil, true)
+	if rr := doReq(mux, "POST", "/api/v1/codes/2/lock", url.Values{}, true); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"Locked": true`) {
+		t.Fatalf("lock = %d %q", rr.Code, rr.Body.String())
+	}
+	if rr := doReq(mux, "GET", "/upd?url=http://example.com/b&id=2", nil, true); rr.Code != http.StatusConflict {
+		t.Errorf("/upd of a locked code = %d %q, expected 409", rr.Code, rr.Body.String())
+	}
+	update := `{"Data":[{"url":"http://example.com/b","id":"2"},{"url":"http://example.com/c","id":"3"}]}`
+	rr := doReq(mux, "POST", "/bulkLoad", url.Values{"update": {update}}, true)
+	var resp []storage.UpdateRespItem
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || len(resp) != 2 {
+		t.Fatalf("bulkLoad returned %q: %v", rr.Body.String(), err)
+	}
+	if !strings.HasPrefix(resp[0].Msg, "fail:") || !strings.Contains(resp[0].Msg, "locked") || resp[1].Msg != "success/insert" {
+		t.Errorf("bulkLoad = %+v, expected the locked code to fail and the other to be inserted", resp)
+	}
+	if URL, _ := data.FetchRaw("2"); URL != "http://example.com/a" {
+		t.Errorf("locked code changed to %q", URL)
+	}
+	if rr := doReq(mux, "GET", "/list?beg=0&end=last", nil, true); !strings.Contains(rr.Body.String(), `"Locked": true`) {
+		t.Errorf("/list does not show the lock: %q", rr.Body.String())
+	}
+
+	if rr := doReq(mux, "POST", "/api/v1/codes/2/unlock", url.Values{}, false); rr.Code != http.StatusUnauthorized {
+		t.Errorf("unlock without auth = %d, expected 401", rr.Code)
+	}
+	if rr := doReq(mux, "POST", "/api/v1/codes/2/unlock", url.Values{}, true); rr.Code != http.StatusOK || strings.Contains(rr.Body.String(), "Locked") {
+		t.Errorf("unlock = %d %q", rr.Code, rr.Body.String())
+	}
+	if rr := doReq(mux, "GET", "/upd?url=http://example.com/b&id=2", nil, true); rr.Code != http.StatusOK {
+		t.Errorf("/upd after unlock = %d %q", rr.Code, rr.Body.String())
+	}
+	if rr := doReq(mux, "GET", "/api/v1/codes/2/lock", nil, true); rr.Code != http.StatusNotFound {
+		t.Errorf("GET lock = %d, expected 404", rr.Code)
+	}
+}
+
+func TestDeleteDisableAPI(t *testing.T) {
+	mux, _ := newTestMux(t)
+	doReq(mux, "GET", "/enc?url=http://example.com/a", nil, true)
+	doReq(mux, "GET", "/enc?url=http://example.com/b", nil, true)
+
+	if rr := doReq(mux, "POST", "/api/v1/codes/2/disable", url.Values{}, true); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"Disabled": true`) {
+		t.Fatalf("disable = %d %q", rr.Code, rr.Body.String())
+	}
+	rr := doReq(mux, "GET", "/q/2", nil, false)
+	if rr.Code != http.StatusGone || !strings.Contains(rr.Body.String(), "no longer active") {
+		t.Errorf("/q of a disabled code = %d %q, expected the inactive page", rr.Code, rr.Body.String())
+	}
+	if rr = doReq(mux, "GET", "/t/2", nil, false); rr.Code != http.StatusGone {
+		t.Errorf("/t of a disabled code = %d, expected 410", rr.Code)
+	}
+	if rr := doReq(mux, "POST", "/api/v1/codes/2/enable", url.Values{}, true); rr.Code != http.StatusOK {
+		t.Errorf("enable = %d %q", rr.Code, rr.Body.String())
+	}
+	if rr = doReq(mux, "GET", "/q/2", nil, false); rr.Header().Get("Location") != "http://example.com/a" {
+		t.Errorf("/q after enable = %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+
+	if rr = doReq(mux, "DELETE", "/api/v1/codes/3", nil, false); rr.Code != http.StatusUnauthorized {
+		t.Errorf("DELETE without auth = %d, expected 401", rr.Code)
+	}
+	if rr = doReq(mux, "DELETE", "/api/v1/codes/3", nil, true); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"deleted":true`) {
+		t.Errorf("DELETE = %d %q", rr.Code, rr.Body.String())
+	}
+	if rr = doReq(mux, "GET", "/q/3", nil, false); rr.Code != http.StatusGone {
+		t.Errorf("/q of a deleted code = %d, expected 410", rr.Code)
+	}
+	if rr = doReq(mux, "GET", "/upd?url=http://example.com/c&id=3", nil, true); rr.Code != http.StatusGone {
+		t.Errorf("/upd of a deleted code = %d, expected 410", rr.Code)
+	}
+	if rr = doReq(mux, "GET", "/list?beg=0&end=last", nil, true); strings.Contains(rr.Body.String(), "example.com/b") {
+		t.Errorf("/list shows the deleted code: %q", rr.Body.String())
+	}
+	if rr = doReq(mux, "GET", "/enc?url=http://example.com/d", nil, true); strings.TrimSpace(rr.Body.String()) == "3" {
+		t.Errorf("/enc reused the deleted ID 3")
+	}
+}
+
+func TestInactiveConfig(t *testing.T) {
+	data, _ := storage.NewMemoryStore(true, os.Stderr)
+	ds := storage.AdaptV1(data)
+	id, _ := ds.Insert(context.Background(), "http://example.com/a")
+	ds.Disable(context.Background(), id)
+
+	page := filepath.Join(t.TempDir(), "inactive.html")
+	ioutil.WriteFile(page, []byte("<p>Gone fishing</p>"), 0644)
+	rr := httptest.NewRecorder()
+	HdlrRedirect(&ConfigType{InactivePage: page}, ds).ServeHTTP(rr, httptest.NewRequest("GET", "/q/"+id, nil))
+	if rr.Code != http.StatusGone || rr.Body.String() != "<p>Gone fishing</p>" {
+		t.Errorf("InactivePage = %d %q", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	HdlrRedirect(&ConfigType{InactiveURL: "http://example.com/sorry", InactivePage: page}, ds).ServeHTTP(rr, httptest.NewRequest("GET", "/q/"+id, nil))
+	if rr.Code != http.StatusFound || rr.Header().Get("Location") != "http://example.com/sorry" {
+		t.Errorf("InactiveURL = %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+}
+
+func TestExpiryAPI(t *testing.T) {
+	mux, _ := newTestMux(t)
+	if rr := doReq(mux, "GET", "/enc?url=http://example.com/a&max_scans=1&expired_url=http://example.com/over", nil, true); rr.Body.String() != "2" {
+		t.Fatalf("/enc = %d %q", rr.Code, rr.Body.String())
+	}
+	if rr := doReq(mux, "GET", "/q/2", nil, false); rr.Header().Get("Location") != "http://example.com/a" {
+		t.Errorf("first scan went to %q", rr.Header().Get("Location"))
+	}
+	rr := doReq(mux, "GET", "/q/2", nil, false)
+	if rr.Code != http.StatusFound || rr.Header().Get("Location") != "http://example.com/over" {
+		t.Errorf("scan past max_scans = %d %q, expected the expired URL", rr.Code, rr.Header().Get("Location"))
+	}
+	if rr = doReq(mux, "GET", "/list?beg=0&end=last", nil, true); !strings.Contains(rr.Body.String(), `"Expired": true`) || !strings.Contains(rr.Body.String(), `"MaxScans": 1`) {
+		t.Errorf("/list does not report the expiry: %q", rr.Body.String())
+	}
+	if rr = doReq(mux, "POST", "/api/v1/codes/2", url.Values{"max_scans": {"0"}, "expires": {"2001-02-03"}}, true); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"Expires": "2001-02-03T00:00:00Z"`) {
+		t.Errorf("set expires = %d %q", rr.Code, rr.Body.String())
+	}
+	if rr = doReq(mux, "GET", "/t/2", nil, false); rr.Header().Get("Location") != "http://example.com/over" {
+		t.Errorf("scan past expires = %d %q, expected the expired URL", rr.Code, rr.Header().Get("Location"))
+	}
+	if rr = doReq(mux, "POST", "/api/v1/codes/2", url.Values{"expires": {"never"}}, true); rr.Code != http.StatusOK || strings.Contains(rr.Body.String(), `"Expires"`) {
+		t.Errorf("clear expires = %d %q", rr.Code, rr.Body.String())
+	}
+	if rr = doReq(mux, "GET", "/q/2", nil, false); rr.Header().Get("Location") != "http://example.com/a" {
+		t.Errorf("scan after clear went to %q", rr.Header().Get("Location"))
+	}
+
+	rr = doReq(mux, "GET", "/enc?url=http://example.com/b&ttl=30d", nil, true)
+	if rr = doReq(mux, "GET", "/api/v1/codes/"+rr.Body.String(), nil, true); !strings.Contains(rr.Body.String(), `"Expires"`) {
+		t.Errorf("ttl did not set Expires: %q", rr.Body.String())
+	}
+	for _, bad := range []string{"ttl=soon", "ttl=-1h", "expires=tomorrow", "max_scans=x", "ttl=1h&expires=never"} {
+		if rr = doReq(mux, "GET", "/enc?url=http://example.com/c&"+bad, nil, true); rr.Code != http.StatusBadRequest {
+			t.Errorf("/enc with %s = %d, expected 400", bad, rr.Code)
+		}
+	}
+
+	// With no ExpiredURL the built in page is sent.
+	doReq(mux, "GET", "/enc?url=http://example.com/d&expires=2001-02-03", nil, true)
+	if rr = doReq(mux, "GET", "/q/4", nil, false); rr.Code != http.StatusGone || !strings.Contains(rr.Body.String(), "expired") {
+		t.Errorf("expired code with no ExpiredURL = %d %q", rr.Code, rr.Body.String())
+	}
+}
+
+func TestScheduleAPI(t *testing.T) {
+	mux, _ := newTestMux(t)
+	doReq(mux, "GET", "/enc?url=http://example.com/product", nil, true)
+
+	launch := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	rr := doReq(mux, "POST", "/api/v1/codes/2/schedule", url.Values{"url": {"http://example.com/pre-launch"}, "until": {launch}}, true)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"N": 1`) {
+		t.Fatalf("add schedule = %d %q", rr.Code, rr.Body.String())
+	}
+	if rr = doReq(mux, "GET", "/q/2?a=1", nil, false); rr.Header().Get("Location") != "http://example.com/pre-launch?a=1" {
+		t.Errorf("/q before launch went to %q", rr.Header().Get("Location"))
+	}
+	if rr = doReq(mux, "GET", "/dec/2?at="+url.QueryEscape(launch)+"&a=1", nil, false); rr.Body.String() != "http://example.com/product?a=1" {
+		t.Errorf("/dec at launch = %d %q", rr.Code, rr.Body.String())
+	}
+	if rr = doReq(mux, "GET", "/dec?id=2&at=2001-01-01", nil, false); rr.Body.String() != "http://example.com/pre-launch?id=2" {
+		t.Errorf("/dec at 2001 = %d %q", rr.Code, rr.Body.String())
+	}
+	if rr = doReq(mux, "GET", "/dec/2?at=soon", nil, false); rr.Code != http.StatusBadRequest {
+		t.Errorf("/dec at=soon = %d, expected 400", rr.Code)
+	}
+	if rr = doReq(mux, "GET", "/api/v1/codes/2/schedule", nil, true); !strings.Contains(rr.Body.String(), "pre-launch") {
+		t.Errorf("list schedule = %q", rr.Body.String())
+	}
+	if rr = doReq(mux, "POST", "/api/v1/codes/2/schedule", url.Values{"url": {"http://example.com/x"}}, true); rr.Code != http.StatusBadRequest {
+		t.Errorf("schedule with no times = %d, expected 400", rr.Code)
+	}
+	if rr = doReq(mux, "DELETE", "/api/v1/codes/2/schedule/1", nil, true); rr.Code != http.StatusOK {
+		t.Errorf("cancel = %d %q", rr.Code, rr.Body.String())
+	}
+	if rr = doReq(mux, "DELETE", "/api/v1/codes/2/schedule/1", nil, true); rr.Code != http.StatusNotFound {
+		t.Errorf("second cancel = %d, expected 404", rr.Code)
+	}
+	if rr = doReq(mux, "DELETE", "/api/v1/codes/2/schedule/x", nil, true); rr.Code != http.StatusBadRequest {
+		t.Errorf("cancel x = %d, expected 400", rr.Code)
+	}
+	if rr = doReq(mux, "GET", "/q/2", nil, false); rr.Header().Get("Location") != "http://example.com/product" {
+		t.Errorf("/q after cancel went to %q", rr.Header().Get("Location"))
+	}
+}
+
+const (
+	testUAiPhone  = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Mobile/15E148 Safari/604.1"
+	testUAAndroid = "Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Mobile Safari/537.36"
+	testUADesktop = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36"
+)
+
+func TestParseDevice(t *testing.T) {
+	tests := []struct {
+		ua, device string
+	}{
+		{testUAiPhone, storage.DeviceIOS},
+		{"Mozilla/5.0 (iPad; CPU OS 12_2 like Mac OS X)", storage.DeviceIOS},
+		{testUAAndroid, storage.DeviceAndroid},
+		{testUADesktop, storage.DeviceDesktop},
+		{"", storage.DeviceDesktop},
+	}
+	for _, test := range tests {
+		if got := ParseDevice(test.ua); got != test.device {
+			t.Errorf("ParseDevice(%q) = %q, expected %q", test.ua, got, test.device)
+		}
+	}
+}
+
+func TestDeviceRouting(t *testing.T) {
+	mux, _ := newTestMux(t)
+	doReq(mux, "GET", "/enc?url=http://example.com/web&ios_url=https://apps.apple.com/app/id1&android_url=https://play.google.com/store/apps/details%3Fid%3Dx", nil, true)
+
+	tests := []struct {
+		ua, location string
+	}{
+		{testUAiPhone, "https://apps.apple.com/app/id1?src=qr"},
+		{testUAAndroid, "https://play.google.com/store/apps/details?id=x&src=qr"},
+		{testUADesktop, "http://example.com/web?src=qr"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/q/2?src=qr", nil)
+		req.Header.Set("User-Agent", test.ua)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if rr.Header().Get("Location") != test.location || rr.Header().Get("Vary") != "User-Agent" {
+			t.Errorf("scan from %q went to %q (Vary %q), expected %q", test.ua, rr.Header().Get("Location"), rr.Header().Get("Vary"), test.location)
+		}
+	}
+
+	rr := doReq(mux, "GET", "/dec/2?ua="+url.QueryEscape(testUAAndroid), nil, false)
+	if rr.Body.String() != "https://play.google.com/store/apps/details?id=x" {
+		t.Errorf("/dec with an Android ua = %q", rr.Body.String())
+	}
+
+	// Edit the rules through the API, none removes one.
+	rr = doReq(mux, "POST", "/api/v1/codes/2", url.Values{"ios_url": {"none"}, "desktop_url": {"http://example.com/desk"}}, true)
+	if rr.Code != http.StatusOK || strings.Contains(rr.Body.String(), "apps.apple.com") || !strings.Contains(rr.Body.String(), `"desktop": "http://example.com/desk"`) {
+		t.Errorf("edit rules = %d %q", rr.Code, rr.Body.String())
+	}
+	if rr = doReq(mux, "GET", "/dec/2?ua="+url.QueryEscape(testUAiPhone), nil, false); rr.Body.String() != "http://example.com/web" {
+		t.Errorf("/dec with an iPhone ua after edit = %q", rr.Body.String())
+	}
+	if rr = doReq(mux, "GET", "/dec/2?ua="+url.QueryEscape(testUADesktop), nil, false); rr.Body.String() != "http://example.com/desk" {
+		t.Errorf("/dec with a desktop ua after edit = %q", rr.Body.String())
+	}
+}
+
+func TestLanguageRouting(t *testing.T) {
+	mux, _ := newTestMux(t)
+	langs := `{"fr":"http://example.com/fr","de":"http://example.com/de"}`
+	doReq(mux, "POST", "/enc", url.Values{"url": {"http://example.com/en"}, "lang_urls": {langs}}, true)
+
+	for accept, location := range map[string]string{
+		"fr-CH, fr;q=0.9, en;q=0.8": "http://example.com/fr",
+		"de":                        "http://example.com/de",
+		"es":                        "http://example.com/en",
+	} {
+		req := httptest.NewRequest("GET", "/q/2", nil)
+		req.Header.Set("Accept-Language", accept)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if rr.Header().Get("Location") != location || rr.Header().Get("Vary") != "Accept-Language" {
+			t.Errorf("scan with %q went to %q (Vary %q), expected %q", accept, rr.Header().Get("Location"), rr.Header().Get("Vary"), location)
+		}
+	}
+	if rr := doReq(mux, "GET", "/dec/2?lang=de-DE", nil, false); rr.Body.String() != "http://example.com/de" {
+		t.Errorf("/dec?lang=de-DE = %q", rr.Body.String())
+	}
+	if rr := doReq(mux, "POST", "/enc", url.Values{"url": {"http://example.com/x"}, "lang_urls": {"{bad"}}, true); rr.Code != http.StatusBadRequest {
+		t.Errorf("/enc with bad lang_urls = %d, expected 400", rr.Code)
+	}
+
+	// The rules in /list load into another server with /bulkLoad.
+	rr := doReq(mux, "GET", "/list?beg=0&end=last", nil, true)
+	var dat []json.RawMessage
+	if err := json.Unmarshal(rr.Body.Bytes(), &dat); err != nil || len(dat) != 1 {
+		t.Fatalf("/list returned %q: %v", rr.Body.String(), err)
+	}
+	item := strings.Replace(string(dat[0]), `"Id"`, `"id"`, 1)
+	mux2, _ := newTestMux(t)
+	rr = doReq(mux2, "POST", "/bulkLoad", url.Values{"update": {`{"Data":[` + item + `]}`}}, true)
+	if !strings.Contains(rr.Body.String(), "success") {
+		t.Fatalf("bulkLoad = %q", rr.Body.String())
+	}
+	rr = doReq(mux2, "GET", "/api/v1/codes/2", nil, true)
+	var ld storage.ListData
+	json.Unmarshal(rr.Body.Bytes(), &ld)
+	if ld.URL != "http://example.com/en" || ld.LangURLs["fr"] != "http://example.com/fr" || ld.LangURLs["de"] != "http://example.com/de" {
+		t.Errorf("after bulkLoad the code is %+v", ld)
+	}
+}
+
+func TestVariantRouting(t *testing.T) {
+	mux, _ := newTestMux(t)
+	variants := `[{"Name":"a","URL":"http://example.com/a","Weight":1},{"Name":"b","URL":"http://example.com/b","Weight":1}]`
+	doReq(mux, "POST", "/enc", url.Values{"url": {"http://example.com/base"}, "variants": {variants}}, true)
+
+	// A new scanner is given a variant and a cookie, then keeps it.
+	rr := doReq(mux, "GET", "/q/2", nil, false)
+	first := rr.Header().Get("Location")
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "Qr-Variant-2" || first != "http://example.com/"+cookies[0].Value {
+		t.Fatalf("first scan went to %q with cookies %v", first, cookies)
+	}
+	for ii := 0; ii < 10; ii++ {
+		req := httptest.NewRequest("GET", "/q/2", nil)
+		req.AddCookie(cookies[0])
+		rr = httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if rr.Header().Get("Location") != first || len(rr.Result().Cookies()) != 0 {
+			t.Fatalf("scan %d with the cookie went to %q, expected %q", ii, rr.Header().Get("Location"), first)
+		}
+	}
+
+	rr = doReq(mux, "GET", "/api/v1/codes/2", nil, true)
+	var ld storage.ListData
+	json.Unmarshal(rr.Body.Bytes(), &ld)
+	if ld.VariantCounts[cookies[0].Value] != 11 || len(ld.Variants) != 2 || ld.Count != 11 {
+		t.Errorf("code = %+v, expected 11 scans of %s", ld, cookies[0].Value)
+	}
+
+	if rr = doReq(mux, "POST", "/api/v1/codes/2", url.Values{"variants": {"[]"}}, true); strings.Contains(rr.Body.String(), `"Variants"`) {
+		t.Errorf("variants=[] did not remove them: %q", rr.Body.String())
+	}
+	if rr = doReq(mux, "GET", "/q/2", nil, false); rr.Header().Get("Location") != "http://example.com/base" || len(rr.Result().Cookies()) != 0 {
+		t.Errorf("scan with no variants went to %q", rr.Header().Get("Location"))
+	}
+	if rr = doReq(mux, "POST", "/api/v1/codes/2", url.Values{"variants": {`[{"Name":"a"}]`}}, true); rr.Code != http.StatusBadRequest {
+		t.Errorf("bad variants = %d, expected 400", rr.Code)
+	}
+}
+
+func TestPinAPI(t *testing.T) {
+	mux, _ := newTestMux(t)
+	doReq(mux, "POST", "/enc", url.Values{"url": {"http://example.com/secret"}}, true)
+	if rr := doReq(mux, "POST", "/api/v1/codes/2/pin", url.Values{"pin": {"12"}}, true); rr.Code != http.StatusBadRequest {
+		t.Errorf("short pin = %d, expected 400", rr.Code)
+	}
+	rr := doReq(mux, "POST", "/api/v1/codes/2/pin", url.Values{"pin": {"4711"}}, true)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"Protected": true`) || strings.Contains(rr.Body.String(), "PinHash") {
+		t.Fatalf("set pin = %d %q", rr.Code, rr.Body.String())
+	}
+
+	// A scan gets the form, not the URL.
+	rr = doReq(mux, "GET", "/q/2?x=1", nil, false)
+	if rr.Code != http.StatusOK || rr.Header().Get("Location") != "" || !strings.Contains(rr.Body.String(), `action="/q/2?x=1"`) {
+		t.Fatalf("scan of a protected code = %d %q", rr.Code, rr.Body.String())
+	}
+	if rr = doReq(mux, "GET", "/dec?id=2", nil, false); rr.Code != http.StatusForbidden || strings.Contains(rr.Body.String(), "secret") {
+		t.Errorf("/dec without auth = %d %q", rr.Code, rr.Body.String())
+	}
+	if rr = doReq(mux, "GET", "/dec?id=2", nil, true); !strings.Contains(rr.Body.String(), "secret") {
+		t.Errorf("/dec with auth = %d %q", rr.Code, rr.Body.String())
+	}
+
+	if rr = doReq(mux, "POST", "/q/2?x=1", url.Values{"pin": {"0000"}}, false); rr.Code != http.StatusForbidden || rr.Header().Get("Location") != "" {
+		t.Errorf("wrong pin = %d", rr.Code)
+	}
+	rr = doReq(mux, "POST", "/q/2?x=1", url.Values{"pin": {"4711"}}, false)
+	cookies := rr.Result().Cookies()
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "http://example.com/secret?x=1" || len(cookies) != 1 || cookies[0].Name != "Qr-Unlock-2" {
+		t.Fatalf("right pin = %d %q %v", rr.Code, rr.Header().Get("Location"), cookies)
+	}
+
+	// The cookie unlocks later scans, a changed one does not.
+	req := httptest.NewRequest("GET", "/q/2", nil)
+	req.AddCookie(cookies[0])
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusTemporaryRedirect || rr.Header().Get("Location") != "http://example.com/secret" {
+		t.Errorf("scan with the cookie = %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+	bad := *cookies[0]
+	bad.Value = strings.Replace(bad.Value, ".", "9.", 1)
+	req = httptest.NewRequest("GET", "/q/2", nil)
+	req.AddCookie(&bad)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || rr.Header().Get("Location") != "" {
+		t.Errorf("scan with a changed cookie = %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+
+	rr = doReq(mux, "GET", "/api/v1/codes/2", nil, true)
+	var ld storage.ListData
+	json.Unmarshal(rr.Body.Bytes(), &ld)
+	if ld.Count != 5 {
+		t.Errorf("Count = %d, expected the 3 scans and 2 /dec, not the PIN posts", ld.Count)
+	}
+
+	// Too many wrong PINs from a client, even the right one is refused.
+	for ii := 0; ii < maxPinFailures; ii++ {
+		doReq(mux, "POST", "/q/2", url.Values{"pin": {"0000"}}, false)
+	}
+	rr = doReq(mux, "POST", "/q/2", url.Values{"pin": {"4711"}}, false)
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("after %d wrong pins = %d, expected 429", maxPinFailures, rr.Code)
+	}
+
+	if rr = doReq(mux, "DELETE", "/api/v1/codes/2/pin", nil, true); rr.Code != http.StatusOK || strings.Contains(rr.Body.String(), "Protected") {
+		t.Errorf("delete pin = %d %q", rr.Code, rr.Body.String())
+	}
+	if rr = doReq(mux, "GET", "/q/2", nil, false); rr.Code != http.StatusTemporaryRedirect {
+		t.Errorf("scan after the pin is removed = %d", rr.Code)
+	}
+}
+
+func TestPinRetryAfter(t *testing.T) {
+	now := time.Now()
+	key := "test|10.0.0.1"
+	for ii := 0; ii < maxPinFailures; ii++ {
+		pinFailed(key, now.Add(time.Duration(ii)*time.Minute))
+	}
+	if retry := pinRetryAfter(key, now.Add(5*time.Minute)); retry != 10*time.Minute {
+		t.Errorf("retry = %s, expected 10m", retry)
+	}
+	if retry := pinRetryAfter(key, now.Add(pinFailWindow)); retry != 0 {
+		t.Errorf("retry after the first failure ends = %s, expected 0", retry)
+	}
+}
+
+func TestRedirectStatus(t *testing.T) {
+	data, _ := storage.NewMemoryStore(true, os.Stderr)
+	cfg := &ConfigType{AuthToken: testAuthToken, DataFileDest: t.TempDir(), RedirectStatus: http.StatusFound, PermanentMaxAge: 3600}
+	mux := NewMux(cfg, data)
+	doReq(mux, "POST", "/enc", url.Values{"url": {"http://example.com/a"}}, true)
+
+	if rr := doReq(mux, "GET", "/q/2", nil, false); rr.Code != http.StatusFound || rr.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("global 302 = %d %q", rr.Code, rr.Header().Get("Cache-Control"))
+	}
+	if rr := doReq(mux, "POST", "/api/v1/codes/2", url.Values{"redirect_status": {"305"}}, true); rr.Code != http.StatusBadRequest {
+		t.Errorf("redirect_status=305 = %d, expected 400", rr.Code)
+	}
+	doReq(mux, "POST", "/api/v1/codes/2", url.Values{"redirect_status": {"308"}}, true)
+	for _, path := range []string{"/q/2", "/t/2"} {
+		if rr := doReq(mux, "GET", path, nil, false); rr.Code != http.StatusPermanentRedirect || rr.Header().Get("Cache-Control") != "public, max-age=3600" {
+			t.Errorf("%s with 308 = %d %q", path, rr.Code, rr.Header().Get("Cache-Control"))
+		}
+	}
+
+	// Not cached past the expiry, or at all with a scan quota.
+	doReq(mux, "POST", "/api/v1/codes/2", url.Values{"ttl": {"10m"}}, true)
+	if rr := doReq(mux, "GET", "/q/2", nil, false); rr.Header().Get("Cache-Control") != "public, max-age=599" && rr.Header().Get("Cache-Control") != "public, max-age=600" {
+		t.Errorf("308 that expires in 10m Cache-Control = %q", rr.Header().Get("Cache-Control"))
+	}
+	doReq(mux, "POST", "/api/v1/codes/2", url.Values{"expires": {"never"}, "max_scans": {"100"}}, true)
+	if rr := doReq(mux, "GET", "/q/2", nil, false); rr.Header().Get("Cache-Control") != "public, max-age=0" {
+		t.Errorf("308 with a scan quota Cache-Control = %q", rr.Header().Get("Cache-Control"))
+	}
+
+	doReq(mux, "POST", "/api/v1/codes/2", url.Values{"redirect_status": {"default"}}, true)
+	if rr := doReq(mux, "GET", "/q/2", nil, false); rr.Code != http.StatusFound {
+		t.Errorf("after redirect_status=default = %d, expected 302", rr.Code)
+	}
+	if status := RedirectStatus(&ConfigType{}, storage.CodeInfo{}); status != http.StatusTemporaryRedirect {
+		t.Errorf("RedirectStatus with nothing set = %d, expected 307", status)
+	}
+}
+
+func TestInterstitial(t *testing.T) {
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, "promo.html"), []byte(`<p>promo {{.ID}} <a href="{{.URL}}">go</a></p>`), 0644)
+	data, _ := storage.NewMemoryStore(true, os.Stderr)
+	cfg := &ConfigType{AuthToken: testAuthToken, DataFileDest: t.TempDir(), TemplateDir: dir, InterstitialDelay: 2, BrandName: "Acme <Co>"}
+	mux := NewMux(cfg, data)
+	doReq(mux, "POST", "/enc", url.Values{"url": {"http://example.com/a?b=1"}}, true)
+
+	if rr := doReq(mux, "GET", "/q/2", nil, false); rr.Code != http.StatusTemporaryRedirect {
+		t.Errorf("no interstitial = %d, expected 307", rr.Code)
+	}
+	if rr := doReq(mux, "POST", "/api/v1/codes/2", url.Values{"interstitial": {"../x"}}, true); rr.Code != http.StatusBadRequest {
+		t.Errorf("interstitial=../x = %d, expected 400", rr.Code)
+	}
+	doReq(mux, "POST", "/api/v1/codes/2", url.Values{"interstitial": {"redirect"}}, true)
+	rr := doReq(mux, "GET", "/q/2?c=2", nil, false)
+	body := rr.Body.String()
+	for _, want := range []string{
+		`content="2;url=http://example.com/a?b=1&amp;c=2"`,
+		`<a href="http://example.com/a?b=1&amp;c=2">Click here</a>`,
+		`window.location.replace("http://example.com/a?b=1\u0026c=2")`,
+		`2000 );`,
+		`<h1>Acme &lt;Co&gt;</h1>`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("interstitial does not have %s: %s", want, body)
+		}
+	}
+	if rr.Code != http.StatusOK || rr.Header().Get("Location") != "" {
+		t.Errorf("interstitial = %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+	if rr = doReq(mux, "GET", "/t/2", nil, false); rr.Code != http.StatusTemporaryRedirect {
+		t.Errorf("/t/ with an interstitial = %d, expected 307", rr.Code)
+	}
+
+	doReq(mux, "POST", "/api/v1/codes/2", url.Values{"interstitial": {"promo"}}, true)
+	if rr = doReq(mux, "GET", "/q/2", nil, false); rr.Body.String() != `<p>promo 2 <a href="http://example.com/a?b=1">go</a></p>` {
+		t.Errorf("promo template = %q", rr.Body.String())
+	}
+	doReq(mux, "POST", "/api/v1/codes/2", url.Values{"interstitial": {"missing"}}, true)
+	if rr = doReq(mux, "GET", "/q/2", nil, false); !strings.Contains(rr.Body.String(), "Click here") {
+		t.Errorf("missing template = %q, expected the built in one", rr.Body.String())
+	}
+
+	// A server default, a code can turn it off.
+	ioutil.WriteFile(filepath.Join(dir, "redirect.html"), []byte(`custom {{.URL}}`), 0644)
+	cfg.Interstitial = "redirect"
+	mux = NewMux(cfg, data)
+	doReq(mux, "POST", "/api/v1/codes/2", url.Values{"interstitial": {"default"}}, true)
+	if rr = doReq(mux, "GET", "/q/2", nil, false); rr.Body.String() != "custom http://example.com/a?b=1" {
+		t.Errorf("replaced redirect template = %q", rr.Body.String())
+	}
+	doReq(mux, "POST", "/api/v1/codes/2", url.Values{"interstitial": {"none"}}, true)
+	if rr = doReq(mux, "GET", "/q/2", nil, false); rr.Code != http.StatusTemporaryRedirect {
+		t.Errorf("interstitial=none = %d, expected 307", rr.Code)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "bad.html"), []byte(`{{.URL`), 0644)
+	if _, err := LoadTemplates(cfg); err == nil {
+		t.Errorf("LoadTemplates with a bad template, expected an error")
+	}
+}
+
+func TestQueryPolicy(t *testing.T) {
+	mux, _ := newTestMux(t)
+	doReq(mux, "POST", "/enc", url.Values{"url": {"http://example.com/p?a=1#top"}}, true)
+
+	if rr := doReq(mux, "GET", "/q/2?a=2", nil, false); rr.Header().Get("Location") != "http://example.com/p?a=1&a=2#top" {
+		t.Errorf("append = %q", rr.Header().Get("Location"))
+	}
+	if rr := doReq(mux, "POST", "/api/v1/codes/2", url.Values{"query": {"merge"}}, true); rr.Code != http.StatusBadRequest {
+		t.Errorf("query=merge = %d, expected 400", rr.Code)
+	}
+	doReq(mux, "POST", "/api/v1/codes/2", url.Values{"query": {"override"}}, true)
+	if rr := doReq(mux, "GET", "/q/2?a=2", nil, false); rr.Header().Get("Location") != "http://example.com/p?a=2#top" {
+		t.Errorf("override = %q", rr.Header().Get("Location"))
+	}
+	doReq(mux, "POST", "/api/v1/codes/2", url.Values{"query": {"allow"}, "query_allow": {"ref, src"}}, true)
+	if rr := doReq(mux, "GET", "/t/2?a=2&ref=x", nil, false); rr.Header().Get("Location") != "http://example.com/p?a=1&ref=x#top" {
+		t.Errorf("allow = %q", rr.Header().Get("Location"))
+	}
+	if rr := doReq(mux, "GET", "/dec/2?a=2&src=y&ua=iPhone", nil, false); rr.Body.String() != "http://example.com/p?a=1&src=y#top" {
+		t.Errorf("/dec with allow = %q", rr.Body.String())
+	}
+	doReq(mux, "POST", "/api/v1/codes/2", url.Values{"query": {"drop"}}, true)
+	if rr := doReq(mux, "GET", "/q/2?a=2&ref=x", nil, false); rr.Header().Get("Location") != "http://example.com/p?a=1#top" {
+		t.Errorf("drop = %q", rr.Header().Get("Location"))
+	}
+}
+
+func TestTracking(t *testing.T) {
+	data, _ := storage.NewMemoryStore(true, os.Stderr)
+	cfg := &ConfigType{AuthToken: testAuthToken, DataFileDest: t.TempDir(), Campaigns: map[string]map[string]string{
+		"spring": {"utm_source": "qr", "utm_campaign": "spring", "utm_content": "{id}-{date}"},
+	}}
+	mux := NewMux(cfg, data)
+	doReq(mux, "POST", "/enc", url.Values{"url": {"http://example.com/p?utm_source=old#x"}}, true)
+
+	if rr := doReq(mux, "POST", "/api/v1/codes/2", url.Values{"campaign": {"fall"}}, true); rr.Code != http.StatusBadRequest {
+		t.Errorf("campaign=fall = %d, expected 400", rr.Code)
+	}
+	doReq(mux, "POST", "/api/v1/codes/2", url.Values{"campaign": {"spring"}}, true)
+	today := time.Now().UTC().Format("2006-01-02")
+	if rr := doReq(mux, "GET", "/q/2?utm_campaign=fake", nil, false); rr.Header().Get("Location") != "http://example.com/p?utm_campaign=spring&utm_content=2-"+today+"&utm_source=qr#x" {
+		t.Errorf("campaign = %q", rr.Header().Get("Location"))
+	}
+	if rr := doReq(mux, "GET", "/dec/2?at=2030-01-02", nil, false); rr.Body.String() != "http://example.com/p?utm_campaign=spring&utm_content=2-2030-01-02&utm_source=qr#x" {
+		t.Errorf("/dec?at= = %q", rr.Body.String())
+	}
+
+	// The code's own over the campaign.
+	doReq(mux, "POST", "/api/v1/codes/2", url.Values{"tracking": {`{"utm_source":"flyer","utm_term":"{device}"}`}, "redirect_status": {"301"}}, true)
+	rr := doReq(mux, "GET", "/q/2", nil, false)
+	if loc := rr.Header().Get("Location"); !strings.Contains(loc, "utm_source=flyer") || !strings.Contains(loc, "utm_term=desktop") || !strings.Contains(loc, "utm_campaign=spring") {
+		t.Errorf("tracking = %q", loc)
+	}
+	if !strings.HasPrefix(rr.Header().Get("Cache-Control"), "public") {
+		t.Errorf("301 without the time Cache-Control = %q", rr.Header().Get("Cache-Control"))
+	}
+	doReq(mux, "POST", "/api/v1/codes/2", url.Values{"tracking": {`{"ts":"{unix}"}`}}, true)
+	if rr = doReq(mux, "GET", "/q/2", nil, false); rr.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("301 with {unix} Cache-Control = %q", rr.Header().Get("Cache-Control"))
+	}
+
+	doReq(mux, "POST", "/api/v1/codes/2", url.Values{"campaign": {"none"}, "tracking": {`{"utm_source":"","utm_term":"","ts":""}`}}, true)
+	if rr = doReq(mux, "GET", "/q/2", nil, false); rr.Header().Get("Location") != "http://example.com/p?utm_source=old#x" {
+		t.Errorf("no tracking = %q", rr.Header().Get("Location"))
+	}
+}
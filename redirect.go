@@ -0,0 +1,226 @@
+package main
+
+// Copyright (C) Philip Schlump 2018-2019.
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/American-Certified-Brands/tools/qr-short/storage"
+	"github.com/pschlump/MiscLib"
+	"github.com/pschlump/godebug"
+)
+
+// ServeRedirect sends a scan of id to its destination.  The User-Agent picks
+// the device rule, see ParseDevice, and the Accept-Language the language rule.
+// For an A/B test a cookie keeps the scanner on the same variant.  A PIN
+// protected code is sent the unlock form first, see ServeUnlock.  The status
+// is from RedirectStatus, the Cache-Control from CacheControl.  With tmpl an
+// interstitial page is sent in place of the redirect, see interstitialName.
+// If raw the URL is read with FetchRaw.  The query string of the scan is
+// merged into the URL by the QueryPolicy, see MergeQuery, then the tracking
+// parameters are set, see TrackingParams.
+func ServeRedirect(cfg *ConfigType, data storage.PersistentDataV2, tmpl *template.Template, www http.ResponseWriter, req *http.Request, id string, raw bool) {
+	// A POST is the PIN for a protected code, the scan was counted when the
+	// form was sent.
+	rr := storage.ResolveRequest{Hit: req.Method != "POST", Raw: raw, Device: ParseDevice(req.UserAgent()), AcceptLanguage: req.Header.Get("Accept-Language")}
+	if cookie, err := req.Cookie(variantCookie(id)); err == nil {
+		rr.Variant = cookie.Value
+	}
+	res, err := data.Resolve(req.Context(), id, rr)
+	switch {
+	case errors.Is(err, storage.ErrDisabled):
+		ServeInactive(cfg, www, req, id)
+		return
+	case errors.Is(err, storage.ErrExpired):
+		ServeExpired(cfg, www, req, id, res.Info)
+		return
+	case err != nil:
+		fmt.Printf("%sRedirect occurring from [%s] -- failed to find: %s%s\n", MiscLib.ColorCyan, id, err, MiscLib.ColorReset)
+		www.WriteHeader(ErrorStatus(err))
+		www.Write([]byte("URL Not Found. Error: " + err.Error() + "\n"))
+		return
+	}
+	status := RedirectStatus(cfg, res.Info)
+	cacheControl := CacheControl(cfg, status, res.Info, time.Now())
+	if res.Info.PinHash != "" {
+		// The unlock is per scanner.
+		cacheControl = "private, no-store"
+	}
+	if res.Info.PinHash != "" && !Unlocked(cfg, req, id, res.Info) {
+		if !ServeUnlock(cfg, www, req, id, res.Info) {
+			return
+		}
+		status = http.StatusSeeOther // 303, the browser does a GET, the PIN is not sent on
+	}
+	URL := res.URL
+	fmt.Printf("%sRedirect occurring from [%s] to [%s] %s%s\n", MiscLib.ColorCyan, id, URL, res.Rule, MiscLib.ColorReset)
+
+	// xyzzy2000 -- PJS -- count number of redirects
+	data.IncrementRedirectCount(req.Context(), id)
+
+	if len(res.Info.DeviceURLs) > 0 {
+		www.Header().Add("Vary", "User-Agent")
+	}
+	if len(res.Info.LangURLs) > 0 {
+		www.Header().Add("Vary", "Accept-Language")
+	}
+	if res.Variant != "" {
+		// The scanner gets the same variant next time.
+		cacheControl = "private, no-store"
+		if res.Variant != rr.Variant {
+			http.SetCookie(www, &http.Cookie{Name: variantCookie(id), Value: res.Variant, Path: "/", MaxAge: variantCookieAge, HttpOnly: true})
+		}
+	}
+
+	uu, err := res.Info.MergeQuery(URL, req.URL.Query())
+	if err != nil {
+		fmt.Fprintf(logFilePtr, "Error: %s, %s\n", err, godebug.LF())
+	}
+	tracking, perScan := TrackingParams(cfg, id, res, rr.Device, time.Now())
+	if uu, err = storage.SetQuery(uu, tracking); err != nil {
+		fmt.Fprintf(logFilePtr, "Error: %s, %s\n", err, godebug.LF())
+	}
+	if perScan && strings.HasPrefix(cacheControl, "public") {
+		cacheControl = "no-store"
+	}
+
+	www.Header().Set("Cache-Control", cacheControl)
+	if name := interstitialName(cfg, res.Info); tmpl != nil && name != "" {
+		ServeInterstitial(cfg, tmpl, www, id, name, uu, res.Info)
+		return
+	}
+	http.Redirect(www, req, uu, status)
+}
+
+// RedirectStatus is the status for a redirect of the code, its own
+// RedirectStatus or the cfg one, 307 if neither is set.
+func RedirectStatus(cfg *ConfigType, ci storage.CodeInfo) int {
+	switch {
+	case ci.RedirectStatus != 0:
+		return ci.RedirectStatus
+	case cfg.RedirectStatus != 0:
+		return cfg.RedirectStatus
+	}
+	return http.StatusTemporaryRedirect // 307
+}
+
+// CacheControl is the Cache-Control for a redirect with status.  A permanent
+// redirect is public for cfg.PermanentMaxAge seconds, but not past the time
+// the code expires or a scheduled URL starts or ends.  Other redirects can
+// change and are not cached.
+func CacheControl(cfg *ConfigType, status int, ci storage.CodeInfo, now time.Time) string {
+	if status != http.StatusMovedPermanently && status != http.StatusPermanentRedirect {
+		return "no-store"
+	}
+	maxAge := time.Duration(cfg.PermanentMaxAge) * time.Second
+	if cfg.PermanentMaxAge <= 0 {
+		maxAge = 24 * time.Hour
+	}
+	until := func(tt *time.Time) {
+		if tt != nil && tt.After(now) && tt.Sub(now) < maxAge {
+			maxAge = tt.Sub(now)
+		}
+	}
+	until(ci.Expires)
+	for ii := range ci.Schedule {
+		until(ci.Schedule[ii].From)
+		until(ci.Schedule[ii].Until)
+	}
+	if ci.MaxScans > 0 {
+		maxAge = 0 // every scan has to be counted
+	}
+	return fmt.Sprintf("public, max-age=%d", int(maxAge/time.Second))
+}
+
+// variantCookieAge is how long, in seconds, a scanner stays on a variant.
+const variantCookieAge = 90 * 24 * 60 * 60
+
+// variantCookie is the name of the cookie with the A/B variant for code id.
+func variantCookie(id string) string {
+	return "Qr-Variant-" + id
+}
+
+// ParseDevice returns the device for a User-Agent, DeviceIOS, DeviceAndroid or
+// DeviceDesktop for everything else.  An iPad with iPadOS 13 or later says it
+// is a Mac and is desktop.
+func ParseDevice(ua string) string {
+	switch {
+	case strings.Contains(ua, "Android"):
+		return storage.DeviceAndroid
+	case strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPad"), strings.Contains(ua, "iPod"):
+		return storage.DeviceIOS
+	}
+	return storage.DeviceDesktop
+}
+
+// inactivePage is sent for a disabled code if there is no InactiveURL or
+// InactivePage in the config.
+const inactivePage = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Code no longer active</title></head>
+<body>
+<h1>This code is no longer active</h1>
+<p>The QR code %s has been turned off by its owner.</p>
+</body>
+</html>
+`
+
+// expiredPage is sent for an expired code if there is no ExpiredURL for the
+// code or in the config and no ExpiredPage.
+const expiredPage = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Code expired</title></head>
+<body>
+<h1>This code has expired</h1>
+<p>The offer for QR code %s is over.</p>
+</body>
+</html>
+`
+
+// ServeInactive answers a scan of a disabled code.  It redirects to
+// cfg.InactiveURL, or sends the cfg.InactivePage file, or the built in page.
+func ServeInactive(cfg *ConfigType, www http.ResponseWriter, req *http.Request, id string) {
+	fmt.Fprintf(logFilePtr, "Redirect: %s is disabled\n", id)
+	serveGone(www, req, id, cfg.InactiveURL, cfg.InactivePage, inactivePage)
+}
+
+// ServeExpired answers a scan of an expired code.  It redirects to the
+// ExpiredURL of the code or cfg.ExpiredURL, or sends the cfg.ExpiredPage file,
+// or the built in page.
+func ServeExpired(cfg *ConfigType, www http.ResponseWriter, req *http.Request, id string, ci storage.CodeInfo) {
+	fmt.Fprintf(logFilePtr, "Redirect: %s has expired\n", id)
+	to := cfg.ExpiredURL
+	if ci.ExpiredURL != "" {
+		to = ci.ExpiredURL
+	}
+	serveGone(www, req, id, to, cfg.ExpiredPage, expiredPage)
+}
+
+// serveGone redirects to to, if it is set, or sends the page file, or the
+// builtin page, with a 410.  The redirect is a 302, the code may come back.
+func serveGone(www http.ResponseWriter, req *http.Request, id, to, pageFile, builtin string) {
+	if to != "" {
+		http.Redirect(www, req, to, http.StatusFound) // 302
+		return
+	}
+	page := []byte(fmt.Sprintf(builtin, html.EscapeString(id)))
+	if pageFile != "" {
+		buf, err := ioutil.ReadFile(pageFile)
+		if err != nil {
+			fmt.Fprintf(logFilePtr, "Error: %s, %s\n", err, godebug.LF())
+		} else {
+			page = buf
+		}
+	}
+	www.Header().Set("Content-Type", "text/html; charset=utf-8")
+	www.Header().Set("Cache-Control", "no-store")
+	www.WriteHeader(http.StatusGone) // 410
+	www.Write(page)
+}
@@ -0,0 +1,453 @@
+package storage
+
+// Copyright (C) Philip Schlump 2018-2019.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// V1Adapter implements PersistentDataV2 on top of a PersistentData.  It checks
+// the context before each call, validates IDs and converts the errors from
+// the backend into the errors in errors.go.  It also keeps the CodeInfo for
+// each code up to date.
+type V1Adapter struct {
+	Data     PersistentData
+	infoLock sync.Mutex // held for read-modify-write of a CodeInfo
+}
+
+// AdaptV1 wraps a PersistentData so that it can be used as a PersistentDataV2.
+func AdaptV1(data PersistentData) PersistentDataV2 {
+	return &V1Adapter{Data: data}
+}
+
+// ValidID returns ErrInvalidID if ID is not a base 36 code.
+func ValidID(ID string) error {
+	if ID == "" {
+		return fmt.Errorf("%w: empty", ErrInvalidID)
+	}
+	if _, err := strconv.ParseInt(ID, 36, 64); err != nil {
+		return fmt.Errorf("%w: %q", ErrInvalidID, ID)
+	}
+	return nil
+}
+
+// backendError wraps err in ErrBackendUnavailable unless it is already one of
+// the errors in errors.go.
+func backendError(err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, e := range []error{ErrNotFound, ErrConflict, ErrInvalidID, ErrInvalidRange, ErrBackendUnavailable, ErrReadOnly} {
+		if errors.Is(err, e) {
+			return err
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrBackendUnavailable, err)
+}
+
+// Insert allocates a new ID and saves the URL under it.
+func (a *V1Adapter) Insert(ctx context.Context, URL string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	ID, err := a.Data.Insert(URL)
+	if err != nil {
+		return ID, backendError(err)
+	}
+	return ID, a.updateInfo(ID, func(ci *CodeInfo) error {
+		now := time.Now()
+		ci.touch(now)
+		ci.addHistory(ctx, "insert", "", URL, now)
+		return nil
+	})
+}
+
+// Exists returns true if the ID exists.
+func (a *V1Adapter) Exists(ctx context.Context, ID string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	if err := ValidID(ID); err != nil {
+		return false, err
+	}
+	return a.Data.Exists(ID), nil
+}
+
+// Update changes the URL for ID.  As /upd always has, if the ID does not exist
+// it is created.  This is done with UpdateInsert so that the sequence is moved
+// past the ID and NextID will not hand it out later.
+func (a *V1Adapter) Update(ctx context.Context, URL string, ID string) (string, error) {
+	ur, err := a.UpdateInsert(ctx, URL, ID)
+	return ur.ID, err
+}
+
+// Fetch returns the URL for ID.  A code that is disabled, deleted or expired
+// is ErrDisabled, ErrDeleted or ErrExpired.  If a scheduled destination is
+// active now it is returned instead of the URL.
+func (a *V1Adapter) Fetch(ctx context.Context, ID string) (string, error) {
+	res, err := a.Resolve(ctx, ID, ResolveRequest{Hit: true})
+	return res.URL, err
+}
+
+// FetchRaw returns the URL for ID, the same as Fetch.
+func (a *V1Adapter) FetchRaw(ctx context.Context, ID string) (string, error) {
+	res, err := a.Resolve(ctx, ID, ResolveRequest{Hit: true, Raw: true})
+	return res.URL, err
+}
+
+// FetchAt returns the URL that Fetch would return at time at.  It does not
+// count a hit, it is for checking a code.
+func (a *V1Adapter) FetchAt(ctx context.Context, ID string, at time.Time) (string, error) {
+	res, err := a.Resolve(ctx, ID, ResolveRequest{At: at})
+	return res.URL, err
+}
+
+// NextID allocates a new ID.
+func (a *V1Adapter) NextID(ctx context.Context) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	ID := a.Data.NextID()
+	if ID == "" {
+		return "", fmt.Errorf("%w: unable to allocate a new ID", ErrBackendUnavailable)
+	}
+	return ID, nil
+}
+
+// List returns the codes from beg to end, see RedisStore.List.  Deleted codes
+// are left out.
+func (a *V1Adapter) List(ctx context.Context, beg, end string) ([]ListData, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if _, _, err := listRange(beg, end, math.MaxInt32); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidRange, err)
+	}
+	dat, err := a.Data.List(beg, end)
+	if err != nil {
+		return dat, backendError(err)
+	}
+	rv := dat[:0]
+	for _, ld := range dat {
+		ci, err := a.fillMeta(&ld)
+		if err != nil {
+			return nil, err
+		}
+		if ci.Deleted == nil {
+			rv = append(rv, ld)
+		}
+	}
+	return rv, nil
+}
+
+// fillMeta sets the CodeMeta in ld from the CodeInfo, which is returned.
+// ld.ID is decimal.
+func (a *V1Adapter) fillMeta(ld *ListData) (ci CodeInfo, err error) {
+	id, err := strconv.ParseInt(ld.ID, 10, 64)
+	if err != nil {
+		return ci, fmt.Errorf("%w: invalid ID %q from List", ErrBackendUnavailable, ld.ID)
+	}
+	if ci, err = a.fetchInfo(strconv.FormatInt(id, 36)); err != nil { // Base 36
+		return
+	}
+	ld.CodeMeta = ci.CodeMeta
+	ld.Expired = ci.IsExpired(ld.Count, time.Now())
+	ld.Protected = ci.PinHash != ""
+	return
+}
+
+// Code returns the URL, count and metadata for one code.  The URL is not
+// fetched so the code is not counted as a hit.  A deleted code is ErrDeleted.
+func (a *V1Adapter) Code(ctx context.Context, ID string) (ld ListData, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if err = ValidID(ID); err != nil {
+		return
+	}
+	ld, found, err := a.peek(ID)
+	if err == nil && !found {
+		err = fmt.Errorf("%w: %s", ErrNotFound, ID)
+	}
+	if err != nil {
+		return
+	}
+	ci, err := a.fillMeta(&ld)
+	if err == nil && ci.Deleted != nil {
+		err = fmt.Errorf("%w: %s", ErrDeleted, ID)
+	}
+	return
+}
+
+// peek reads the URL and count for ID with List, unlike Fetch this does not
+// count a hit.
+func (a *V1Adapter) peek(ID string) (ld ListData, found bool, err error) {
+	id, _ := strconv.ParseInt(ID, 36, 64) // Base 36
+	dat, err := a.Data.List(strconv.FormatInt(id, 10), strconv.FormatInt(id+1, 10))
+	if err != nil {
+		return ld, false, backendError(err)
+	}
+	if len(dat) == 0 {
+		return ld, false, nil
+	}
+	return dat[0], true, nil
+}
+
+// FetchInfo returns the CodeInfo for ID.
+func (a *V1Adapter) FetchInfo(ctx context.Context, ID string) (CodeInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return CodeInfo{}, err
+	}
+	if err := ValidID(ID); err != nil {
+		return CodeInfo{}, err
+	}
+	return a.fetchInfo(ID)
+}
+
+func (a *V1Adapter) fetchInfo(ID string) (CodeInfo, error) {
+	s, err := a.Data.FetchInfo(ID)
+	if err != nil {
+		return CodeInfo{}, backendError(err)
+	}
+	ci, err := ParseCodeInfo(s)
+	return ci, backendError(err)
+}
+
+// updateInfo reads the CodeInfo for ID, calls fn to change it and saves it.
+// If fn returns an error nothing is saved.  The lock makes the read-modify-write
+// safe within this server, like the file store it does not protect against
+// another server changing the same code at the same time.
+func (a *V1Adapter) updateInfo(ID string, fn func(ci *CodeInfo) error) error {
+	a.infoLock.Lock()
+	defer a.infoLock.Unlock()
+	return a.updateInfoLocked(ID, fn)
+}
+
+// updateInfoLocked is updateInfo for a caller that holds a.infoLock.
+func (a *V1Adapter) updateInfoLocked(ID string, fn func(ci *CodeInfo) error) error {
+	ci, err := a.fetchInfo(ID)
+	if err != nil {
+		return err
+	}
+	if err = fn(&ci); err != nil {
+		return err
+	}
+	return backendError(a.Data.SetInfo(ID, ci.String()))
+}
+
+// SetMeta sets the Owner, Title, Tags, expiry and routing rules for ID.  Only
+// the fields that are set in meta are changed, Created, Updated and the lock
+// are kept.  A zero (not nil) Expires or a negative MaxScans clears it.  The
+// DeviceURLs and LangURLs are merged, a "" URL removes the rule.  Language
+// tags are saved in canonical form.  Variants replaces the variants, an empty
+// list removes them, the counts are kept.  A negative RedirectStatus or an
+// Interstitial of ServerInterstitial clears it.  A QueryPolicy other than
+// QueryAllow clears QueryAllow.  Tracking is merged like DeviceURLs, a
+// Campaign of NoCampaign clears it.
+func (a *V1Adapter) SetMeta(ctx context.Context, ID string, meta CodeMeta) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := ValidID(ID); err != nil {
+		return err
+	}
+	for device := range meta.DeviceURLs {
+		if device != DeviceIOS && device != DeviceAndroid && device != DeviceDesktop {
+			return fmt.Errorf("%w: device %q, must be %s, %s or %s", ErrInvalidRange, device, DeviceIOS, DeviceAndroid, DeviceDesktop)
+		}
+	}
+	langURLs, err := canonicalLangs(meta.LangURLs)
+	if err != nil {
+		return err
+	}
+	if err = validVariants(meta.Variants); err != nil {
+		return err
+	}
+	if !validQueryPolicy(meta.QueryPolicy) {
+		return fmt.Errorf("%w: query policy %q, must be %s, %s, %s or %s", ErrInvalidRange, meta.QueryPolicy, QueryAppend, QueryOverride, QueryDrop, QueryAllow)
+	}
+	if !validTemplateName(meta.Interstitial) {
+		return fmt.Errorf("%w: interstitial %q, must be letters, digits, - and _", ErrInvalidRange, meta.Interstitial)
+	}
+	if meta.RedirectStatus > 0 && !ValidRedirectStatus(meta.RedirectStatus) {
+		return fmt.Errorf("%w: redirect status %d, must be 301, 302, 303, 307 or 308", ErrInvalidRange, meta.RedirectStatus)
+	}
+	return a.updateInfo(ID, func(ci *CodeInfo) error {
+		if meta.Owner != "" {
+			ci.Owner = meta.Owner
+		}
+		if meta.Title != "" {
+			ci.Title = meta.Title
+		}
+		if meta.Tags != nil {
+			ci.Tags = meta.Tags
+		}
+		switch {
+		case meta.Expires == nil:
+		case meta.Expires.IsZero():
+			ci.Expires = nil
+		default:
+			ci.Expires = meta.Expires
+		}
+		switch {
+		case meta.MaxScans < 0:
+			ci.MaxScans = 0
+		case meta.MaxScans > 0:
+			ci.MaxScans = meta.MaxScans
+		}
+		if meta.ExpiredURL != "" {
+			ci.ExpiredURL = meta.ExpiredURL
+		}
+		ci.DeviceURLs = mergeRules(ci.DeviceURLs, meta.DeviceURLs)
+		ci.LangURLs = mergeRules(ci.LangURLs, langURLs)
+		switch {
+		case meta.Variants == nil:
+		case len(meta.Variants) == 0:
+			ci.Variants = nil
+		default:
+			ci.Variants = meta.Variants
+		}
+		switch {
+		case meta.RedirectStatus < 0:
+			ci.RedirectStatus = 0
+		case meta.RedirectStatus > 0:
+			ci.RedirectStatus = meta.RedirectStatus
+		}
+		switch meta.Interstitial {
+		case "":
+		case ServerInterstitial:
+			ci.Interstitial = ""
+		default:
+			ci.Interstitial = meta.Interstitial
+		}
+		if meta.QueryPolicy != "" {
+			ci.QueryPolicy = meta.QueryPolicy
+			if ci.QueryPolicy == QueryAppend {
+				ci.QueryPolicy = ""
+			}
+			if ci.QueryPolicy != QueryAllow {
+				ci.QueryAllow = nil
+			}
+		}
+		if meta.QueryAllow != nil {
+			ci.QueryAllow = meta.QueryAllow
+		}
+		switch meta.Campaign {
+		case "":
+		case NoCampaign:
+			ci.Campaign = ""
+		default:
+			ci.Campaign = meta.Campaign
+		}
+		ci.Tracking = mergeRules(ci.Tracking, meta.Tracking)
+		if ci.QueryPolicy == QueryAllow && len(ci.QueryAllow) == 0 {
+			return fmt.Errorf("%w: query policy %s needs the keys to allow", ErrInvalidRange, QueryAllow)
+		}
+		return nil
+	})
+}
+
+// validTemplateName returns true if name is a file name for a template, it
+// is used in a path.
+func validTemplateName(name string) bool {
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeRules sets the rules in set in rules, a "" value removes the rule.
+// The result is nil if there are no rules.
+func mergeRules(rules, set map[string]string) map[string]string {
+	for key, URL := range set {
+		if URL == "" {
+			delete(rules, key)
+			continue
+		}
+		if rules == nil {
+			rules = make(map[string]string)
+		}
+		rules[key] = URL
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	return rules
+}
+
+// UpdateInsert does an update or insert of ID.  The UpdateRespItem is always
+// filled in, on error the Msg is "fail:..." the same as PersistentData.
+func (a *V1Adapter) UpdateInsert(ctx context.Context, URL string, ID string) (ur UpdateRespItem, err error) {
+	ur.ID = ID
+	if err = ctx.Err(); err == nil {
+		err = ValidID(ID)
+	}
+	if err != nil {
+		ur.Msg = fmt.Sprintf("fail:%s", err)
+		return
+	}
+	a.infoLock.Lock()
+	defer a.infoLock.Unlock()
+	return a.setURL(ctx, URL, ID, "")
+}
+
+// setURL does the UpdateInsert and adds it to the history.  If action is ""
+// it is insert or update.  A locked code is not changed, the error is ErrLocked,
+// and a deleted ID is not used again, the error is ErrDeleted.
+// The caller must hold a.infoLock so that the old URL in the history is the one
+// that was replaced.
+func (a *V1Adapter) setURL(ctx context.Context, URL string, ID string, action string) (ur UpdateRespItem, err error) {
+	ur.ID = ID
+	old, found, err := a.peek(ID)
+	var ci CodeInfo
+	if err == nil && found {
+		ci, err = a.fetchInfo(ID)
+	}
+	switch {
+	case err != nil:
+	case ci.Deleted != nil:
+		err = fmt.Errorf("%w: %s, a deleted ID is not used again", ErrDeleted, ID)
+	case ci.Locked:
+		err = fmt.Errorf("%w: %s, unlock it to change the URL", ErrLocked, ID)
+	}
+	if err != nil {
+		ur.Msg = fmt.Sprintf("fail:%s", err)
+		return
+	}
+	ur = a.Data.UpdateInsert(URL, ID)
+	if strings.HasPrefix(ur.Msg, "fail:") {
+		err = fmt.Errorf("%w: %s", ErrBackendUnavailable, ur.Msg[len("fail:"):])
+		return
+	}
+	if action == "" {
+		action = "update"
+		if ur.Msg == "success/insert" {
+			action = "insert"
+		}
+	}
+	now := time.Now()
+	ci.touch(now)
+	ci.addHistory(ctx, action, old.URL, URL, now)
+	if err = backendError(a.Data.SetInfo(ID, ci.String())); err != nil {
+		ur.Msg = fmt.Sprintf("fail:%s", err)
+	}
+	return
+}
+
+// IncrementRedirectCount counts a redirect for ID.
+func (a *V1Adapter) IncrementRedirectCount(ctx context.Context, ID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	a.Data.IncrementRedirectCount(ID)
+	return nil
+}
@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestAdapter(t *testing.T) PersistentDataV2 {
+	data, err := NewMemoryStore(true, os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return AdaptV1(data)
+}
+
+// TestAdapterInsertConsecutive checks that each Insert uses one ID, not two.
+func TestAdapterInsertConsecutive(t *testing.T) {
+	ds := newTestAdapter(t)
+	ctx := context.Background()
+	var prev int64
+	for ii := 0; ii < 5; ii++ {
+		id, err := ds.Insert(ctx, "http://example.com/")
+		if err != nil {
+			t.Fatalf("Insert: %s", err)
+		}
+		nn, _ := strconv.ParseInt(id, 36, 64)
+		if ii > 0 && nn != prev+1 {
+			t.Errorf("Insert returned %d after %d, expected %d", nn, prev, prev+1)
+		}
+		prev = nn
+	}
+}
+
+func TestAdapterUpdateCreates(t *testing.T) {
+	ds := newTestAdapter(t)
+	ctx := context.Background()
+	if _, err := ds.Update(ctx, "http://example.com/a", "zz"); err != nil {
+		t.Fatalf("Update of a new ID: %s", err)
+	}
+	if got, err := ds.Fetch(ctx, "zz"); err != nil || got != "http://example.com/a" {
+		t.Errorf("Fetch(zz) = %q, %v", got, err)
+	}
+	id, _ := ds.NextID(ctx)
+	if nn, _ := strconv.ParseInt(id, 36, 64); nn <= 1295 {
+		t.Errorf("NextID() = %s after Update(zz), must be past zz", id)
+	}
+}
+
+func TestAdapterErrors(t *testing.T) {
+	ds := newTestAdapter(t)
+	ctx := context.Background()
+	if _, err := ds.Fetch(ctx, "zzz"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Fetch of a missing ID = %v, expected ErrNotFound", err)
+	}
+	if _, err := ds.Fetch(ctx, "a-b"); !errors.Is(err, ErrInvalidID) {
+		t.Errorf("Fetch of a bad ID = %v, expected ErrInvalidID", err)
+	}
+	if _, err := ds.List(ctx, "9", "2"); !errors.Is(err, ErrInvalidRange) {
+		t.Errorf("List(9,2) = %v, expected ErrInvalidRange", err)
+	}
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := ds.Insert(cctx, "http://example.com/"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Insert with a canceled context = %v, expected context.Canceled", err)
+	}
+}
+
+// TestAdapterMeta checks that the times are kept, SetMeta only changes the
+// fields that are set and List returns the metadata.
+func TestAdapterMeta(t *testing.T) {
+	ds := newTestAdapter(t)
+	ctx := context.Background()
+	id, err := ds.Insert(ctx, "http://example.com/a")
+	if err != nil {
+		t.Fatalf("Insert: %s", err)
+	}
+	ci, err := ds.FetchInfo(ctx, id)
+	if err != nil || ci.Created == nil || ci.Updated == nil {
+		t.Fatalf("FetchInfo after Insert = %+v, %v, expected Created and Updated", ci, err)
+	}
+	created := *ci.Created
+
+	if err = ds.SetMeta(ctx, id, CodeMeta{Owner: "bob", Tags: []string{"x"}}); err != nil {
+		t.Fatalf("SetMeta: %s", err)
+	}
+	if err = ds.SetMeta(ctx, id, CodeMeta{Title: "Label"}); err != nil {
+		t.Fatalf("SetMeta: %s", err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if _, err = ds.Update(ctx, "http://example.com/b", id); err != nil {
+		t.Fatalf("Update: %s", err)
+	}
+
+	dat, err := ds.List(ctx, "0", "last")
+	if err != nil || len(dat) != 1 {
+		t.Fatalf("List = %+v, %v", dat, err)
+	}
+	cm := dat[0].CodeMeta
+	if cm.Owner != "bob" || cm.Title != "Label" || len(cm.Tags) != 1 || cm.Tags[0] != "x" {
+		t.Errorf("List meta = %+v, expected owner bob, title Label, tags [x]", cm)
+	}
+	if cm.Created == nil || !cm.Created.Equal(created) || cm.Updated == nil || !cm.Updated.After(created) {
+		t.Errorf("List meta Created %v, Updated %v, expected Created %v and Updated after it", cm.Created, cm.Updated, created)
+	}
+
+	if ld, err := ds.Code(ctx, id); err != nil || ld.URL != "http://example.com/b" || ld.Owner != "bob" {
+		t.Errorf("Code(%s) = %+v, %v", id, ld, err)
+	}
+	if _, err := ds.Code(ctx, "zzz"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Code(zzz) error = %v, expected ErrNotFound", err)
+	}
+	if err := ds.SetMeta(ctx, "zzz", CodeMeta{Owner: "bob"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SetMeta(zzz) error = %v, expected ErrNotFound", err)
+	}
+}
+
+func TestSetMetaRedirectStatus(t *testing.T) {
+	ds := newTestAdapter(t)
+	ctx := context.Background()
+
+	id, _ := ds.Insert(ctx, "http://example.com/a")
+	if err := ds.SetMeta(ctx, id, CodeMeta{RedirectStatus: 305}); !errors.Is(err, ErrInvalidRange) {
+		t.Errorf("SetMeta 305 error = %v, expected ErrInvalidRange", err)
+	}
+	if err := ds.SetMeta(ctx, id, CodeMeta{RedirectStatus: 301}); err != nil {
+		t.Fatalf("SetMeta 301: %s", err)
+	}
+	if ci, _ := ds.FetchInfo(ctx, id); ci.RedirectStatus != 301 {
+		t.Errorf("RedirectStatus = %d, expected 301", ci.RedirectStatus)
+	}
+	ds.SetMeta(ctx, id, CodeMeta{Title: "t"})
+	if ci, _ := ds.FetchInfo(ctx, id); ci.RedirectStatus != 301 {
+		t.Errorf("RedirectStatus = %d after a SetMeta without it, expected 301", ci.RedirectStatus)
+	}
+	ds.SetMeta(ctx, id, CodeMeta{RedirectStatus: -1})
+	if ci, _ := ds.FetchInfo(ctx, id); ci.RedirectStatus != 0 {
+		t.Errorf("RedirectStatus = %d after clear", ci.RedirectStatus)
+	}
+}
+
+func TestSetMetaInterstitial(t *testing.T) {
+	ds := newTestAdapter(t)
+	ctx := context.Background()
+
+	id, _ := ds.Insert(ctx, "http://example.com/a")
+	for _, name := range []string{"../x", "a b", "x.html"} {
+		if err := ds.SetMeta(ctx, id, CodeMeta{Interstitial: name}); !errors.Is(err, ErrInvalidRange) {
+			t.Errorf("SetMeta interstitial %q error = %v, expected ErrInvalidRange", name, err)
+		}
+	}
+	if err := ds.SetMeta(ctx, id, CodeMeta{Interstitial: "promo-2_b"}); err != nil {
+		t.Fatalf("SetMeta: %s", err)
+	}
+	if ci, _ := ds.FetchInfo(ctx, id); ci.Interstitial != "promo-2_b" {
+		t.Errorf("Interstitial = %q", ci.Interstitial)
+	}
+	ds.SetMeta(ctx, id, CodeMeta{Interstitial: ServerInterstitial})
+	if ci, _ := ds.FetchInfo(ctx, id); ci.Interstitial != "" {
+		t.Errorf("Interstitial = %q after clear", ci.Interstitial)
+	}
+}
@@ -0,0 +1,244 @@
+package storage
+
+// Copyright (C) Philip Schlump 2018-2019.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BackupFormat and BackupVersion identify a backup archive.  The version is
+// changed when fields are added that an older restore would lose.
+//
+//	1 - id, url, count
+//	2 - info, the CodeInfo for the code
+const (
+	BackupFormat  = "qr-short-backup"
+	BackupVersion = 2
+)
+
+// backupBatch is the number of IDs read in one List call, this is the List limit.
+const backupBatch = 1000
+
+// BackupHeader is the first line of a backup archive.
+type BackupHeader struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	Seq     int64     `json:"seq"`
+	Created time.Time `json:"created"`
+}
+
+// BackupRecord is one code in a backup archive, ID is base 36.
+type BackupRecord struct {
+	ID    string          `json:"id"`
+	URL   string          `json:"url"`
+	Count int             `json:"count"`
+	Info  json.RawMessage `json:"info,omitempty"` // CodeInfo as saved by SetInfo
+}
+
+// BackupTrailer is the last line of a backup archive.  SHA256 is the checksum
+// of all the lines before it, N is the number of records.
+type BackupTrailer struct {
+	End    bool   `json:"end"`
+	N      int    `json:"n"`
+	SHA256 string `json:"sha256"`
+}
+
+// Backup is a backup archive that has been read and checked.
+type Backup struct {
+	Header  BackupHeader
+	Records []BackupRecord
+}
+
+// WriteBackup writes every code in data, with its hit count and info, and the sequence
+// to w as JSON Lines.  The first line is a BackupHeader, then one BackupRecord
+// per code, then a BackupTrailer with the checksum.  It returns the number of
+// codes written.
+func WriteBackup(data PersistentData, w io.Writer) (n int, err error) {
+	seq, err := data.Seq()
+	if err != nil {
+		return 0, fmt.Errorf("read sequence: %s", err)
+	}
+	sum := sha256.New()
+	bw := bufio.NewWriter(w)
+	out := io.MultiWriter(bw, sum)
+	err = writeJSONLine(out, BackupHeader{Format: BackupFormat, Version: BackupVersion, Seq: seq, Created: time.Now().UTC()})
+	if err != nil {
+		return 0, err
+	}
+	for beg := int64(0); beg <= seq; beg += backupBatch {
+		dat, err := data.List(strconv.FormatInt(beg, 10), strconv.FormatInt(beg+backupBatch, 10))
+		if err != nil {
+			return n, fmt.Errorf("list %d to %d: %s", beg, beg+backupBatch, err)
+		}
+		for _, ld := range dat {
+			id, err := strconv.ParseInt(ld.ID, 10, 64)
+			if err != nil {
+				return n, fmt.Errorf("invalid ID %q: %s", ld.ID, err)
+			}
+			rec := BackupRecord{ID: strconv.FormatInt(id, 36), URL: ld.URL, Count: ld.Count} // Base 36
+			info, err := data.FetchInfo(rec.ID)
+			if err != nil {
+				return n, fmt.Errorf("read info %s: %s", rec.ID, err)
+			}
+			if info != "" {
+				if !json.Valid([]byte(info)) {
+					return n, fmt.Errorf("info for %s is not valid JSON", rec.ID)
+				}
+				rec.Info = json.RawMessage(info)
+			}
+			if err = writeJSONLine(out, rec); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	if err = writeJSONLine(bw, BackupTrailer{End: true, N: n, SHA256: hex.EncodeToString(sum.Sum(nil))}); err != nil {
+		return n, err
+	}
+	return n, bw.Flush()
+}
+
+func writeJSONLine(w io.Writer, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(buf, '\n'))
+	return err
+}
+
+// ReadBackup reads a backup archive and checks the format, version, record
+// count and checksum.  Nothing is returned unless the whole archive is good.
+func ReadBackup(r io.Reader) (bk *Backup, err error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	sum := sha256.New()
+	var trailer *BackupTrailer
+	bk = &Backup{}
+	line, haveHeader := 0, false
+	for sc.Scan() {
+		line++
+		buf := sc.Bytes()
+		if len(bytes.TrimSpace(buf)) == 0 {
+			continue
+		}
+		if trailer != nil {
+			return nil, fmt.Errorf("line %d: data after the end of the archive", line)
+		}
+		switch {
+		case !haveHeader:
+			haveHeader = true
+			if err = json.Unmarshal(buf, &bk.Header); err != nil {
+				return nil, fmt.Errorf("line %d: invalid header: %s", line, err)
+			}
+			if bk.Header.Format != BackupFormat {
+				return nil, fmt.Errorf("not a %s archive", BackupFormat)
+			}
+			if bk.Header.Version < 1 || bk.Header.Version > BackupVersion {
+				return nil, fmt.Errorf("archive version %d is not supported, this version of qr-short reads 1 to %d", bk.Header.Version, BackupVersion)
+			}
+		case bytes.HasPrefix(buf, []byte(`{"end":`)):
+			trailer = &BackupTrailer{}
+			if err = json.Unmarshal(buf, trailer); err != nil {
+				return nil, fmt.Errorf("line %d: invalid trailer: %s", line, err)
+			}
+			continue // the trailer is not part of the checksum
+		default:
+			var rec BackupRecord
+			if err = json.Unmarshal(buf, &rec); err != nil {
+				return nil, fmt.Errorf("line %d: %s", line, err)
+			}
+			if err = ValidID(rec.ID); err != nil {
+				return nil, fmt.Errorf("line %d: %s", line, err)
+			}
+			bk.Records = append(bk.Records, rec)
+		}
+		sum.Write(buf)
+		sum.Write([]byte{'\n'})
+	}
+	if err = sc.Err(); err != nil {
+		return nil, err
+	}
+	if !haveHeader {
+		return nil, fmt.Errorf("empty archive")
+	}
+	if trailer == nil {
+		return nil, fmt.Errorf("archive is truncated, no trailer")
+	}
+	if trailer.N != len(bk.Records) {
+		return nil, fmt.Errorf("archive has %d records, the trailer says %d", len(bk.Records), trailer.N)
+	}
+	if got := hex.EncodeToString(sum.Sum(nil)); got != trailer.SHA256 {
+		return nil, fmt.Errorf("checksum mismatch, archive is %s, the trailer says %s", got, trailer.SHA256)
+	}
+	return bk, nil
+}
+
+// RestoreMode is how RestoreBackup treats codes that are already in the store.
+type RestoreMode string
+
+// RestoreMerge only adds the codes that are not in the store.  RestoreReplace
+// sets every code in the archive to the archived URL, count and info.  In both modes
+// codes that are not in the archive are left alone, a printed code is never
+// removed by a restore.
+const (
+	RestoreMerge   RestoreMode = "merge"
+	RestoreReplace RestoreMode = "replace"
+)
+
+// RestoreResult reports what RestoreBackup did.
+type RestoreResult struct {
+	Inserted int   `json:"inserted"`
+	Replaced int   `json:"replaced"`
+	Skipped  int   `json:"skipped"`
+	Seq      int64 `json:"seq"`
+}
+
+// RestoreBackup reads and checks an archive, then writes it to data.  The
+// sequence is moved up to the archived sequence, it is never moved down.
+func RestoreBackup(data PersistentData, r io.Reader, mode RestoreMode) (rr RestoreResult, err error) {
+	if mode != RestoreMerge && mode != RestoreReplace {
+		return rr, fmt.Errorf("%w: mode %q, must be %s or %s", ErrInvalidBackup, mode, RestoreMerge, RestoreReplace)
+	}
+	bk, err := ReadBackup(r)
+	if err != nil {
+		return rr, fmt.Errorf("%w: %s", ErrInvalidBackup, err)
+	}
+	for _, rec := range bk.Records {
+		if mode == RestoreMerge && data.Exists(rec.ID) {
+			rr.Skipped++
+			continue
+		}
+		ur := data.UpdateInsert(rec.URL, rec.ID)
+		if strings.HasPrefix(ur.Msg, "fail:") {
+			return rr, fmt.Errorf("%w: write %s: %s", ErrBackendUnavailable, rec.ID, ur.Msg)
+		}
+		if err = data.SetCount(rec.ID, rec.Count); err != nil {
+			return rr, fmt.Errorf("%w: set count %s: %s", ErrBackendUnavailable, rec.ID, err)
+		}
+		if len(rec.Info) > 0 {
+			if err = data.SetInfo(rec.ID, string(rec.Info)); err != nil {
+				return rr, fmt.Errorf("%w: set info %s: %s", ErrBackendUnavailable, rec.ID, err)
+			}
+		}
+		if ur.Msg == "success/update" {
+			rr.Replaced++
+		} else {
+			rr.Inserted++
+		}
+	}
+	if err = data.SetSeq(bk.Header.Seq); err != nil {
+		return rr, fmt.Errorf("%w: set sequence: %s", ErrBackendUnavailable, err)
+	}
+	rr.Seq, err = data.Seq()
+	return rr, err
+}
@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// newTestBackup returns a backup of a store with three codes, a count and a
+// sequence past the last code.
+func newTestBackup(t *testing.T) []byte {
+	src, err := NewMemoryStore(true, os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.UpdateInsert("http://example.com/a", "2")
+	src.UpdateInsert("http://example.com/b", "3")
+	src.UpdateInsert("http://example.com/big", strconv.FormatInt(2500, 36)) // second List batch
+	src.SetCount("3", 7)
+	src.SetInfo("3", `{"Owner":"bob"}`)
+	src.SetSeq(3000)
+
+	var buf bytes.Buffer
+	n, err := WriteBackup(src, &buf)
+	if err != nil {
+		t.Fatalf("WriteBackup: %s", err)
+	}
+	if n != 3 {
+		t.Fatalf("WriteBackup wrote %d codes, expected 3", n)
+	}
+	return buf.Bytes()
+}
+
+func TestBackupRestore(t *testing.T) {
+	archive := newTestBackup(t)
+
+	dst, _ := NewMemoryStore(true, os.Stderr)
+	dst.UpdateInsert("http://example.com/keep", "2")
+	dst.UpdateInsert("http://example.com/other", "9")
+
+	rr, err := RestoreBackup(dst, bytes.NewReader(archive), RestoreMerge)
+	if err != nil {
+		t.Fatalf("RestoreBackup merge: %s", err)
+	}
+	if rr.Inserted != 2 || rr.Skipped != 1 || rr.Replaced != 0 || rr.Seq != 3000 {
+		t.Errorf("RestoreBackup merge = %+v, expected 2 inserted, 1 skipped, seq 3000", rr)
+	}
+	if got, _ := dst.FetchRaw("2"); got != "http://example.com/keep" {
+		t.Errorf("after merge 2 = %q, merge must not overwrite", got)
+	}
+	if dat, _ := dst.List("3", "4"); len(dat) != 1 || dat[0].Count != 7 {
+		t.Errorf("after merge List(3,4) = %+v, expected a count of 7", dat)
+	}
+	if info, _ := dst.FetchInfo("3"); info != `{"Owner":"bob"}` {
+		t.Errorf("after merge info for 3 = %q, expected the archived info", info)
+	}
+
+	rr, err = RestoreBackup(dst, bytes.NewReader(archive), RestoreReplace)
+	if err != nil {
+		t.Fatalf("RestoreBackup replace: %s", err)
+	}
+	if rr.Replaced != 3 || rr.Inserted != 0 {
+		t.Errorf("RestoreBackup replace = %+v, expected 3 replaced", rr)
+	}
+	if got, _ := dst.FetchRaw("2"); got != "http://example.com/a" {
+		t.Errorf("after replace 2 = %q, expected http://example.com/a", got)
+	}
+	if !dst.Exists("9") {
+		t.Errorf("replace removed a code that is not in the archive")
+	}
+}
+
+func TestBackupDamaged(t *testing.T) {
+	archive := string(newTestBackup(t))
+	lines := strings.SplitAfter(archive, "\n")
+
+	tests := []struct {
+		name    string
+		archive string
+	}{
+		{"empty", ""},
+		{"changed URL", strings.Replace(archive, "example.com/b", "example.com/x", 1)},
+		{"truncated", strings.Join(lines[:len(lines)-2], "")},
+		{"record dropped", lines[0] + strings.Join(lines[2:], "")},
+		{"not an archive", `{"format":"something-else","version":1}` + "\n"},
+		{"newer version", strings.Replace(archive, `"version":2`, `"version":99`, 1)},
+		{"data after end", archive + lines[1]},
+	}
+	for _, test := range tests {
+		dst, _ := NewMemoryStore(true, os.Stderr)
+		_, err := RestoreBackup(dst, strings.NewReader(test.archive), RestoreReplace)
+		if !errors.Is(err, ErrInvalidBackup) {
+			t.Errorf("%s: RestoreBackup error = %v, expected ErrInvalidBackup", test.name, err)
+		}
+		if seq, _ := dst.Seq(); dst.Exists("2") || seq != 1 {
+			t.Errorf("%s: RestoreBackup of a bad archive wrote to the store", test.name)
+		}
+	}
+
+	dst, _ := NewMemoryStore(true, os.Stderr)
+	if _, err := RestoreBackup(dst, strings.NewReader(archive), "overwrite"); !errors.Is(err, ErrInvalidBackup) {
+		t.Errorf("RestoreBackup with mode overwrite error = %v, expected ErrInvalidBackup", err)
+	}
+}
+
+// TestBackupVersion1 checks that an archive from before info was added can
+// still be restored.
+func TestBackupVersion1(t *testing.T) {
+	body := `{"format":"qr-short-backup","version":1,"seq":10,"created":"2019-04-01T00:00:00Z"}
+{"id":"5","url":"http://example.com/5","count":2}
+`
+	sum := sha256.Sum256([]byte(body))
+	archive := body + `{"end":true,"n":1,"sha256":"` + hex.EncodeToString(sum[:]) + `"}` + "\n"
+
+	dst, _ := NewMemoryStore(true, os.Stderr)
+	rr, err := RestoreBackup(dst, strings.NewReader(archive), RestoreMerge)
+	if err != nil {
+		t.Fatalf("RestoreBackup of a version 1 archive: %s", err)
+	}
+	if rr.Inserted != 1 || rr.Seq != 10 {
+		t.Errorf("RestoreBackup = %+v, expected 1 inserted, seq 10", rr)
+	}
+	if got, _ := dst.FetchRaw("5"); got != "http://example.com/5" {
+		t.Errorf("after restore 5 = %q", got)
+	}
+}
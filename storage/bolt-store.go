@@ -0,0 +1,362 @@
+package storage
+
+// Copyright (C) Philip Schlump 2018-2019.
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pschlump/MiscLib"
+	"github.com/pschlump/godebug"
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltStore implements PersistentData with an embedded single file database (bbolt).
+// This is for single server setups where running Redis is not worth the trouble.
+// The file is locked by bbolt so only one server can have it open at a time.
+//
+// Layout is the same as Redis: bucket "qr" holds <ID> -> URL with the bucket
+// sequence used as "qr!seq", bucket "qr^" holds <ID> -> hit count and bucket
+// "qr@" holds <ID> -> metadata.
+type BoltStore struct {
+	DBFile    string
+	Log       *os.File
+	CountHits bool
+	db        *bolt.DB
+	readOnly  bool
+}
+
+var boltURLBucket = []byte("qr")
+var boltCountBucket = []byte("qr^")
+var boltInfoBucket = []byte("qr@")
+
+// boltOpenTimeout is how long to wait for the file lock if another process has the database open.
+var boltOpenTimeout = 5 * time.Second
+
+// NewBoltStore opens (or creates) the database file and initializes the buckets if necessary.
+func NewBoltStore(dbFile string, countHits bool, log *os.File) (rv PersistentData, err error) {
+	err = os.MkdirAll(filepath.Dir(dbFile), 0744)
+	if err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(dbFile, 0644, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %s: %s", dbFile, err)
+	}
+	bs := &BoltStore{
+		DBFile:    dbFile,
+		Log:       log,
+		CountHits: countHits,
+		db:        db,
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(boltURLBucket)
+		if err != nil {
+			return err
+		}
+		if b.Sequence() == 0 {
+			// Same starting point as Redis "qr!seq".
+			if err := b.SetSequence(1); err != nil {
+				return err
+			}
+		}
+		if _, err = tx.CreateBucketIfNotExists(boltCountBucket); err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(boltInfoBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to initialize %s: %s", dbFile, err)
+	}
+	return bs, nil
+}
+
+// NewBoltStoreReadOnly opens an existing database file read only.  Hits are
+// not counted, the counts are still returned by List.  A server that has the
+// file open holds an exclusive lock, so this fails after boltOpenTimeout
+// until the server is stopped.
+func NewBoltStoreReadOnly(dbFile string, log *os.File) (rv PersistentData, err error) {
+	if _, err = os.Stat(dbFile); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(dbFile, 0644, &bolt.Options{Timeout: boltOpenTimeout, ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %s: %s", dbFile, err)
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltURLBucket) == nil || tx.Bucket(boltCountBucket) == nil {
+			return fmt.Errorf("not a qr-short database")
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to open %s: %s", dbFile, err)
+	}
+	return &BoltStore{
+		DBFile:    dbFile,
+		Log:       log,
+		CountHits: true,
+		db:        db,
+		readOnly:  true,
+	}, nil
+}
+
+// NextID returns the next higher integer that will be used to lookup the URL.  It is in base 36.
+func (bs *BoltStore) NextID() (rv string) {
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		nn, err := tx.Bucket(boltURLBucket).NextSequence()
+		if err != nil {
+			return err
+		}
+		rv = strconv.FormatUint(nn, 36) // Base 36
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(bs.Log, "Error: %s, %s\n", err, godebug.LF())
+		return ""
+	}
+	return
+}
+
+// getID returns the current sequence value in integer format.
+func (bs *BoltStore) getID() (nn int64) {
+	bs.db.View(func(tx *bolt.Tx) error {
+		nn = int64(tx.Bucket(boltURLBucket).Sequence())
+		return nil
+	})
+	return
+}
+
+// Seq returns the current value of the sequence.
+func (bs *BoltStore) Seq() (int64, error) {
+	return bs.getID(), nil
+}
+
+// SetSeq moves the sequence up to n if it is less than n.
+func (bs *BoltStore) SetSeq(n int64) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		ub := tx.Bucket(boltURLBucket)
+		if n > int64(ub.Sequence()) {
+			return ub.SetSequence(uint64(n))
+		}
+		return nil
+	})
+}
+
+// SetCount sets the hit count for ID.
+func (bs *BoltStore) SetCount(ID string, n int) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltURLBucket).Get([]byte(ID)) == nil {
+			return fmt.Errorf("%w: %s", ErrNotFound, ID)
+		}
+		return tx.Bucket(boltCountBucket).Put([]byte(ID), []byte(strconv.Itoa(n)))
+	})
+}
+
+// FetchInfo returns the metadata for ID.  A file from before the "qr@" bucket
+// was added, opened read only, has no metadata.
+func (bs *BoltStore) FetchInfo(ID string) (info string, err error) {
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltURLBucket).Get([]byte(ID)) == nil {
+			return fmt.Errorf("%w: %s", ErrNotFound, ID)
+		}
+		if ib := tx.Bucket(boltInfoBucket); ib != nil {
+			info = string(ib.Get([]byte(ID)))
+		}
+		return nil
+	})
+	return
+}
+
+// SetInfo saves the metadata for ID.
+func (bs *BoltStore) SetInfo(ID string, info string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltURLBucket).Get([]byte(ID)) == nil {
+			return fmt.Errorf("%w: %s", ErrNotFound, ID)
+		}
+		return tx.Bucket(boltInfoBucket).Put([]byte(ID), []byte(info))
+	})
+}
+
+// Insert saves `urlStr` under a newly allocated ID.
+func (bs *BoltStore) Insert(urlStr string) (string, error) {
+	code := bs.NextID()
+	if code == "" {
+		return "", fmt.Errorf("unable to allocate a new ID")
+	}
+	return code, bs.put(urlStr, code, true)
+}
+
+// put writes the URL and, if this is a new code, resets the hit count.
+func (bs *BoltStore) put(urlStr, code string, isNew bool) error {
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(boltURLBucket).Put([]byte(code), []byte(urlStr))
+		if err != nil {
+			return err
+		}
+		if bs.CountHits && isNew {
+			return tx.Bucket(boltCountBucket).Put([]byte(code), []byte("0"))
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(bs.Log, "Error: unable to update: %s, %s\n", err, godebug.LF())
+	}
+	return err
+}
+
+// Update an existing key
+func (bs *BoltStore) Update(urlStr, code string) (ID string, err error) {
+	return code, bs.put(urlStr, code, false)
+}
+
+// Exists returns true if the ID exists in the database
+func (bs *BoltStore) Exists(ID string) (rv bool) {
+	bs.db.View(func(tx *bolt.Tx) error {
+		rv = len(tx.Bucket(boltURLBucket).Get([]byte(ID))) > 0
+		return nil
+	})
+	if db5 {
+		fmt.Printf("%sExists(%s) = %v%s\n", MiscLib.ColorCyan, ID, rv, MiscLib.ColorReset)
+	}
+	return
+}
+
+// Fetch converts from a `code` into a `url` to be returned.
+func (bs *BoltStore) Fetch(code string) (string, error) {
+	return bs.fetch(code)
+}
+
+// FetchRaw converts from a `code` into a `url` to be returned.
+func (bs *BoltStore) FetchRaw(code string) (string, error) {
+	return bs.fetch(code)
+}
+
+// fetch looks up the URL and increments the hit count in the same transaction.
+// If hits are not counted a read only transaction is used so that redirects do
+// not wait on the single writer.
+func (bs *BoltStore) fetch(code string) (urlStr string, err error) {
+	count := bs.CountHits && !bs.readOnly
+	txFunc := bs.db.View
+	if count {
+		txFunc = bs.db.Update
+	}
+	err = txFunc(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltURLBucket).Get([]byte(code))
+		if v == nil {
+			return fmt.Errorf("%w: %s", ErrNotFound, code)
+		}
+		urlStr = string(v)
+		if count {
+			cb := tx.Bucket(boltCountBucket)
+			n, _ := strconv.Atoi(string(cb.Get([]byte(code))))
+			return cb.Put([]byte(code), []byte(strconv.Itoa(n+1)))
+		}
+		return nil
+	})
+	return
+}
+
+// List returns a list of all the redirects between beg and end, where beg
+// can be 0 to start at the beginning and end can be 'last' | '*' | 'latest'
+// to to go the most recent item.  This has the same limits as RedisStore.List,
+// at most 1000 are returned in a single call.
+func (bs *BoltStore) List(beg, end string) (dat []ListData, err error) {
+	begInt, endInt, err := listRange(beg, end, bs.getID())
+	if err != nil {
+		fmt.Fprintf(bs.Log, "Error: %s, %s\n", err, godebug.LF())
+		return
+	}
+
+	dataRange := endInt - begInt + 1
+	if dataRange > 1000 {
+		dataRange = 1000
+	}
+	dat = make([]ListData, 0, dataRange)
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		ub := tx.Bucket(boltURLBucket)
+		cb := tx.Bucket(boltCountBucket)
+		jj := 0
+		for ii := begInt; ii < endInt && jj < 1000; ii++ {
+			jj++
+			key := []byte(strconv.FormatUint(uint64(ii), 36)) // Base 36
+			v := ub.Get(key)
+			if len(v) == 0 {
+				continue
+			}
+			nUse := 0
+			if bs.CountHits {
+				nUse, _ = strconv.Atoi(string(cb.Get(key)))
+			}
+			dat = append(dat, ListData{
+				ID:    fmt.Sprintf("%d", ii),
+				URL:   string(v),
+				Count: nUse,
+			})
+		}
+		return nil
+	})
+	if db4 {
+		fmt.Printf("dat=%s AT: %s\n", godebug.SVarI(dat), godebug.LF())
+	}
+	return
+}
+
+// UpdateInsert performs an update for existing IDs and an insert on new ids.
+// The sequence is moved to max(cur,1+id) so that NextID will not hand out an ID
+// that was loaded in bulk.
+func (bs *BoltStore) UpdateInsert(URL string, ID string) (ur UpdateRespItem) {
+	ur.ID = ID
+
+	IDint, err := strconv.ParseInt(ID, 36, 64) // Base 36, Parse the int into a number
+	if err != nil {
+		ur.Msg = fmt.Sprintf("fail:%s", err)
+		return
+	}
+
+	found := false
+	err = bs.db.Update(func(tx *bolt.Tx) error {
+		ub := tx.Bucket(boltURLBucket)
+		if IDint >= int64(ub.Sequence()) {
+			if db6 {
+				fmt.Printf("IDint=%d AT: %s\n", IDint, godebug.LF())
+			}
+			if err := ub.SetSequence(uint64(IDint + 1)); err != nil {
+				return err
+			}
+		}
+		found = len(ub.Get([]byte(ID))) > 0
+		if err := ub.Put([]byte(ID), []byte(URL)); err != nil {
+			return err
+		}
+		if bs.CountHits && !found {
+			return tx.Bucket(boltCountBucket).Put([]byte(ID), []byte("0"))
+		}
+		return nil
+	})
+
+	if err != nil {
+		ur.Msg = fmt.Sprintf("fail:%s", err)
+	} else if found {
+		ur.Msg = "success/update"
+	} else {
+		ur.Msg = "success/insert"
+	}
+	return
+}
+
+// Close closes the database file, this releases the lock on it.
+func (bs *BoltStore) Close() error {
+	return bs.db.Close()
+}
+
+// IncrementRedirectCount is a no-op, the count is incremented by Fetch
+// the same as with Redis.
+func (bs *BoltStore) IncrementRedirectCount(id string) {
+}
@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestBoltStore(t *testing.T, dbFile string) *BoltStore {
+	data, err := NewBoltStore(dbFile, true, os.Stderr)
+	if err != nil {
+		t.Fatalf("NewBoltStore: %s", err)
+	}
+	bs := data.(*BoltStore)
+	t.Cleanup(func() { bs.Close() })
+	return bs
+}
+
+func TestBoltStoreNextIDConcurrent(t *testing.T) {
+	bs := newTestBoltStore(t, filepath.Join(t.TempDir(), "qr.db"))
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	seen := make(map[string]bool)
+	for ww := 0; ww < 8; ww++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ii := 0; ii < 25; ii++ {
+				id := bs.NextID()
+				lock.Lock()
+				if seen[id] {
+					t.Errorf("NextID returned %s twice", id)
+				}
+				seen[id] = true
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if seq := bs.getID(); seq != 1+8*25 {
+		t.Errorf("sequence = %d after %d NextID calls, expected %d", seq, 8*25, 1+8*25)
+	}
+}
+
+func TestBoltStoreListRange(t *testing.T) {
+	bs := newTestBoltStore(t, filepath.Join(t.TempDir(), "qr.db"))
+
+	for ii := 0; ii < 20; ii++ {
+		if _, err := bs.Insert(fmt.Sprintf("http://example.com/%d", ii)); err != nil {
+			t.Fatalf("Insert: %s", err)
+		}
+	}
+	// IDs are 2..21 in decimal.
+	tests := []struct {
+		beg, end string
+		first    string
+		n        int
+	}{
+		{"0", "last", "2", 20},
+		{"5", "10", "5", 5},
+		{"21", "*", "21", 1},
+		{"100", "200", "", 0},
+	}
+	for _, test := range tests {
+		dat, err := bs.List(test.beg, test.end)
+		if err != nil {
+			t.Errorf("List(%s,%s): %s", test.beg, test.end, err)
+			continue
+		}
+		if len(dat) != test.n {
+			t.Errorf("List(%s,%s) returned %d items, expected %d", test.beg, test.end, len(dat), test.n)
+			continue
+		}
+		if test.n > 0 && dat[0].ID != test.first {
+			t.Errorf("List(%s,%s)[0].ID = %s, expected %s", test.beg, test.end, dat[0].ID, test.first)
+		}
+	}
+
+	bs.UpdateInsert("http://example.com/big", strconv.FormatInt(5000, 36))
+	dat, err := bs.List("0", "last")
+	if err != nil || len(dat) != 20 {
+		t.Errorf("List(0,last) = %d items, %v, expected 20, at most 1000 IDs are looked at", len(dat), err)
+	}
+}
+
+func TestBoltStoreOpenTimeout(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "qr.db")
+	newTestBoltStore(t, dbFile)
+
+	save := boltOpenTimeout
+	boltOpenTimeout = 100 * time.Millisecond
+	defer func() { boltOpenTimeout = save }()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := NewBoltStore(dbFile, true, os.Stderr)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("second NewBoltStore on a locked file did not return an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("second NewBoltStore on a locked file did not time out")
+	}
+}
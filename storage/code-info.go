@@ -0,0 +1,156 @@
+package storage
+
+// Copyright (C) Philip Schlump 2018-2019.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// CodeMeta is the metadata for a code that is set through the API and
+// returned by /list.  Empty fields are left out of the JSON so codes without
+// metadata list the same as before.
+type CodeMeta struct {
+	Owner   string     `json:"Owner,omitempty"`
+	Title   string     `json:"Title,omitempty"`
+	Tags    []string   `json:"Tags,omitempty"`
+	Created *time.Time `json:"Created,omitempty"`
+	Updated *time.Time `json:"Updated,omitempty"` // last time the URL was changed
+
+	// Locked is set by Lock, the URL can not be changed until Unlock.
+	Locked   bool       `json:"Locked,omitempty"`
+	LockedBy string     `json:"LockedBy,omitempty"`
+	LockedAt *time.Time `json:"LockedAt,omitempty"`
+
+	// Disabled is set by Disable, the code does not redirect until Enable.
+	Disabled bool `json:"Disabled,omitempty"`
+
+	// The code expires at Expires or after MaxScans scans (this needs
+	// CountHits), then it goes to ExpiredURL.  See SetMeta to clear them.
+	Expires    *time.Time `json:"Expires,omitempty"`
+	MaxScans   int        `json:"MaxScans,omitempty"`
+	ExpiredURL string     `json:"ExpiredURL,omitempty"`
+
+	// DeviceURLs sends a device, DeviceIOS, DeviceAndroid or DeviceDesktop,
+	// somewhere other than the URL.
+	DeviceURLs map[string]string `json:"DeviceURLs,omitempty"`
+
+	// LangURLs sends a scan with an Accept-Language that matches a BCP 47
+	// tag, "fr", "pt-BR", to that URL.
+	LangURLs map[string]string `json:"LangURLs,omitempty"`
+
+	// Variants splits the scans between URLs by weight for an A/B test.
+	// VariantCounts is the number of scans sent to each, it is kept by
+	// Resolve and not changed by SetMeta.
+	Variants      []Variant      `json:"Variants,omitempty"`
+	VariantCounts map[string]int `json:"VariantCounts,omitempty"`
+
+	// RedirectStatus is the HTTP status of the redirect, 0 is the server
+	// default.  See ValidRedirectStatus.
+	RedirectStatus int `json:"RedirectStatus,omitempty"`
+
+	// Interstitial is the name of the template for the page /q/ sends in
+	// place of a redirect, letters, digits, - and _.  NoInterstitial
+	// redirects, "" is the server default.
+	Interstitial string `json:"Interstitial,omitempty"`
+
+	// QueryPolicy is what a redirect does with the query string of the scan,
+	// QueryAppend, QueryOverride, QueryDrop or QueryAllow for only the keys
+	// in QueryAllow.  See MergeQuery.
+	QueryPolicy string   `json:"QueryPolicy,omitempty"`
+	QueryAllow  []string `json:"QueryAllow,omitempty"`
+
+	// Campaign is a group of tracking parameters in the server config, and
+	// Tracking the code's own, key -> value.  They are set on the URL at
+	// redirect, Tracking over the Campaign ones.  The values can have
+	// variables, {id}, {time} ... for the scan.
+	Campaign string            `json:"Campaign,omitempty"`
+	Tracking map[string]string `json:"Tracking,omitempty"`
+}
+
+// NoCampaign to SetMeta takes the code out of its Campaign.
+const NoCampaign = "none"
+
+// Interstitial values, NoInterstitial always redirects, ServerInterstitial
+// to SetMeta clears it so the server default is used.
+const (
+	NoInterstitial     = "none"
+	ServerInterstitial = "default"
+)
+
+// Variant is one destination of an A/B test.
+type Variant struct {
+	Name   string `json:"Name"`
+	URL    string `json:"URL"`
+	Weight int    `json:"Weight"`
+}
+
+// CodeInfo is the record kept with each code by PersistentData.SetInfo.
+type CodeInfo struct {
+	CodeMeta
+	History []HistoryEntry `json:"History,omitempty"`
+
+	// Deleted is set by Delete.  The code is kept as a tombstone so the ID is
+	// never used again.
+	Deleted   *time.Time `json:"Deleted,omitempty"`
+	DeletedBy string     `json:"DeletedBy,omitempty"`
+
+	// Schedule is the destinations that replace the URL for a time.
+	Schedule []ScheduleEntry `json:"Schedule,omitempty"`
+
+	// PinHash is the bcrypt hash of the PIN or password, see SetPin.
+	PinHash string `json:"PinHash,omitempty"`
+}
+
+// ParseCodeInfo decodes the string from PersistentData.FetchInfo, "" is an
+// empty CodeInfo.
+func ParseCodeInfo(s string) (ci CodeInfo, err error) {
+	if s == "" {
+		return
+	}
+	if err = json.Unmarshal([]byte(s), &ci); err != nil {
+		err = fmt.Errorf("invalid code info: %s", err)
+	}
+	return
+}
+
+// String encodes the CodeInfo for PersistentData.SetInfo.
+func (ci CodeInfo) String() string {
+	buf, _ := json.Marshal(ci)
+	return string(buf)
+}
+
+// IsZero returns true if none of the fields are set.
+func (cm CodeMeta) IsZero() bool {
+	return cm.Owner == "" && cm.Title == "" && cm.Tags == nil && cm.Created == nil && cm.Updated == nil &&
+		!cm.Locked && cm.LockedBy == "" && cm.LockedAt == nil && !cm.Disabled &&
+		cm.Expires == nil && cm.MaxScans == 0 && cm.ExpiredURL == "" && cm.DeviceURLs == nil &&
+		cm.LangURLs == nil && cm.Variants == nil && cm.VariantCounts == nil && cm.RedirectStatus == 0 &&
+		cm.Interstitial == "" && cm.QueryPolicy == "" && cm.QueryAllow == nil &&
+		cm.Campaign == "" && cm.Tracking == nil
+}
+
+// ValidRedirectStatus returns true if status is 301, 302, 303, 307 or 308.
+func ValidRedirectStatus(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// IsExpired returns true if the code is past Expires at now or count is up to
+// MaxScans.
+func (cm CodeMeta) IsExpired(count int, now time.Time) bool {
+	return (cm.Expires != nil && !now.Before(*cm.Expires)) || (cm.MaxScans > 0 && count >= cm.MaxScans)
+}
+
+// touch sets Updated, and Created if it is not set, to now.
+func (ci *CodeInfo) touch(now time.Time) {
+	if ci.Created == nil {
+		ci.Created = &now
+	}
+	ci.Updated = &now
+}
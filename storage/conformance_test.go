@@ -0,0 +1,93 @@
+package storage_test
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/American-Certified-Brands/tools/qr-short/storage"
+	"github.com/American-Certified-Brands/tools/qr-short/storage/storagetest"
+)
+
+func TestMemoryStoreConformance(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) storage.PersistentData {
+		data, err := storage.NewMemoryStore(true, os.Stderr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	})
+}
+
+func TestFilesystemConformance(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) storage.PersistentData {
+		data, err := storage.NewFilesystem(t.TempDir(), true, os.Stderr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	})
+}
+
+func TestBoltStoreConformance(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) storage.PersistentData {
+		data, err := storage.NewBoltStore(filepath.Join(t.TempDir(), "qr.db"), true, os.Stderr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { data.Close() })
+		return data
+	})
+}
+
+// TestPostgresStoreConformance uses the scratch database in $QR_SHORT_TEST_PG,
+// the qr-short tables in it are dropped before each sub-test.
+func TestPostgresStoreConformance(t *testing.T) {
+	connStr := os.Getenv("QR_SHORT_TEST_PG")
+	if connStr == "" {
+		t.Skip("QR_SHORT_TEST_PG is not set")
+	}
+	storagetest.RunConformance(t, func(t *testing.T) storage.PersistentData {
+		db, err := sql.Open("postgres", connStr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(`DROP TABLE IF EXISTS qr_code, qr_schema_version; DROP SEQUENCE IF EXISTS qr_seq`)
+		db.Close()
+		if err != nil {
+			t.Fatalf("unable to reset the test database: %s", err)
+		}
+		data, err := storage.NewPostgresStore(connStr, true, os.Stderr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { data.Close() })
+		return data
+	})
+}
+
+// TestRedisStoreConformance uses the Redis in $QR_SHORT_TEST_REDIS (host:port),
+// each sub-test has its own key prefix.
+func TestRedisStoreConformance(t *testing.T) {
+	addr := os.Getenv("QR_SHORT_TEST_REDIS")
+	if addr == "" {
+		t.Skip("QR_SHORT_TEST_REDIS is not set")
+	}
+	host, port := addr, "6379"
+	if ii := strings.LastIndex(addr, ":"); ii >= 0 {
+		host, port = addr[:ii], addr[ii+1:]
+	}
+	storagetest.RunConformance(t, func(t *testing.T) storage.PersistentData {
+		prefix := fmt.Sprintf("qrtest%d", time.Now().UnixNano())
+		data, err := storage.NewRedisStore(host, port, os.Getenv("QR_SHORT_TEST_REDIS_AUTH"), prefix, true, storage.RedisOptions{}, os.Stderr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { data.Close() })
+		return data
+	})
+}
@@ -0,0 +1,71 @@
+package storage
+
+// Copyright (C) Philip Schlump 2018-2019.
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Disable stops ID from redirecting, Fetch returns ErrDisabled.  The URL,
+// count and history are kept and Enable turns it back on.
+func (a *V1Adapter) Disable(ctx context.Context, ID string) error {
+	return a.setDisabled(ctx, ID, true)
+}
+
+// Enable allows ID to redirect again.
+func (a *V1Adapter) Enable(ctx context.Context, ID string) error {
+	return a.setDisabled(ctx, ID, false)
+}
+
+func (a *V1Adapter) setDisabled(ctx context.Context, ID string, disabled bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := ValidID(ID); err != nil {
+		return err
+	}
+	return a.updateInfo(ID, func(ci *CodeInfo) error {
+		if ci.Deleted != nil {
+			return fmt.Errorf("%w: %s", ErrDeleted, ID)
+		}
+		ci.Disabled = disabled
+		return nil
+	})
+}
+
+// Delete removes ID.  None of the backends can remove a code, and a printed
+// code must never be given a new meaning, so the code is kept as a tombstone.
+// Fetch, Code and UpdateInsert return ErrDeleted, List leaves it out and the
+// sequence is already past it so NextID never returns it.  A locked code can
+// not be deleted.  The delete is added to the history.
+func (a *V1Adapter) Delete(ctx context.Context, ID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := ValidID(ID); err != nil {
+		return err
+	}
+	a.infoLock.Lock()
+	defer a.infoLock.Unlock()
+	old, found, err := a.peek(ID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("%w: %s", ErrNotFound, ID)
+	}
+	return a.updateInfoLocked(ID, func(ci *CodeInfo) error {
+		switch {
+		case ci.Deleted != nil:
+			return fmt.Errorf("%w: %s", ErrDeleted, ID)
+		case ci.Locked:
+			return fmt.Errorf("%w: %s, unlock it to delete it", ErrLocked, ID)
+		}
+		now := time.Now()
+		ci.Deleted, ci.DeletedBy = &now, ActorFrom(ctx)
+		ci.addHistory(ctx, "delete", old.URL, "", now)
+		return nil
+	})
+}
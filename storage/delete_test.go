@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDisable(t *testing.T) {
+	data, _ := NewMemoryStore(true, os.Stderr)
+	ds := AdaptV1(data)
+	ctx := context.Background()
+
+	id, _ := ds.Insert(ctx, "http://example.com/a")
+	if err := ds.Disable(ctx, id); err != nil {
+		t.Fatalf("Disable: %s", err)
+	}
+	if _, err := ds.Fetch(ctx, id); !errors.Is(err, ErrDisabled) || !errors.Is(err, ErrNotFound) {
+		t.Errorf("Fetch of a disabled code error = %v, expected ErrDisabled", err)
+	}
+	if _, err := ds.FetchRaw(ctx, id); !errors.Is(err, ErrDisabled) {
+		t.Errorf("FetchRaw of a disabled code error = %v, expected ErrDisabled", err)
+	}
+	if ld, err := ds.Code(ctx, id); err != nil || !ld.Disabled || ld.Count != 0 {
+		t.Errorf("Code of a disabled code = %+v, %v", ld, err)
+	}
+	if err := ds.Enable(ctx, id); err != nil {
+		t.Fatalf("Enable: %s", err)
+	}
+	if URL, err := ds.Fetch(ctx, id); err != nil || URL != "http://example.com/a" {
+		t.Errorf("Fetch after Enable = %q, %v", URL, err)
+	}
+	if err := ds.Disable(ctx, "zzzz"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Disable of a code that does not exist error = %v, expected ErrNotFound", err)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	data, _ := NewMemoryStore(true, os.Stderr)
+	ds := AdaptV1(data)
+	ctx := WithActor(context.Background(), "bob")
+
+	a, _ := ds.Insert(ctx, "http://example.com/a")
+	b, _ := ds.Insert(ctx, "http://example.com/b")
+	if err := ds.Delete(ctx, a); err != nil {
+		t.Fatalf("Delete: %s", err)
+	}
+	if _, err := ds.Fetch(ctx, a); !errors.Is(err, ErrDeleted) || !errors.Is(err, ErrNotFound) {
+		t.Errorf("Fetch of a deleted code error = %v, expected ErrDeleted", err)
+	}
+	if _, err := ds.Code(ctx, a); !errors.Is(err, ErrDeleted) {
+		t.Errorf("Code of a deleted code error = %v, expected ErrDeleted", err)
+	}
+	if dat, _ := ds.List(ctx, "0", "last"); len(dat) != 1 || dat[0].URL != "http://example.com/b" {
+		t.Errorf("List after Delete = %+v, expected only %s", dat, b)
+	}
+	ur, err := ds.UpdateInsert(ctx, "http://example.com/c", a)
+	if !errors.Is(err, ErrDeleted) || !strings.HasPrefix(ur.Msg, "fail:") {
+		t.Errorf("UpdateInsert of a deleted code = %+v, %v, expected ErrDeleted", ur, err)
+	}
+	if _, err := ds.Rollback(ctx, a, 1); !errors.Is(err, ErrDeleted) {
+		t.Errorf("Rollback of a deleted code error = %v, expected ErrDeleted", err)
+	}
+	if err := ds.Enable(ctx, a); !errors.Is(err, ErrDeleted) {
+		t.Errorf("Enable of a deleted code error = %v, expected ErrDeleted", err)
+	}
+	if err := ds.Delete(ctx, a); !errors.Is(err, ErrDeleted) {
+		t.Errorf("second Delete error = %v, expected ErrDeleted", err)
+	}
+	for ii := 0; ii < 5; ii++ {
+		if id, _ := ds.NextID(ctx); id == a {
+			t.Errorf("NextID returned the deleted ID %s", a)
+		}
+	}
+	ci, _ := ds.FetchInfo(ctx, a)
+	if ci.Deleted == nil || ci.DeletedBy != "bob" || ci.History[len(ci.History)-1].Action != "delete" {
+		t.Errorf("tombstone = %+v", ci)
+	}
+
+	ds.Lock(ctx, b)
+	if err := ds.Delete(ctx, b); !errors.Is(err, ErrLocked) {
+		t.Errorf("Delete of a locked code error = %v, expected ErrLocked", err)
+	}
+	if err := ds.Delete(ctx, "zzzz"); !errors.Is(err, ErrNotFound) || errors.Is(err, ErrDeleted) {
+		t.Errorf("Delete of a code that does not exist error = %v, expected ErrNotFound", err)
+	}
+}
@@ -0,0 +1,52 @@
+package storage
+
+// Copyright (C) Philip Schlump 2018-2019.
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by PersistentDataV2.  Other errors are wrapped so that
+// errors.Is can be used to check for these.
+var (
+	// ErrNotFound is returned when the ID does not exist.
+	ErrNotFound = errors.New("not found")
+
+	// ErrConflict is returned when the change conflicts with the existing data,
+	// for example a new ID that is already in use.
+	ErrConflict = errors.New("conflict")
+
+	// ErrInvalidID is returned when the ID is not a valid base 36 code.
+	ErrInvalidID = errors.New("invalid ID")
+
+	// ErrInvalidRange is returned by List when beg/end are not valid.
+	ErrInvalidRange = errors.New("invalid range")
+
+	// ErrBackendUnavailable is returned when the storage system fails, Redis is
+	// down, the disk is full etc.  Trying again later may work.
+	ErrBackendUnavailable = errors.New("storage backend unavailable")
+
+	// ErrReadOnly is returned when a store that was opened read only is changed.
+	ErrReadOnly = errors.New("store is read only")
+
+	// ErrInvalidBackup is returned by RestoreBackup when the archive is damaged,
+	// truncated or from a newer version.  Nothing has been written.
+	ErrInvalidBackup = errors.New("invalid backup archive")
+
+	// ErrLocked is returned when the URL of a locked code is changed.  It is an
+	// ErrConflict.
+	ErrLocked = fmt.Errorf("%w: code is locked", ErrConflict)
+
+	// ErrDisabled is returned by Fetch for a code that has been disabled.  It
+	// is an ErrNotFound.
+	ErrDisabled = fmt.Errorf("%w: code is disabled", ErrNotFound)
+
+	// ErrDeleted is returned for a code that has been deleted.  The ID is kept
+	// as a tombstone and is never used again.  It is an ErrNotFound.
+	ErrDeleted = fmt.Errorf("%w: code is deleted", ErrNotFound)
+
+	// ErrExpired is returned by Fetch for a code that is past its expiry time
+	// or has used up its scans.  It is an ErrNotFound.
+	ErrExpired = fmt.Errorf("%w: code has expired", ErrNotFound)
+)
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestExpiry(t *testing.T) {
+	data, _ := NewMemoryStore(true, os.Stderr)
+	ds := AdaptV1(data)
+	ctx := context.Background()
+
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	old, _ := ds.Insert(ctx, "http://example.com/old")
+	ds.SetMeta(ctx, old, CodeMeta{Expires: &past, ExpiredURL: "http://example.com/over"})
+	if _, err := ds.Fetch(ctx, old); !errors.Is(err, ErrExpired) || !errors.Is(err, ErrNotFound) {
+		t.Errorf("Fetch of an expired code error = %v, expected ErrExpired", err)
+	}
+	if ci, _ := ds.FetchInfo(ctx, old); ci.ExpiredURL != "http://example.com/over" {
+		t.Errorf("ExpiredURL = %q", ci.ExpiredURL)
+	}
+
+	cur, _ := ds.Insert(ctx, "http://example.com/cur")
+	ds.SetMeta(ctx, cur, CodeMeta{Expires: &future, MaxScans: 2})
+	for ii := 0; ii < 2; ii++ {
+		if _, err := ds.Fetch(ctx, cur); err != nil {
+			t.Fatalf("scan %d: %s", ii+1, err)
+		}
+	}
+	if _, err := ds.FetchRaw(ctx, cur); !errors.Is(err, ErrExpired) {
+		t.Errorf("third scan error = %v, expected ErrExpired", err)
+	}
+
+	dat, _ := ds.List(ctx, "0", "last")
+	if len(dat) != 2 || !dat[0].Expired || !dat[1].Expired || dat[1].MaxScans != 2 || dat[1].Expires == nil {
+		t.Errorf("List = %+v, expected both expired", dat)
+	}
+
+	// Clear the quota and the expiry.
+	ds.SetMeta(ctx, cur, CodeMeta{MaxScans: -1, Expires: &time.Time{}})
+	if ci, _ := ds.FetchInfo(ctx, cur); ci.MaxScans != 0 || ci.Expires != nil {
+		t.Errorf("after clear CodeMeta = %+v", ci.CodeMeta)
+	}
+	if _, err := ds.Fetch(ctx, cur); err != nil {
+		t.Errorf("Fetch after clear: %s", err)
+	}
+}
@@ -3,48 +3,257 @@ package storage
 // Copyright (C) Philip Schlump 2018-2019.
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/pschlump/godebug"
 )
 
 // FileStorage implements PersistentData using the local file system.
+//
+// Each code is a file in StorageDir named by the ID.  The sequence is kept
+// in the file "!seq" in the same directory, this is the same as "qr!seq" in
+// Redis.  The '!' can not occur in a base 36 ID so the names will not collide.
 type FileStorage struct {
 	StorageDir string
 	Log        *os.File
+	CountHits  bool
 	lock       sync.RWMutex
+	readOnly   bool
 }
 
+// fileRecord is the JSON data that is stored in each file.  Older files have
+// just the URL in them, if the 1st char is not a '{' then it is an old file.
+// Old files are converted to JSON the next time they are written.
+type fileRecord struct {
+	URL     string    `json:"URL"`
+	Created time.Time `json:"Created"`
+	Updated time.Time `json:"Updated"`
+	Count   int       `json:"Count"`
+	Info    string    `json:"Info,omitempty"`
+}
+
+// seqFileName is the name of the sequence file in StorageDir.
+const seqFileName = "!seq"
+
 // NewFilesystem creates a new connection to the filesystem for storing shorened URLs
-func NewFilesystem(storageDir string, log *os.File) (rv PersistentData, err error) {
+func NewFilesystem(storageDir string, countHits bool, log *os.File) (rv PersistentData, err error) {
 	err = os.MkdirAll(storageDir, 0744)
+	if err != nil {
+		return nil, err
+	}
+	fs := &FileStorage{
+		StorageDir: storageDir,
+		Log:        log,
+		CountHits:  countHits,
+	}
+	err = fs.recoverSeq()
+	return fs, err
+}
+
+// NewFilesystemReadOnly opens an existing directory without changing anything
+// in it, the sequence is not repaired and hits are not counted.  The counts
+// are still returned by List.  This is used to read from a store that another
+// server may be using.
+func NewFilesystemReadOnly(storageDir string, log *os.File) (rv PersistentData, err error) {
+	fi, err := os.Stat(storageDir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", storageDir)
+	}
 	return &FileStorage{
 		StorageDir: storageDir,
 		Log:        log,
-	}, err
+		CountHits:  true,
+		readOnly:   true,
+	}, nil
+}
+
+// recoverSeq is called at startup.  It checks the sequence file against the
+// codes that are in the directory and repairs it if it is missing, corrupt or
+// behind.  A directory from before there was a sequence file is the same as
+// a missing one, the old ID was the count of the files so the sequence
+// starts at the larger of that and the largest ID found.
+func (fs *FileStorage) recoverSeq() error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	seq, want, err := fs.scanSeq(true)
+	if err != nil {
+		return err
+	}
+	if want != seq {
+		return fs.writeSeq(want)
+	}
+	return nil
+}
+
+// scanSeq returns the sequence from the file and the value it should have from
+// looking at the codes in the directory.  If removeTmp is true left over
+// temporary files are removed.  The caller must hold fs.lock.
+func (fs *FileStorage) scanSeq(removeTmp bool) (seq, want int64, err error) {
+	files, err := ioutil.ReadDir(fs.StorageDir)
+	if err != nil {
+		return 0, 0, err
+	}
+	var nFiles, maxID int64
+	for _, fi := range files {
+		if !fi.IsDir() && strings.HasSuffix(fi.Name(), ".tmp") {
+			if removeTmp {
+				os.Remove(filepath.Join(fs.StorageDir, fi.Name())) // left over from a crash during writeFileAtomic
+			}
+			continue
+		}
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), "!") || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		nFiles++
+		if nn, err := strconv.ParseInt(fi.Name(), 36, 64); err == nil && nn > maxID {
+			maxID = nn
+		}
+	}
+
+	seq, err = fs.readSeq()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Fprintf(fs.Log, "Warning: sequence file %s is not valid: %s\n", fs.seqFile(), err)
+		}
+		seq = 0 // so that it is always written
+	}
+	want = 1 // Same starting point as Redis "qr!seq".
+	if seq > want {
+		want = seq
+	}
+	if nFiles > want {
+		want = nFiles
+	}
+	if maxID > want {
+		want = maxID
+	}
+	return seq, want, nil
+}
+
+// seqFile returns the full path to the sequence file.
+func (fs *FileStorage) seqFile() string {
+	return filepath.Join(fs.StorageDir, seqFileName)
+}
+
+// readSeq reads the current sequence value.  The caller must hold fs.lock.
+func (fs *FileStorage) readSeq() (int64, error) {
+	buf, err := ioutil.ReadFile(fs.seqFile())
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(buf)), 10, 64)
+}
+
+// currentSeq is readSeq for a normal store.  A read only store has not had the
+// sequence repaired so it is worked out from the directory each time.  The
+// caller must hold fs.lock.
+func (fs *FileStorage) currentSeq() (int64, error) {
+	if fs.readOnly {
+		_, want, err := fs.scanSeq(false)
+		return want, err
+	}
+	return fs.readSeq()
+}
+
+// writeSeq saves the sequence value.  The caller must hold fs.lock.
+func (fs *FileStorage) writeSeq(seq int64) error {
+	return fs.writeFileAtomic(fs.seqFile(), []byte(fmt.Sprintf("%d\n", seq)))
+}
+
+// writeFileAtomic writes to a temporary file, syncs it and then renames it over
+// the old one so that a crash leaves either the old or the new data, never a
+// partial file.
+func (fs *FileStorage) writeFileAtomic(fn string, data []byte) error {
+	if fs.readOnly {
+		return ErrReadOnly
+	}
+	tmp := fn + ".tmp"
+	fp, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fp.Write(data)
+	if err == nil {
+		err = fp.Sync()
+	}
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, fn); err != nil {
+		return err
+	}
+	// sync the directory so that the rename is on disk.
+	if dir, err := os.Open(fs.StorageDir); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// readRecord reads the file for `id`.  Old files with just a URL in them are
+// returned as a record with only the URL set.  The caller must hold fs.lock.
+func (fs *FileStorage) readRecord(id string) (rec fileRecord, err error) {
+	data, err := ioutil.ReadFile(filepath.Join(fs.StorageDir, id))
+	if err != nil {
+		return
+	}
+	if len(data) > 0 && data[0] == '{' {
+		err = json.Unmarshal(data, &rec)
+		return
+	}
+	rec.URL = string(bytes.TrimRight(data, "\n"))
+	return
+}
+
+// writeRecord saves the record for `id` as JSON.  The caller must hold fs.lock.
+func (fs *FileStorage) writeRecord(id string, rec fileRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return fs.writeFileAtomic(filepath.Join(fs.StorageDir, id), data)
 }
 
 // NextID returns the next higher integer that will be used to lookup the URL.
+// The sequence is read, incremented and written back while holding the lock so
+// two requests can not get the same ID, and IDs are never re-used.
 func (fs *FileStorage) NextID() string {
 	fs.lock.Lock()
 	defer fs.lock.Unlock()
-	files, err := ioutil.ReadDir(fs.StorageDir)
+	seq, err := fs.readSeq()
 	if err != nil {
 		fmt.Fprintf(fs.Log, "Error: %s, %s\n", err, godebug.LF())
 		return ""
 	}
-	return strconv.FormatUint(uint64(len(files)+1), 36) // Base 36, take count of # of files add 1, this is the ID.
+	seq++
+	if err = fs.writeSeq(seq); err != nil {
+		fmt.Fprintf(fs.Log, "Error: %s, %s\n", err, godebug.LF())
+		return ""
+	}
+	return strconv.FormatUint(uint64(seq), 36) // Base 36, this is the ID.
 }
 
 // Exists returns true if the ID exists in the file store.
 func (fs *FileStorage) Exists(ID string) bool {
-	fs.lock.Lock()
-	defer fs.lock.Unlock()
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
 	fn := filepath.Join(fs.StorageDir, ID)
 	if FileExists(fn) {
 		return true
@@ -55,14 +264,25 @@ func (fs *FileStorage) Exists(ID string) bool {
 // Insert writes out the `urlStr` into the `~/data` direcotry under the file name in `ID`
 func (fs *FileStorage) Insert(urlStr string) (string, error) {
 	id := fs.NextID()
+	if id == "" {
+		return "", fmt.Errorf("unable to allocate a new ID")
+	}
 	return fs.Update(urlStr, id)
 }
 
-// Update update an existing URL encode.
+// Update update an existing URL encode.  The created time and count are kept
+// from the existing record, if there is one.
 func (fs *FileStorage) Update(urlStr, id string) (string, error) {
 	fs.lock.Lock()
 	defer fs.lock.Unlock()
-	err := ioutil.WriteFile(filepath.Join(fs.StorageDir, id), []byte(urlStr), 0644)
+	now := time.Now()
+	rec, err := fs.readRecord(id)
+	if err != nil || rec.Created.IsZero() {
+		rec.Created = now
+	}
+	rec.URL = urlStr
+	rec.Updated = now
+	err = fs.writeRecord(id, rec)
 	if err != nil {
 		fmt.Fprintf(fs.Log, "Error: writing file: %s\n", err)
 		return id, err
@@ -72,37 +292,106 @@ func (fs *FileStorage) Update(urlStr, id string) (string, error) {
 
 // Fetch converts from a `id` into a `url` to be returned.
 func (fs *FileStorage) Fetch(id string) (string, error) {
-	fs.lock.Lock()
-	defer fs.lock.Unlock()
-	data, err := ioutil.ReadFile(filepath.Join(fs.StorageDir, id))
-	return string(data), err
+	return fs.fetch(id)
 }
 
+// FetchRaw converts from a `id` into a `url` to be returned.
 func (fs *FileStorage) FetchRaw(id string) (string, error) {
-	fs.lock.Lock()
-	defer fs.lock.Unlock()
-	data, err := ioutil.ReadFile(filepath.Join(fs.StorageDir, id))
-	return string(data), err
+	return fs.fetch(id)
+}
+
+// fetch reads the record and if counting hits updates the count.  Only a read
+// lock is needed when hits are not counted so redirects can run in parallel.
+func (fs *FileStorage) fetch(id string) (string, error) {
+	if fs.CountHits && !fs.readOnly {
+		fs.lock.Lock()
+		defer fs.lock.Unlock()
+	} else {
+		fs.lock.RLock()
+		defer fs.lock.RUnlock()
+	}
+	rec, err := fs.readRecord(id)
+	if os.IsNotExist(err) {
+		return "", ErrNotFound
+	} else if err != nil {
+		return "", err
+	}
+	if fs.CountHits && !fs.readOnly {
+		rec.Count++
+		if err := fs.writeRecord(id, rec); err != nil {
+			fmt.Fprintf(fs.Log, "Error: %s, %s\n", err, godebug.LF())
+		}
+	}
+	return rec.URL, nil
 }
 
 // List returns a list of all the redirects between beg and end, where beg
-// can be 0 to start at the beginning and end can be 'last' to to go the most
-// recent item.
+// can be 0 to start at the beginning and end can be 'last' | '*' | 'latest'
+// to to go the most recent item.  This has the same limits as RedisStore.List,
+// at most 1000 are returned in a single call.
 func (fs *FileStorage) List(beg, end string) (dat []ListData, err error) {
-	fs.lock.Lock()
-	defer fs.lock.Unlock()
-	// data, err := ioutil.ReadFile(filepath.Join(fs.StorageDir, id))
-	// xyzzy - direcotyr list, pull out stuff
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+
+	maxID, err := fs.currentSeq()
+	if err != nil {
+		fmt.Fprintf(fs.Log, "Error: %s, %s\n", err, godebug.LF())
+		return
+	}
+	begInt, endInt, err := listRange(beg, end, maxID)
+	if err != nil {
+		fmt.Fprintf(fs.Log, "Error: %s, %s\n", err, godebug.LF())
+		return
+	}
+
+	dataRange := endInt - begInt + 1
+	if dataRange > 1000 {
+		dataRange = 1000
+	}
+	dat = make([]ListData, 0, dataRange)
+	jj := 0
+	for ii := begInt; ii < endInt && jj < 1000; ii++ {
+		jj++
+		key := strconv.FormatUint(uint64(ii), 36) // Base 36
+		rec, err := fs.readRecord(key)
+		if err != nil || rec.URL == "" {
+			continue
+		}
+		nUse := 0
+		if fs.CountHits {
+			nUse = rec.Count
+		}
+		dat = append(dat, ListData{
+			ID:    fmt.Sprintf("%d", ii),
+			URL:   rec.URL,
+			Count: nUse,
+		})
+	}
+	if db4 {
+		fmt.Printf("dat=%s AT: %s\n", godebug.SVarI(dat), godebug.LF())
+	}
 	return
 }
 
 // UpdateInsert performs an Insert if the ID is new or an Update if it already exists.
+// The sequence is moved to max(cur,1+id) so that NextID will not hand out an ID
+// that was loaded in bulk, this is the same as RedisStore.
 func (fs *FileStorage) UpdateInsert(URL string, ID string) (ur UpdateRespItem) {
 
 	var err error
 	var code string
 
-	ur.ID = code
+	ur.ID = ID
+	IDint, err := strconv.ParseInt(ID, 36, 64) // Base 36, Parse the int into a number
+	if err != nil {
+		ur.Msg = fmt.Sprintf("fail:%s", err)
+		return
+	}
+	if err = fs.bumpSeq(IDint); err != nil {
+		ur.Msg = fmt.Sprintf("fail:%s", err)
+		return
+	}
+
 	fn := filepath.Join(fs.StorageDir, ID)
 	if !FileExists(fn) {
 		code, err = fs.Update(URL, ID)
@@ -111,6 +400,7 @@ func (fs *FileStorage) UpdateInsert(URL string, ID string) (ur UpdateRespItem) {
 		code, err = fs.Update(URL, ID)
 		ur.Msg = "success/update"
 	}
+	ur.ID = code
 
 	if err != nil {
 		ur.Msg = fmt.Sprintf("fail:%s", err)
@@ -119,6 +409,74 @@ func (fs *FileStorage) UpdateInsert(URL string, ID string) (ur UpdateRespItem) {
 	return
 }
 
+// bumpSeq moves the sequence to id+1 if id is at or past the current value.
+func (fs *FileStorage) bumpSeq(id int64) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	seq, err := fs.readSeq()
+	if err != nil {
+		return err
+	}
+	if id >= seq {
+		if db6 {
+			fmt.Printf("IDint=%d AT: %s\n", id, godebug.LF())
+		}
+		return fs.writeSeq(id + 1)
+	}
+	return nil
+}
+
+// Seq returns the current value of the sequence.
+func (fs *FileStorage) Seq() (int64, error) {
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+	return fs.currentSeq()
+}
+
+// SetSeq moves the sequence up to n if it is less than n.
+func (fs *FileStorage) SetSeq(n int64) error {
+	return fs.bumpSeq(n - 1) // bumpSeq moves the sequence to id+1 if it is at or past the current value.
+}
+
+// SetCount sets the hit count for ID.
+func (fs *FileStorage) SetCount(ID string, n int) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	rec, err := fs.readRecord(ID)
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	rec.Count = n
+	return fs.writeRecord(ID, rec)
+}
+
+// FetchInfo returns the metadata for ID.
+func (fs *FileStorage) FetchInfo(ID string) (string, error) {
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+	rec, err := fs.readRecord(ID)
+	if os.IsNotExist(err) {
+		return "", ErrNotFound
+	}
+	return rec.Info, err
+}
+
+// SetInfo saves the metadata for ID in the file with the URL.
+func (fs *FileStorage) SetInfo(ID string, info string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	rec, err := fs.readRecord(ID)
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	rec.Info = info
+	return fs.writeRecord(ID, rec)
+}
+
 // FileExists returns true if the file exists in the file system.
 func FileExists(name string) bool {
 	if _, err := os.Stat(name); err != nil {
@@ -129,6 +487,12 @@ func FileExists(name string) bool {
 	return true
 }
 
+// Close does nothing, no files are held open.
+func (fs *FileStorage) Close() error {
+	return nil
+}
+
+// IncrementRedirectCount is a no-op, the count is incremented by Fetch
+// the same as with Redis.
 func (fs *FileStorage) IncrementRedirectCount(id string) {
-	// xyzzy - need to implement this.
 }
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFilesystemRecoverSeq(t *testing.T) {
+	tests := []struct {
+		name   string
+		files  map[string]string
+		nextID string
+	}{
+		{"empty", nil, "2"},
+		{"old directory, no sequence file", map[string]string{"5": "http://example.com/5", "6": "http://example.com/6"}, "7"},
+		{"sequence behind", map[string]string{"!seq": "3\n", "a": "http://example.com/a"}, "b"},
+		{"sequence ahead", map[string]string{"!seq": "100\n", "5": "http://example.com/5"}, "2t"},
+		{"corrupt sequence", map[string]string{"!seq": "xyz", "5": "http://example.com/5"}, "6"},
+		{"left over tmp files", map[string]string{"!seq": "5\n", "5": "http://example.com/5", "!seq.tmp": "9", "6.tmp": "{", "7.tmp": "{", "8.tmp": "{", "9.tmp": "{", "a.tmp": "{", "b.tmp": "{"}, "6"},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		for fn, data := range test.files {
+			if err := os.WriteFile(filepath.Join(dir, fn), []byte(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		data, err := NewFilesystem(dir, true, os.Stderr)
+		if err != nil {
+			t.Errorf("%s: NewFilesystem: %s", test.name, err)
+			continue
+		}
+		if id := data.NextID(); id != test.nextID {
+			t.Errorf("%s: NextID() = %s, expected %s", test.name, id, test.nextID)
+		}
+		tmps, _ := filepath.Glob(filepath.Join(dir, "*.tmp"))
+		if len(tmps) != 0 {
+			t.Errorf("%s: temporary files not removed: %s", test.name, tmps)
+		}
+	}
+}
+
+func TestFilesystemFetchParallel(t *testing.T) {
+	dir := t.TempDir()
+	data, err := NewFilesystem(dir, false, os.Stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := data.Insert("http://example.com/a")
+	done := make(chan bool)
+	for ii := 0; ii < 10; ii++ {
+		go func() {
+			for jj := 0; jj < 20; jj++ {
+				if got, err := data.Fetch(id); err != nil || got != "http://example.com/a" {
+					t.Errorf("Fetch(%s) = %q, %v", id, got, err)
+				}
+			}
+			done <- true
+		}()
+	}
+	for ii := 0; ii < 10; ii++ {
+		<-done
+	}
+	if dat, _ := data.List("0", "last"); len(dat) != 1 || dat[0].Count != 0 {
+		t.Errorf("List = %+v, expected 1 item with a count of 0 when hits are not counted", dat)
+	}
+}
+
+func TestFilesystemReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	data, _ := NewFilesystem(dir, true, os.Stderr)
+	id, _ := data.Insert("http://example.com/a")
+
+	ro, err := NewFilesystemReadOnly(dir, os.Stderr)
+	if err != nil {
+		t.Fatalf("NewFilesystemReadOnly: %s", err)
+	}
+	if got, err := ro.Fetch(id); err != nil || got != "http://example.com/a" {
+		t.Errorf("Fetch(%s) = %q, %v", id, got, err)
+	}
+	if _, err := ro.Update("http://example.com/b", id); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Update on a read only store = %v, expected ErrReadOnly", err)
+	}
+	if dat, _ := data.List("0", "last"); len(dat) != 1 || dat[0].Count != 0 {
+		t.Errorf("List = %+v, a read only Fetch must not count the hit", dat)
+	}
+	if _, err := NewFilesystemReadOnly(filepath.Join(dir, "missing"), os.Stderr); err == nil {
+		t.Errorf("NewFilesystemReadOnly of a missing directory did not fail")
+	}
+}
@@ -0,0 +1,93 @@
+package storage
+
+// Copyright (C) Philip Schlump 2018-2019.
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// HistoryEntry is one change to the URL of a code.  The history is kept in the
+// CodeInfo and is only ever added to, a rollback is a new entry.
+type HistoryEntry struct {
+	Version int       `json:"Version"` // 1, 2, 3 ... for each change to the code
+	Action  string    `json:"Action"`  // insert, update, rollback or delete
+	OldURL  string    `json:"OldURL,omitempty"`
+	NewURL  string    `json:"NewURL"`
+	Time    time.Time `json:"Time"`
+	Actor   string    `json:"Actor,omitempty"` // who made the change, see WithActor
+}
+
+type actorKey struct{}
+
+// WithActor returns a context that records actor, the user_id or auth identity
+// of the caller, in the history of any code changed with it.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFrom returns the actor set with WithActor, "" if there is none.
+func ActorFrom(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// addHistory appends an entry for a change from oldURL to newURL.
+func (ci *CodeInfo) addHistory(ctx context.Context, action, oldURL, newURL string, now time.Time) {
+	ci.History = append(ci.History, HistoryEntry{
+		Version: len(ci.History) + 1,
+		Action:  action,
+		OldURL:  oldURL,
+		NewURL:  newURL,
+		Time:    now,
+		Actor:   ActorFrom(ctx),
+	})
+}
+
+// History returns the changes to the URL of ID, oldest first.  Codes that were
+// last changed before the history was kept have no history.
+func (a *V1Adapter) History(ctx context.Context, ID string) ([]HistoryEntry, error) {
+	ci, err := a.FetchInfo(ctx, ID)
+	if err != nil {
+		return nil, err
+	}
+	return ci.History, nil
+}
+
+// Rollback sets the URL of ID back to what it was after version.  Version 0 is
+// the URL before the first change in the history.  The rollback is added to the
+// history so it can be undone in the same way.
+func (a *V1Adapter) Rollback(ctx context.Context, ID string, version int) (entry HistoryEntry, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if err = ValidID(ID); err != nil {
+		return
+	}
+	a.infoLock.Lock()
+	defer a.infoLock.Unlock()
+	ci, err := a.fetchInfo(ID)
+	if err != nil {
+		return
+	}
+	var URL string
+	switch {
+	case version < 0 || version > len(ci.History) || len(ci.History) == 0:
+		return entry, fmt.Errorf("%w: %s has no version %d, there are %d", ErrNotFound, ID, version, len(ci.History))
+	case version == 0 && ci.History[0].OldURL == "":
+		return entry, fmt.Errorf("%w: %s was created with version 1", ErrNotFound, ID)
+	case version == 0:
+		URL = ci.History[0].OldURL
+	default:
+		URL = ci.History[version-1].NewURL
+	}
+	if _, err = a.setURL(ctx, URL, ID, "rollback"); err != nil {
+		return
+	}
+	ci, err = a.fetchInfo(ID)
+	if err != nil {
+		return
+	}
+	return ci.History[len(ci.History)-1], nil
+}
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestHistoryRollback(t *testing.T) {
+	data, _ := NewMemoryStore(true, os.Stderr)
+	ds := AdaptV1(data)
+	ctx := WithActor(context.Background(), "bob")
+
+	// A code from before the history was kept.
+	data.UpdateInsert("http://example.com/v0", "5")
+
+	for _, URL := range []string{"http://example.com/v1", "http://example.com/v2", "http://example.com/v3"} {
+		if _, err := ds.Update(ctx, URL, "5"); err != nil {
+			t.Fatalf("Update: %s", err)
+		}
+	}
+	hist, err := ds.History(ctx, "5")
+	if err != nil || len(hist) != 3 {
+		t.Fatalf("History = %+v, %v, expected 3 entries", hist, err)
+	}
+	if h := hist[0]; h.Version != 1 || h.Action != "update" || h.OldURL != "http://example.com/v0" || h.NewURL != "http://example.com/v1" || h.Actor != "bob" || h.Time.IsZero() {
+		t.Errorf("History[0] = %+v", h)
+	}
+	if h := hist[2]; h.Version != 3 || h.OldURL != "http://example.com/v2" || h.NewURL != "http://example.com/v3" {
+		t.Errorf("History[2] = %+v", h)
+	}
+
+	tests := []struct {
+		version int
+		url     string
+	}{
+		{1, "http://example.com/v1"},
+		{0, "http://example.com/v0"},
+		{3, "http://example.com/v3"},
+	}
+	for ii, test := range tests {
+		h, err := ds.Rollback(ctx, "5", test.version)
+		if err != nil {
+			t.Fatalf("Rollback(%d): %s", test.version, err)
+		}
+		if h.Action != "rollback" || h.NewURL != test.url || h.Version != 4+ii {
+			t.Errorf("Rollback(%d) = %+v, expected version %d to %s", test.version, h, 4+ii, test.url)
+		}
+		if got, _ := data.FetchRaw("5"); got != test.url {
+			t.Errorf("after Rollback(%d) URL = %q, expected %q", test.version, got, test.url)
+		}
+	}
+	if _, err := ds.Rollback(ctx, "5", 99); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Rollback(99) error = %v, expected ErrNotFound", err)
+	}
+
+	data.UpdateInsert("http://example.com/old", "6")
+	if _, err := ds.Rollback(ctx, "6", 0); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Rollback(0) with no history error = %v, expected ErrNotFound", err)
+	}
+
+	id, _ := ds.Insert(ctx, "http://example.com/new")
+	if hist, _ := ds.History(ctx, id); len(hist) != 1 || hist[0].Action != "insert" || hist[0].OldURL != "" {
+		t.Errorf("History after Insert = %+v, expected one insert", hist)
+	}
+	if _, err := ds.Rollback(ctx, id, 0); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Rollback(0) of a new code error = %v, expected ErrNotFound", err)
+	}
+}
@@ -0,0 +1,74 @@
+package storage
+
+// Copyright (C) Philip Schlump 2018-2019.
+
+import (
+	"context"
+	"time"
+)
+
+// PersistentDataV2 is the version 2 of PersistentData.  Each call takes a
+// context and errors are reported with ErrNotFound (or ErrDisabled, ErrDeleted),
+// ErrConflict (or ErrLocked), ErrInvalidID, ErrInvalidRange and
+// ErrBackendUnavailable so that the caller can tell what went wrong.
+//
+// Update is an upsert, an ID that does not exist is created.  Insert, Update
+// and UpdateInsert keep the Created and Updated times in the CodeInfo and add
+// each change to the History, the actor is taken from the context, see WithActor.
+//
+// The existing backends implement PersistentData, use AdaptV1 to get a
+// PersistentDataV2 from them.
+type PersistentDataV2 interface {
+	Insert(ctx context.Context, URL string) (ID string, err error)
+	Exists(ctx context.Context, ID string) (found bool, err error)
+	Update(ctx context.Context, URL string, ID string) (codeID string, err error)
+	Fetch(ctx context.Context, ID string) (URL string, err error)
+	FetchRaw(ctx context.Context, ID string) (URL string, err error)
+	NextID(ctx context.Context) (ID string, err error)
+	List(ctx context.Context, beg, end string) ([]ListData, error)
+	UpdateInsert(ctx context.Context, URL string, ID string) (ur UpdateRespItem, err error)
+	IncrementRedirectCount(ctx context.Context, ID string) error
+
+	// Code returns the URL, count and metadata for ID without counting a hit.
+	Code(ctx context.Context, ID string) (ListData, error)
+	// FetchInfo returns the CodeInfo for ID.
+	FetchInfo(ctx context.Context, ID string) (CodeInfo, error)
+	// SetMeta changes the fields of the metadata that are set in meta.
+	SetMeta(ctx context.Context, ID string, meta CodeMeta) error
+
+	// History returns the changes to the URL of ID, oldest first.
+	History(ctx context.Context, ID string) ([]HistoryEntry, error)
+	// Rollback sets the URL of ID back to the URL after version.
+	Rollback(ctx context.Context, ID string, version int) (HistoryEntry, error)
+
+	// Lock stops the URL of ID from being changed, Update, UpdateInsert and
+	// Rollback return ErrLocked until Unlock is called.
+	Lock(ctx context.Context, ID string) error
+	// Unlock allows the URL of ID to be changed again.
+	Unlock(ctx context.Context, ID string) error
+
+	// Disable stops ID from redirecting, Fetch returns ErrDisabled until
+	// Enable is called.
+	Disable(ctx context.Context, ID string) error
+	// Enable allows ID to redirect again.
+	Enable(ctx context.Context, ID string) error
+	// Delete removes ID.  The ID is kept as a tombstone, Fetch, Code and
+	// UpdateInsert return ErrDeleted and List leaves it out.
+	Delete(ctx context.Context, ID string) error
+
+	// FetchAt returns the URL that Fetch would return at a time without
+	// counting a hit.
+	FetchAt(ctx context.Context, ID string, at time.Time) (URL string, err error)
+	// Resolve finds where a scan goes, Fetch with the routing rules.
+	Resolve(ctx context.Context, ID string, rr ResolveRequest) (Resolution, error)
+	// Schedule returns the scheduled destinations for ID.
+	Schedule(ctx context.Context, ID string) ([]ScheduleEntry, error)
+	// AddSchedule adds a scheduled destination, the N, Created and Actor are
+	// set.
+	AddSchedule(ctx context.Context, ID string, se ScheduleEntry) (ScheduleEntry, error)
+	// CancelSchedule removes scheduled destination N.
+	CancelSchedule(ctx context.Context, ID string, N int) error
+
+	// SetPin sets the PIN or password needed to follow ID, "" removes it.
+	SetPin(ctx context.Context, ID string, pin string) error
+}
@@ -16,14 +16,36 @@ type PersistentData interface {
 	List(string, string) ([]ListData, error)
 	UpdateInsert(URL string, ID string) (ur UpdateRespItem)
 	IncrementRedirectCount(id string)
+
+	// Seq returns the current value of the sequence, the last ID handed out in decimal.
+	Seq() (int64, error)
+	// SetSeq moves the sequence up to n, it is never moved down.
+	SetSeq(n int64) error
+	// SetCount sets the hit count for an ID.
+	SetCount(ID string, n int) error
+
+	// FetchInfo returns the metadata saved with SetInfo, "" if none has been
+	// saved.  It is ErrNotFound if the code does not exist.
+	FetchInfo(ID string) (info string, err error)
+	// SetInfo saves the metadata for an existing code, it is ErrNotFound if the
+	// code does not exist.  The info is JSON, see CodeInfo, the store keeps it
+	// as an opaque string.
+	SetInfo(ID string, info string) error
+
+	// Close releases the connections or files held by the store.
+	Close() error
 }
 
 // ListData is used to format the data returned by the /list API
-// end point into a JSON data.
+// end point into a JSON data.  The CodeMeta, Expired and Protected are filled
+// in by V1Adapter.List, the backends only set ID, URL and Count.
 type ListData struct {
-	ID    string `json:"Id"`
-	URL   string `json:"URL"`
-	Count int    `json:"Count"`
+	ID        string `json:"Id"`
+	URL       string `json:"URL"`
+	Count     int    `json:"Count"`
+	Expired   bool   `json:"Expired,omitempty"`
+	Protected bool   `json:"Protected,omitempty"` // a PIN is needed, see SetPin
+	CodeMeta
 }
 
 // UpdateRespItem is a output type used to respond to bulk udpate
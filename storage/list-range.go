@@ -0,0 +1,43 @@
+package storage
+
+// Copyright (C) Philip Schlump 2018-2019.
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// listRange converts the beg, end parameters of List into integers.  `end` can be
+// 'last' | '*' | 'latest' in which case the list goes through maxID.  This is shared by all the
+// storage backends so that /list behaves the same on each.
+//
+// Before this was shared the Redis List used maxID as the (not included) end, so
+// end=last left out the most recently created code.  Now it is included on every
+// backend.
+func listRange(beg, end string, maxID int64) (begInt, endInt int, err error) {
+	var begI64, endI64 int64
+	begI64, err = strconv.ParseInt(beg, 10, 64)
+	if err != nil {
+		return
+	}
+	begInt = int(begI64)
+
+	if end == "last" || end == "*" || end == "latest" {
+		// The end is not included in the list and the sequence is the last ID
+		// handed out, so go one past it.
+		endInt = int(maxID) + 1
+	} else {
+		endI64, err = strconv.ParseInt(end, 10, 64)
+		if err != nil {
+			return
+		}
+		endInt = int(endI64)
+	}
+
+	dataRange := endInt - begInt + 1
+	if dataRange <= 0 {
+		err = fmt.Errorf("Invalid range for data, %d from end(%d)-beg(%d)+1", dataRange, endInt, begInt)
+		return
+	}
+	return
+}
@@ -0,0 +1,33 @@
+package storage
+
+import "testing"
+
+func TestListRange(t *testing.T) {
+	tests := []struct {
+		beg, end       string
+		maxID          int64
+		begInt, endInt int
+		isErr          bool
+	}{
+		{"0", "10", 50, 0, 10, false},
+		{"0", "last", 50, 0, 51, false}, // the newest ID, 50, is included
+		{"5", "*", 50, 5, 51, false},
+		{"5", "latest", 50, 5, 51, false},
+		{"7", "7", 50, 7, 7, false},
+		{"8", "3", 50, 0, 0, true},
+		{"abc", "last", 50, 0, 0, true},
+		{"0", "xyz", 50, 0, 0, true},
+	}
+	for _, test := range tests {
+		begInt, endInt, err := listRange(test.beg, test.end, test.maxID)
+		if test.isErr {
+			if err == nil {
+				t.Errorf("listRange(%s,%s,%d) did not return an error", test.beg, test.end, test.maxID)
+			}
+			continue
+		}
+		if err != nil || begInt != test.begInt || endInt != test.endInt {
+			t.Errorf("listRange(%s,%s,%d) = %d, %d, %v, expected %d, %d", test.beg, test.end, test.maxID, begInt, endInt, err, test.begInt, test.endInt)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package storage
+
+// Copyright (C) Philip Schlump 2018-2019.
+
+import (
+	"context"
+	"time"
+)
+
+// Lock stops the URL of ID from being changed.  This is for codes that have
+// been printed, a change has to be a deliberate Unlock first.  The actor from
+// the context and the time are saved with the lock.  Locking a locked code
+// leaves the original lock in place.
+func (a *V1Adapter) Lock(ctx context.Context, ID string) error {
+	return a.setLock(ctx, ID, true)
+}
+
+// Unlock allows the URL of ID to be changed again.
+func (a *V1Adapter) Unlock(ctx context.Context, ID string) error {
+	return a.setLock(ctx, ID, false)
+}
+
+func (a *V1Adapter) setLock(ctx context.Context, ID string, locked bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := ValidID(ID); err != nil {
+		return err
+	}
+	return a.updateInfo(ID, func(ci *CodeInfo) error {
+		switch {
+		case locked && !ci.Locked:
+			now := time.Now()
+			ci.Locked, ci.LockedBy, ci.LockedAt = true, ActorFrom(ctx), &now
+		case !locked:
+			ci.Locked, ci.LockedBy, ci.LockedAt = false, "", nil
+		}
+		return nil
+	})
+}
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLock(t *testing.T) {
+	data, _ := NewMemoryStore(true, os.Stderr)
+	ds := AdaptV1(data)
+	ctx := WithActor(context.Background(), "bob")
+
+	id, _ := ds.Insert(ctx, "http://example.com/a")
+	if err := ds.Lock(ctx, id); err != nil {
+		t.Fatalf("Lock: %s", err)
+	}
+	ci, _ := ds.FetchInfo(ctx, id)
+	if !ci.Locked || ci.LockedBy != "bob" || ci.LockedAt == nil {
+		t.Errorf("after Lock CodeMeta = %+v", ci.CodeMeta)
+	}
+
+	if _, err := ds.Update(ctx, "http://example.com/b", id); !errors.Is(err, ErrLocked) || !errors.Is(err, ErrConflict) {
+		t.Errorf("Update of a locked code error = %v, expected ErrLocked", err)
+	}
+	ur, err := ds.UpdateInsert(ctx, "http://example.com/b", id)
+	if !errors.Is(err, ErrLocked) || !strings.HasPrefix(ur.Msg, "fail:") || !strings.Contains(ur.Msg, "locked") {
+		t.Errorf("UpdateInsert of a locked code = %+v, %v, expected a fail: locked message", ur, err)
+	}
+	if _, err := ds.Rollback(ctx, id, 1); !errors.Is(err, ErrLocked) {
+		t.Errorf("Rollback of a locked code error = %v, expected ErrLocked", err)
+	}
+	if URL, _ := data.FetchRaw(id); URL != "http://example.com/a" {
+		t.Errorf("locked code changed to %q", URL)
+	}
+	if hist, _ := ds.History(ctx, id); len(hist) != 1 {
+		t.Errorf("refused changes are in the history: %+v", hist)
+	}
+
+	if err := ds.Lock(WithActor(ctx, "sue"), id); err != nil {
+		t.Fatalf("second Lock: %s", err)
+	}
+	if ci, _ := ds.FetchInfo(ctx, id); ci.LockedBy != "bob" {
+		t.Errorf("second Lock changed LockedBy to %q", ci.LockedBy)
+	}
+
+	if err := ds.Unlock(ctx, id); err != nil {
+		t.Fatalf("Unlock: %s", err)
+	}
+	if _, err := ds.Update(ctx, "http://example.com/b", id); err != nil {
+		t.Errorf("Update after Unlock: %s", err)
+	}
+	if ci, _ := ds.FetchInfo(ctx, id); ci.Locked || ci.LockedBy != "" || ci.LockedAt != nil {
+		t.Errorf("after Unlock CodeMeta = %+v", ci.CodeMeta)
+	}
+
+	if err := ds.Lock(ctx, "zzzz"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Lock of a code that does not exist error = %v, expected ErrNotFound", err)
+	}
+}
@@ -0,0 +1,216 @@
+package storage
+
+// Copyright (C) Philip Schlump 2018-2019.
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/pschlump/godebug"
+)
+
+// MemoryStore implements PersistentData in memory.  Nothing is saved when the
+// server exits, this is for tests and for trying out the server.  It is safe
+// for use from multiple goroutines.
+type MemoryStore struct {
+	Log       *os.File
+	CountHits bool
+	lock      sync.Mutex
+	seq       int64
+	urls      map[string]string
+	counts    map[string]int
+	infos     map[string]string
+}
+
+// NewMemoryStore creates an empty in memory store.
+func NewMemoryStore(countHits bool, log *os.File) (rv PersistentData, err error) {
+	return &MemoryStore{
+		Log:       log,
+		CountHits: countHits,
+		seq:       1, // Same starting point as Redis "qr!seq".
+		urls:      make(map[string]string),
+		counts:    make(map[string]int),
+		infos:     make(map[string]string),
+	}, nil
+}
+
+// NextID returns the next higher integer that will be used to lookup the URL.  It is in base 36.
+func (ms *MemoryStore) NextID() string {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.seq++
+	return strconv.FormatUint(uint64(ms.seq), 36) // Base 36
+}
+
+// Seq returns the current value of the sequence.
+func (ms *MemoryStore) Seq() (int64, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	return ms.seq, nil
+}
+
+// SetSeq moves the sequence up to n if it is less than n.
+func (ms *MemoryStore) SetSeq(n int64) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if n > ms.seq {
+		ms.seq = n
+	}
+	return nil
+}
+
+// SetCount sets the hit count for ID.
+func (ms *MemoryStore) SetCount(ID string, n int) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if _, found := ms.urls[ID]; !found {
+		return ErrNotFound
+	}
+	ms.counts[ID] = n
+	return nil
+}
+
+// FetchInfo returns the metadata for ID.
+func (ms *MemoryStore) FetchInfo(ID string) (string, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if _, found := ms.urls[ID]; !found {
+		return "", ErrNotFound
+	}
+	return ms.infos[ID], nil
+}
+
+// SetInfo saves the metadata for ID.
+func (ms *MemoryStore) SetInfo(ID string, info string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if _, found := ms.urls[ID]; !found {
+		return ErrNotFound
+	}
+	ms.infos[ID] = info
+	return nil
+}
+
+// Insert saves `urlStr` under a newly allocated ID.
+func (ms *MemoryStore) Insert(urlStr string) (string, error) {
+	code := ms.NextID()
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.urls[code] = urlStr
+	ms.counts[code] = 0
+	return code, nil
+}
+
+// Update an existing key
+func (ms *MemoryStore) Update(urlStr, code string) (string, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.urls[code] = urlStr
+	return code, nil
+}
+
+// Exists returns true if the ID exists.
+func (ms *MemoryStore) Exists(ID string) bool {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	_, found := ms.urls[ID]
+	return found
+}
+
+// Fetch converts from a `code` into a `url` to be returned.
+func (ms *MemoryStore) Fetch(code string) (string, error) {
+	return ms.fetch(code)
+}
+
+// FetchRaw converts from a `code` into a `url` to be returned.
+func (ms *MemoryStore) FetchRaw(code string) (string, error) {
+	return ms.fetch(code)
+}
+
+// fetch gets the URL and if counting hits increments the count.
+func (ms *MemoryStore) fetch(code string) (string, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	urlStr, found := ms.urls[code]
+	if !found {
+		return "", ErrNotFound
+	}
+	if ms.CountHits {
+		ms.counts[code]++
+	}
+	return urlStr, nil
+}
+
+// List returns a list of all the redirects between beg and end, where beg
+// can be 0 to start at the beginning and end can be 'last' | '*' | 'latest'
+// to to go the most recent item.  This has the same limits as RedisStore.List,
+// at most 1000 are returned in a single call.
+func (ms *MemoryStore) List(beg, end string) (dat []ListData, err error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	begInt, endInt, err := listRange(beg, end, ms.seq)
+	if err != nil {
+		fmt.Fprintf(ms.Log, "Error: %s, %s\n", err, godebug.LF())
+		return
+	}
+	dataRange := endInt - begInt + 1
+	if dataRange > 1000 {
+		dataRange = 1000
+	}
+	dat = make([]ListData, 0, dataRange)
+	jj := 0
+	for ii := begInt; ii < endInt && jj < 1000; ii++ {
+		jj++
+		key := strconv.FormatUint(uint64(ii), 36) // Base 36
+		urlStr, found := ms.urls[key]
+		if !found {
+			continue
+		}
+		nUse := 0
+		if ms.CountHits {
+			nUse = ms.counts[key]
+		}
+		dat = append(dat, ListData{
+			ID:    fmt.Sprintf("%d", ii),
+			URL:   urlStr,
+			Count: nUse,
+		})
+	}
+	return
+}
+
+// UpdateInsert performs an update for existing IDs and an insert on new ids.
+// The sequence is moved to max(cur,1+id) the same as RedisStore.
+func (ms *MemoryStore) UpdateInsert(URL string, ID string) (ur UpdateRespItem) {
+	ur.ID = ID
+	IDint, err := strconv.ParseInt(ID, 36, 64) // Base 36, Parse the int into a number
+	if err != nil {
+		ur.Msg = fmt.Sprintf("fail:%s", err)
+		return
+	}
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if IDint >= ms.seq {
+		ms.seq = IDint + 1
+	}
+	if _, found := ms.urls[ID]; found {
+		ur.Msg = "success/update"
+	} else {
+		ms.counts[ID] = 0
+		ur.Msg = "success/insert"
+	}
+	ms.urls[ID] = URL
+	return
+}
+
+// Close does nothing, the data is kept so the store can still be used.
+func (ms *MemoryStore) Close() error {
+	return nil
+}
+
+// IncrementRedirectCount is a no-op, the count is incremented by Fetch
+// the same as with Redis.
+func (ms *MemoryStore) IncrementRedirectCount(id string) {
+}
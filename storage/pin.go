@@ -0,0 +1,43 @@
+package storage
+
+// Copyright (C) Philip Schlump 2018-2019.
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MinPinLength is the shortest PIN or password SetPin takes.
+const MinPinLength = 4
+
+// SetPin sets the PIN or password that a scanner has to enter before ID
+// redirects.  Only the bcrypt hash is saved.  A pin of "" removes it.
+func (a *V1Adapter) SetPin(ctx context.Context, ID string, pin string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := ValidID(ID); err != nil {
+		return err
+	}
+	var hash []byte
+	if pin != "" {
+		if len(pin) < MinPinLength {
+			return fmt.Errorf("%w: the PIN must be at least %d characters", ErrInvalidRange, MinPinLength)
+		}
+		var err error
+		if hash, err = bcrypt.GenerateFromPassword([]byte(pin), bcrypt.DefaultCost); err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidRange, err) // longer than 72 bytes
+		}
+	}
+	return a.updateInfo(ID, func(ci *CodeInfo) error {
+		ci.PinHash = string(hash)
+		return nil
+	})
+}
+
+// CheckPin returns true if pin is the PIN for the code.
+func (ci CodeInfo) CheckPin(pin string) bool {
+	return ci.PinHash != "" && bcrypt.CompareHashAndPassword([]byte(ci.PinHash), []byte(pin)) == nil
+}
@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPin(t *testing.T) {
+	data, _ := NewMemoryStore(true, os.Stderr)
+	ds := AdaptV1(data)
+	ctx := context.Background()
+
+	id, _ := ds.Insert(ctx, "http://example.com/a")
+	if err := ds.SetPin(ctx, id, "123"); !errors.Is(err, ErrInvalidRange) {
+		t.Errorf("SetPin of a short PIN error = %v, expected ErrInvalidRange", err)
+	}
+	if err := ds.SetPin(ctx, id, "1234"); err != nil {
+		t.Fatalf("SetPin: %s", err)
+	}
+	ci, _ := ds.FetchInfo(ctx, id)
+	if ci.PinHash == "" || strings.Contains(ci.PinHash, "1234") {
+		t.Errorf("PinHash = %q, expected a bcrypt hash", ci.PinHash)
+	}
+	if !ci.CheckPin("1234") || ci.CheckPin("4321") || ci.CheckPin("") {
+		t.Errorf("CheckPin does not match only 1234")
+	}
+	ld, _ := ds.List(ctx, "0", "100")
+	if len(ld) != 1 || !ld[0].Protected {
+		t.Errorf("List = %+v, expected Protected", ld)
+	}
+
+	// The URL is not changed, Resolve still finds it for the unlock.
+	if res, err := ds.Resolve(ctx, id, ResolveRequest{}); err != nil || res.URL != "http://example.com/a" || res.Info.PinHash == "" {
+		t.Errorf("Resolve = %+v, %v", res, err)
+	}
+
+	if err := ds.SetPin(ctx, id, ""); err != nil {
+		t.Fatalf("SetPin remove: %s", err)
+	}
+	if ci, _ = ds.FetchInfo(ctx, id); ci.PinHash != "" || ci.CheckPin("") {
+		t.Errorf("after remove PinHash = %q", ci.PinHash)
+	}
+	if err := ds.SetPin(ctx, "zzzz", "1234"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SetPin of a code that does not exist error = %v, expected ErrNotFound", err)
+	}
+}
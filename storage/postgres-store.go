@@ -0,0 +1,405 @@
+package storage
+
+// Copyright (C) Philip Schlump 2018-2019.
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pschlump/MiscLib"
+	"github.com/pschlump/godebug"
+
+	_ "github.com/lib/pq" // PostgreSQL driver for database/sql
+)
+
+// PostgresStore implements PersistentData with PostgreSQL as the database.
+// Like Redis this will support concurrent servers on multiple machines.
+//
+// The ID is kept in the table as an integer, it is converted to/from base 36
+// on the way in and out so that the codes are the same as with Redis.
+type PostgresStore struct {
+	ConnStr   string
+	Log       *os.File
+	CountHits bool
+	db        *sql.DB
+	readOnly  bool
+}
+
+// pgMigrations is the list of schema changes.  They are applied in order at
+// startup and the version number (index+1) is recorded in qr_schema_version.
+// Never edit a migration that has been released, add a new one to the end.
+var pgMigrations = []string{
+	// 1 - initial schema, the sequence starts at the same place as Redis "qr!seq".
+	`CREATE SEQUENCE IF NOT EXISTS qr_seq START 1;
+	SELECT setval('qr_seq', 1, true);
+	CREATE TABLE IF NOT EXISTS qr_code (
+		id		bigint primary key,
+		url		text not null,
+		hits	bigint not null default 0,
+		created	timestamp with time zone not null default now(),
+		updated	timestamp with time zone not null default now()
+	)`,
+	// 2 - metadata for each code, JSON kept as text, see CodeInfo.
+	`ALTER TABLE qr_code ADD COLUMN IF NOT EXISTS info text not null default ''`,
+}
+
+// pgSeqLock is the advisory lock key held while qr_seq is changed.  Sequences are
+// not transactional so "read last_value then setval" has to be serialized against
+// nextval or a concurrent insert can move the sequence backwards.
+const pgSeqLock int64 = 0x71725f736571 // "qr_seq"
+
+// NewPostgresStore connects to PostgreSQL and brings the schema up to date.
+func NewPostgresStore(connStr string, countHits bool, log *os.File) (rv PersistentData, err error) {
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to PostgreSQL: %s", err)
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to connect to PostgreSQL: %s", err)
+	}
+	ps := &PostgresStore{
+		ConnStr:   connStr,
+		Log:       log,
+		CountHits: countHits,
+		db:        db,
+	}
+	if err = ps.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to migrate PostgreSQL schema: %s", err)
+	}
+	return ps, nil
+}
+
+// NewPostgresStoreReadOnly connects to PostgreSQL without applying migrations.
+// Nothing is written, hits are not counted but are returned by List.
+func NewPostgresStoreReadOnly(connStr string, log *os.File) (rv PersistentData, err error) {
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to PostgreSQL: %s", err)
+	}
+	var found bool
+	if err = db.QueryRow(`SELECT to_regclass('qr_code') IS NOT NULL`).Scan(&found); err == nil && !found {
+		err = fmt.Errorf("table qr_code does not exist")
+	}
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to connect to PostgreSQL: %s", err)
+	}
+	return &PostgresStore{
+		ConnStr:   connStr,
+		Log:       log,
+		CountHits: true,
+		db:        db,
+		readOnly:  true,
+	}, nil
+}
+
+// migrate applies any migrations that have not been run yet.  The version table
+// is locked so that if multiple servers start at once only one will do the work.
+func (ps *PostgresStore) migrate() error {
+	_, err := ps.db.Exec(`CREATE TABLE IF NOT EXISTS qr_schema_version (
+		version	int primary key,
+		applied	timestamp with time zone not null default now()
+	)`)
+	if err != nil {
+		return err
+	}
+
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(`LOCK TABLE qr_schema_version IN EXCLUSIVE MODE`); err != nil {
+		return err
+	}
+	var cur int
+	if err = tx.QueryRow(`SELECT coalesce(max(version), 0) FROM qr_schema_version`).Scan(&cur); err != nil {
+		return err
+	}
+	for ii := cur; ii < len(pgMigrations); ii++ {
+		if db6 {
+			fmt.Printf("%sApply PostgreSQL migration %d%s\n", MiscLib.ColorCyan, ii+1, MiscLib.ColorReset)
+		}
+		if _, err = tx.Exec(pgMigrations[ii]); err != nil {
+			return fmt.Errorf("migration %d: %s", ii+1, err)
+		}
+		if _, err = tx.Exec(`INSERT INTO qr_schema_version ( version ) VALUES ( $1 )`, ii+1); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// withSeqLock runs fn in a transaction that holds the pgSeqLock advisory lock.
+func (ps *PostgresStore) withSeqLock(fn func(tx *sql.Tx) error) error {
+	if ps.readOnly {
+		return ErrReadOnly
+	}
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec(`SELECT pg_advisory_xact_lock($1)`, pgSeqLock); err != nil {
+		return err
+	}
+	if err = fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// raiseSeq moves qr_seq up to n if it is less than n.  It must be called with pgSeqLock held.
+func raiseSeq(tx *sql.Tx, n int64) error {
+	_, err := tx.Exec(`SELECT setval('qr_seq', $1) FROM qr_seq WHERE last_value < $1`, n)
+	return err
+}
+
+// NextID returns the next higher integer that will be used to lookup the URL.  It is in base 36.
+func (ps *PostgresStore) NextID() string {
+	var nn int64
+	err := ps.withSeqLock(func(tx *sql.Tx) error {
+		return tx.QueryRow(`SELECT nextval('qr_seq')`).Scan(&nn)
+	})
+	if err != nil {
+		fmt.Fprintf(ps.Log, "Error: %s, %s\n", err, godebug.LF())
+		return ""
+	}
+	return strconv.FormatUint(uint64(nn), 36) // Base 36
+}
+
+// getID returns the current sequence value in integer format.
+func (ps *PostgresStore) getID() int64 {
+	var nn int64
+	err := ps.db.QueryRow(`SELECT last_value FROM qr_seq`).Scan(&nn)
+	if err != nil {
+		fmt.Fprintf(ps.Log, "Error: %s, %s\n", err, godebug.LF())
+		return 0
+	}
+	return nn
+}
+
+// Seq returns the current value of the sequence.
+func (ps *PostgresStore) Seq() (nn int64, err error) {
+	err = ps.db.QueryRow(`SELECT last_value FROM qr_seq`).Scan(&nn)
+	return
+}
+
+// SetSeq moves the sequence up to n if it is less than n.
+func (ps *PostgresStore) SetSeq(n int64) error {
+	return ps.withSeqLock(func(tx *sql.Tx) error {
+		return raiseSeq(tx, n)
+	})
+}
+
+// SetCount sets the hit count for ID.
+func (ps *PostgresStore) SetCount(ID string, n int) error {
+	if ps.readOnly {
+		return ErrReadOnly
+	}
+	id, err := strconv.ParseInt(ID, 36, 64) // Base 36
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidID, err)
+	}
+	res, err := ps.db.Exec(`UPDATE qr_code SET hits = $2 WHERE id = $1`, id, n)
+	if err != nil {
+		return err
+	}
+	if nr, _ := res.RowsAffected(); nr == 0 {
+		return fmt.Errorf("%w: %s", ErrNotFound, ID)
+	}
+	return nil
+}
+
+// FetchInfo returns the metadata for ID.
+func (ps *PostgresStore) FetchInfo(ID string) (info string, err error) {
+	id, err := strconv.ParseInt(ID, 36, 64) // Base 36
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidID, err)
+	}
+	err = ps.db.QueryRow(`SELECT info FROM qr_code WHERE id = $1`, id).Scan(&info)
+	if err == sql.ErrNoRows {
+		err = fmt.Errorf("%w: %s", ErrNotFound, ID)
+	}
+	return
+}
+
+// SetInfo saves the metadata for ID.
+func (ps *PostgresStore) SetInfo(ID string, info string) error {
+	if ps.readOnly {
+		return ErrReadOnly
+	}
+	id, err := strconv.ParseInt(ID, 36, 64) // Base 36
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidID, err)
+	}
+	res, err := ps.db.Exec(`UPDATE qr_code SET info = $2 WHERE id = $1`, id, info)
+	if err != nil {
+		return err
+	}
+	if nr, _ := res.RowsAffected(); nr == 0 {
+		return fmt.Errorf("%w: %s", ErrNotFound, ID)
+	}
+	return nil
+}
+
+// Insert saves `urlStr` under a newly allocated ID.
+func (ps *PostgresStore) Insert(urlStr string) (string, error) {
+	code := ps.NextID()
+	if code == "" {
+		return "", fmt.Errorf("unable to allocate a new ID")
+	}
+	id, _ := strconv.ParseInt(code, 36, 64)
+	_, err := ps.db.Exec(`INSERT INTO qr_code ( id, url ) VALUES ( $1, $2 )`, id, urlStr)
+	if err != nil {
+		fmt.Fprintf(ps.Log, "Error: unable to insert: %s, %s\n", err, godebug.LF())
+		return code, err
+	}
+	return code, nil
+}
+
+// Update an existing key.  Like Redis if the key does not exist it is created.
+func (ps *PostgresStore) Update(urlStr, code string) (ID string, err error) {
+	if _, err = strconv.ParseInt(code, 36, 64); err != nil { // Base 36
+		return code, fmt.Errorf("%w: %s", ErrInvalidID, err)
+	}
+	ur := ps.UpdateInsert(urlStr, code)
+	if strings.HasPrefix(ur.Msg, "fail:") {
+		fmt.Fprintf(ps.Log, "Error: unable to update: %s, %s\n", ur.Msg, godebug.LF())
+		return code, fmt.Errorf("%s", ur.Msg[len("fail:"):])
+	}
+	return code, nil
+}
+
+// Exists returns true if the ID exists in the database
+func (ps *PostgresStore) Exists(ID string) (rv bool) {
+	id, err := strconv.ParseInt(ID, 36, 64) // Base 36
+	if err == nil {
+		err = ps.db.QueryRow(`SELECT EXISTS ( SELECT 1 FROM qr_code WHERE id = $1 )`, id).Scan(&rv)
+		if err != nil {
+			fmt.Fprintf(ps.Log, "Error: %s, %s\n", err, godebug.LF())
+		}
+	}
+	if db5 {
+		fmt.Printf("%sExists(%s) = %v%s\n", MiscLib.ColorCyan, ID, rv, MiscLib.ColorReset)
+	}
+	return
+}
+
+// Fetch converts from a `code` into a `url` to be returned.
+func (ps *PostgresStore) Fetch(code string) (string, error) {
+	return ps.fetch(code)
+}
+
+// FetchRaw converts from a `code` into a `url` to be returned.
+func (ps *PostgresStore) FetchRaw(code string) (string, error) {
+	return ps.fetch(code)
+}
+
+// fetch looks up the URL, if counting then the hit count is incremented in the same statement.
+func (ps *PostgresStore) fetch(code string) (urlStr string, err error) {
+	id, err := strconv.ParseInt(code, 36, 64) // Base 36
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidID, err)
+	}
+	if ps.CountHits && !ps.readOnly {
+		err = ps.db.QueryRow(`UPDATE qr_code SET hits = hits + 1 WHERE id = $1 RETURNING url`, id).Scan(&urlStr)
+	} else {
+		err = ps.db.QueryRow(`SELECT url FROM qr_code WHERE id = $1`, id).Scan(&urlStr)
+	}
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return
+}
+
+// List returns a list of all the redirects between beg and end, where beg
+// can be 0 to start at the beginning and end can be 'last' | '*' | 'latest'
+// to to go the most recent item.  This has the same limits as RedisStore.List,
+// at most 1000 are returned in a single call.
+func (ps *PostgresStore) List(beg, end string) (dat []ListData, err error) {
+	begInt, endInt, err := listRange(beg, end, ps.getID())
+	if err != nil {
+		fmt.Fprintf(ps.Log, "Error: %s, %s\n", err, godebug.LF())
+		return
+	}
+
+	rows, err := ps.db.Query(`SELECT id, url, hits FROM qr_code WHERE id >= $1 AND id < $2 ORDER BY id LIMIT 1000`, begInt, endInt)
+	if err != nil {
+		fmt.Fprintf(ps.Log, "Error: %s, %s\n", err, godebug.LF())
+		return
+	}
+	defer rows.Close()
+
+	dat = make([]ListData, 0, 100)
+	for rows.Next() {
+		var id int64
+		var ld ListData
+		if err = rows.Scan(&id, &ld.URL, &ld.Count); err != nil {
+			fmt.Fprintf(ps.Log, "Error: %s, %s\n", err, godebug.LF())
+			return
+		}
+		ld.ID = fmt.Sprintf("%d", id)
+		if !ps.CountHits {
+			ld.Count = 0
+		}
+		dat = append(dat, ld)
+	}
+	err = rows.Err()
+	if db4 {
+		fmt.Printf("dat=%s AT: %s\n", godebug.SVarI(dat), godebug.LF())
+	}
+	return
+}
+
+// UpdateInsert performs an update for existing IDs and an insert on new ids.
+// The sequence is moved to max(cur,1+id) so that NextID will not hand out an ID
+// that was loaded in bulk.
+func (ps *PostgresStore) UpdateInsert(URL string, ID string) (ur UpdateRespItem) {
+	ur.ID = ID
+
+	IDint, err := strconv.ParseInt(ID, 36, 64) // Base 36, Parse the int into a number
+	if err != nil {
+		ur.Msg = fmt.Sprintf("fail:%s", err)
+		return
+	}
+
+	found := false
+	err = ps.withSeqLock(func(tx *sql.Tx) error {
+		if err := raiseSeq(tx, IDint+1); err != nil {
+			return err
+		}
+		err := tx.QueryRow(`SELECT EXISTS ( SELECT 1 FROM qr_code WHERE id = $1 )`, IDint).Scan(&found)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO qr_code ( id, url ) VALUES ( $1, $2 )
+			ON CONFLICT ( id ) DO UPDATE SET url = EXCLUDED.url, updated = now()`, IDint, URL)
+		return err
+	})
+
+	if err != nil {
+		ur.Msg = fmt.Sprintf("fail:%s", err)
+	} else if found {
+		ur.Msg = "success/update"
+	} else {
+		ur.Msg = "success/insert"
+	}
+	return
+}
+
+// Close closes the connections to the database.
+func (ps *PostgresStore) Close() error {
+	return ps.db.Close()
+}
+
+// IncrementRedirectCount is a no-op, the count is incremented by Fetch
+// the same as with Redis.
+func (ps *PostgresStore) IncrementRedirectCount(id string) {
+}
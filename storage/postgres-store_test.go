@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"database/sql"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// newTestPostgresStore connects to the database in $QR_SHORT_TEST_PG, the test is
+// skipped if it is not set.  This must be a scratch database, the qr-short tables
+// are dropped first.
+//
+//	QR_SHORT_TEST_PG="postgres://postgres@localhost/qr_test?sslmode=disable" go test ./storage/
+func newTestPostgresStore(t *testing.T) *PostgresStore {
+	connStr := os.Getenv("QR_SHORT_TEST_PG")
+	if connStr == "" {
+		t.Skip("QR_SHORT_TEST_PG is not set")
+	}
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatalf("sql.Open: %s", err)
+	}
+	_, err = db.Exec(`DROP TABLE IF EXISTS qr_code, qr_schema_version; DROP SEQUENCE IF EXISTS qr_seq`)
+	db.Close()
+	if err != nil {
+		t.Fatalf("unable to reset the test database: %s", err)
+	}
+	data, err := NewPostgresStore(connStr, true, os.Stderr)
+	if err != nil {
+		t.Fatalf("NewPostgresStore: %s", err)
+	}
+	ps := data.(*PostgresStore)
+	t.Cleanup(func() { ps.Close() })
+	return ps
+}
+
+// TestPostgresSeqRace loads old IDs in bulk while new IDs are allocated, the
+// sequence must never move backwards and no ID can be handed out twice.
+func TestPostgresSeqRace(t *testing.T) {
+	ps := newTestPostgresStore(t)
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	seen := make(map[string]bool)
+	for ww := 0; ww < 4; ww++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for ii := 0; ii < 50; ii++ {
+				id, err := ps.Insert("http://example.com/new")
+				if err != nil {
+					t.Errorf("Insert: %s", err)
+					return
+				}
+				lock.Lock()
+				if seen[id] {
+					t.Errorf("Insert returned %s twice", id)
+				}
+				seen[id] = true
+				lock.Unlock()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for ii := 0; ii < 50; ii++ {
+				ur := ps.UpdateInsert("http://example.com/old", strconv.FormatInt(int64(ii%3)+2, 36))
+				if len(ur.Msg) >= 5 && ur.Msg[:5] == "fail:" {
+					t.Errorf("UpdateInsert: %s", ur.Msg)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestPostgresUpdateCreates(t *testing.T) {
+	ps := newTestPostgresStore(t)
+
+	if _, err := ps.Update("http://example.com/a", "zz"); err != nil {
+		t.Fatalf("Update on a new ID: %s", err)
+	}
+	if got, err := ps.Fetch("zz"); err != nil || got != "http://example.com/a" {
+		t.Errorf("Fetch(zz) = %q, %v", got, err)
+	}
+	zz, _ := strconv.ParseInt("zz", 36, 64)
+	if seq, _ := ps.Seq(); seq <= zz {
+		t.Errorf("Seq() = %d after Update(zz), must be > %d", seq, zz)
+	}
+}
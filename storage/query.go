@@ -0,0 +1,78 @@
+package storage
+
+// Copyright (C) Philip Schlump 2018-2019.
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// QueryPolicy values, what a redirect does with the query string of the scan.
+const (
+	QueryAppend   = "append"   // add the parameters after the ones in the URL, the default
+	QueryOverride = "override" // a parameter replaces the one in the URL with the same key
+	QueryDrop     = "drop"     // the query string is not passed on
+	QueryAllow    = "allow"    // only the QueryAllow keys are passed on, as override
+)
+
+func validQueryPolicy(policy string) bool {
+	switch policy {
+	case "", QueryAppend, QueryOverride, QueryDrop, QueryAllow:
+		return true
+	}
+	return false
+}
+
+// MergeQuery returns URL with the scan parameters qry merged in by the
+// QueryPolicy.  The #fragment stays at the end.  If nothing is added URL is
+// returned as is.
+func (cm CodeMeta) MergeQuery(URL string, qry url.Values) (string, error) {
+	if cm.QueryPolicy == QueryAllow {
+		allowed := make(url.Values)
+		for _, key := range cm.QueryAllow {
+			if vv, ok := qry[key]; ok {
+				allowed[key] = vv
+			}
+		}
+		qry = allowed
+	}
+	if len(qry) == 0 || cm.QueryPolicy == QueryDrop {
+		return URL, nil
+	}
+	uu, err := url.Parse(URL)
+	if err != nil {
+		return URL, fmt.Errorf("URL %q: %s", URL, err)
+	}
+	switch cm.QueryPolicy {
+	case "", QueryAppend:
+		if uu.RawQuery != "" {
+			uu.RawQuery += "&"
+		}
+		uu.RawQuery += qry.Encode()
+	default: // QueryOverride, QueryAllow
+		setQuery(uu, qry)
+	}
+	return uu.String(), nil
+}
+
+// SetQuery returns URL with the parameters in qry set, they replace the ones
+// with the same key.  The #fragment stays at the end.
+func SetQuery(URL string, qry url.Values) (string, error) {
+	if len(qry) == 0 {
+		return URL, nil
+	}
+	uu, err := url.Parse(URL)
+	if err != nil {
+		return URL, fmt.Errorf("URL %q: %s", URL, err)
+	}
+	setQuery(uu, qry)
+	return uu.String(), nil
+}
+
+func setQuery(uu *url.URL, qry url.Values) {
+	vals := uu.Query()
+	for key, vv := range qry {
+		vals[key] = vv
+	}
+	uu.RawQuery = vals.Encode()
+}
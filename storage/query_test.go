@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+)
+
+func TestMergeQuery(t *testing.T) {
+	qry := url.Values{"a": {"9"}, "c": {"3"}}
+	tests := []struct {
+		policy string
+		allow  []string
+		URL    string
+		qry    url.Values
+		want   string
+	}{
+		{"", nil, "http://example.com/p?a=1&b=2", qry, "http://example.com/p?a=1&b=2&a=9&c=3"},
+		{QueryAppend, nil, "http://example.com/p#top", qry, "http://example.com/p?a=9&c=3#top"},
+		{QueryOverride, nil, "http://example.com/p?a=1&b=2#top", qry, "http://example.com/p?a=9&b=2&c=3#top"},
+		{QueryDrop, nil, "http://example.com/p?a=1#top", qry, "http://example.com/p?a=1#top"},
+		{QueryAllow, []string{"c"}, "http://example.com/p?a=1#top", qry, "http://example.com/p?a=1&c=3#top"},
+		{QueryAllow, []string{"x"}, "http://example.com/p?b=%2f#top", qry, "http://example.com/p?b=%2f#top"},
+		{QueryOverride, nil, "http://example.com/p?b=%2f", nil, "http://example.com/p?b=%2f"},
+	}
+	for ii, test := range tests {
+		cm := CodeMeta{QueryPolicy: test.policy, QueryAllow: test.allow}
+		if got, err := cm.MergeQuery(test.URL, test.qry); err != nil || got != test.want {
+			t.Errorf("%d: %s MergeQuery(%q) = %q, %v, expected %q", ii, test.policy, test.URL, got, err, test.want)
+		}
+	}
+}
+
+func TestSetMetaQueryPolicy(t *testing.T) {
+	ds := newTestAdapter(t)
+	ctx := context.Background()
+
+	id, _ := ds.Insert(ctx, "http://example.com/a")
+	if err := ds.SetMeta(ctx, id, CodeMeta{QueryPolicy: "merge"}); !errors.Is(err, ErrInvalidRange) {
+		t.Errorf("SetMeta query policy merge error = %v, expected ErrInvalidRange", err)
+	}
+	if err := ds.SetMeta(ctx, id, CodeMeta{QueryPolicy: QueryAllow}); !errors.Is(err, ErrInvalidRange) {
+		t.Errorf("SetMeta allow with no keys error = %v, expected ErrInvalidRange", err)
+	}
+	if err := ds.SetMeta(ctx, id, CodeMeta{QueryPolicy: QueryAllow, QueryAllow: []string{"ref"}}); err != nil {
+		t.Fatalf("SetMeta: %s", err)
+	}
+	if ci, _ := ds.FetchInfo(ctx, id); ci.QueryPolicy != QueryAllow || len(ci.QueryAllow) != 1 {
+		t.Errorf("after SetMeta CodeMeta = %+v", ci.CodeMeta)
+	}
+	ds.SetMeta(ctx, id, CodeMeta{QueryPolicy: QueryAppend})
+	if ci, _ := ds.FetchInfo(ctx, id); ci.QueryPolicy != "" || ci.QueryAllow != nil {
+		t.Errorf("after append CodeMeta = %+v", ci.CodeMeta)
+	}
+}
+
+func TestSetQuery(t *testing.T) {
+	if got, _ := SetQuery("http://example.com/p?a=1&b=2#top", url.Values{"a": {"3"}}); got != "http://example.com/p?a=3&b=2#top" {
+		t.Errorf("SetQuery = %q", got)
+	}
+	if got, _ := SetQuery("http://example.com/p?b=%2f", nil); got != "http://example.com/p?b=%2f" {
+		t.Errorf("SetQuery with nothing = %q", got)
+	}
+	if _, err := SetQuery("http://[::1", url.Values{"a": {"3"}}); err == nil {
+		t.Errorf("SetQuery of a bad URL, expected an error")
+	}
+}
+
+func TestSetMetaTracking(t *testing.T) {
+	ds := newTestAdapter(t)
+	ctx := context.Background()
+
+	id, _ := ds.Insert(ctx, "http://example.com/a")
+	ds.SetMeta(ctx, id, CodeMeta{Campaign: "spring", Tracking: map[string]string{"utm_source": "qr", "utm_term": "x"}})
+	ds.SetMeta(ctx, id, CodeMeta{Tracking: map[string]string{"utm_term": ""}})
+	if ci, _ := ds.FetchInfo(ctx, id); ci.Campaign != "spring" || len(ci.Tracking) != 1 || ci.Tracking["utm_source"] != "qr" {
+		t.Errorf("after SetMeta CodeMeta = %+v", ci.CodeMeta)
+	}
+	ds.SetMeta(ctx, id, CodeMeta{Campaign: NoCampaign})
+	if ci, _ := ds.FetchInfo(ctx, id); ci.Campaign != "" {
+		t.Errorf("Campaign = %q after clear", ci.Campaign)
+	}
+}
@@ -6,14 +6,35 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/pschlump/MiscLib"
 	"github.com/pschlump/godebug"
+	"github.com/pschlump/radix.v2/cluster"
+	"github.com/pschlump/radix.v2/pool"
 	"github.com/pschlump/radix.v2/redis"
+	"github.com/pschlump/radix.v2/sentinel"
 )
 
 // RedisStore implements PersistentData storage with Redis as the database.
 // This will support concurrent servers on multiple machines.
+//
+// A redis.Client can not be shared between goroutines so all access is through
+// a pool of connections.  Each command gets a connection from the pool and puts
+// it back.  Connections that have a network error are closed, not put back, so
+// the next Get will dial a new one.
+//
+// If RedisOptions.SentinelAddr is set the master is found through Sentinel, if
+// RedisOptions.ClusterAddr is set then a Redis Cluster is used.  In cluster mode
+// the keys use a hash tag, "qr:{<ID>}", "qr^{<ID>}", "qr@{<ID>}" and "qr!{seq}", so that the keys
+// for a code are always in the same slot.  Existing data from a single server is
+// not found under the tagged keys, copy it to the cluster with
+//
+//	qr-short migrate --from redis://host:6379 --to 'redis://host:7000?cluster=host:7000'
+//
+// Call Close when done with the store to stop the health check and close the connections.
 type RedisStore struct {
 	Root        string
 	RedisHost   string
@@ -22,11 +43,37 @@ type RedisStore struct {
 	RedisPrefix string // defauilt "qr:<ID>" and "qr!seq"
 	Log         *os.File
 	CountHits   bool
-	redisConn   *redis.Client
+	Opts        RedisOptions
+	redisConn   redisCmder
+	redisPool   *pool.Pool       // set if not using Sentinel or Cluster, used by the health check
+	redisClust  *cluster.Cluster // set in cluster mode, used to send scripts to the node for the key
+	closeConn   func()           // closes the pool, cluster or sentinel connections
+	stop        chan struct{}
+	closeOnce   sync.Once
+}
+
+// redisCmder is the part of pool.Pool, cluster.Cluster and the sentinel wrapper
+// that is used by RedisStore.
+type redisCmder interface {
+	Cmd(cmd string, args ...interface{}) *redis.Resp
+}
+
+// RedisOptions are the connection pool settings for RedisStore.  Zero values
+// are replaced with the defaults.
+type RedisOptions struct {
+	PoolSize    int           // Number of connections kept in the pool, default 10
+	DialTimeout time.Duration // Timeout for connect and each read/write, default 5s
+	HealthCheck time.Duration // How often idle connections are checked with a PING, default 30s, < 0 to turn off, only used without Sentinel or Cluster
+
+	SentinelAddr   string // host:port of a Sentinel, if set the master is looked up through Sentinel
+	SentinelMaster string // name of the master in Sentinel, default "mymaster"
+	ClusterAddr    string // host:port of any node in a Redis Cluster, if set cluster mode is used
+
+	ReadOnly bool // only read, the sequence is not initialized, hits are not counted and changes are ErrReadOnly
 }
 
 // NewRedisStore creates a connection to Redis and initialized redis if necessary.
-func NewRedisStore(rHost, rPort, rAuth, rPrefix string, countHits bool, log *os.File) (rv PersistentData, err error) {
+func NewRedisStore(rHost, rPort, rAuth, rPrefix string, countHits bool, opts RedisOptions, log *os.File) (rv PersistentData, err error) {
 	if rHost == "" {
 		rHost = "127.0.0.1"
 	}
@@ -36,6 +83,15 @@ func NewRedisStore(rHost, rPort, rAuth, rPrefix string, countHits bool, log *os.
 	if rPrefix == "" {
 		rPrefix = "qr"
 	}
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = 10
+	}
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = 5 * time.Second
+	}
+	if opts.HealthCheck == 0 {
+		opts.HealthCheck = 30 * time.Second
+	}
 	rs := &RedisStore{
 		RedisHost:   rHost,
 		RedisPort:   rPort,
@@ -43,27 +99,209 @@ func NewRedisStore(rHost, rPort, rAuth, rPrefix string, countHits bool, log *os.
 		RedisPrefix: rPrefix,
 		Log:         log,
 		CountHits:   countHits,
+		Opts:        opts,
+		stop:        make(chan struct{}),
 	}
-	rc, err := ConnectToRedis(rs.RedisHost, rs.RedisPort, rs.RedisAuth)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to connect to redis: %s\n", err)
-		os.Exit(1)
+	if opts.SentinelAddr != "" && opts.ClusterAddr != "" {
+		return nil, fmt.Errorf("can not use both Sentinel and Cluster for redis")
+	}
+	if opts.SentinelAddr != "" {
+		if opts.SentinelMaster == "" {
+			opts.SentinelMaster = "mymaster"
+			rs.Opts.SentinelMaster = opts.SentinelMaster
+		}
+		sc, err := sentinel.NewClientCustom("tcp", opts.SentinelAddr, opts.PoolSize, rs.dial, opts.SentinelMaster)
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to redis sentinel %s: %s", opts.SentinelAddr, err)
+		}
+		rs.redisConn = &sentinelCmder{client: sc, master: opts.SentinelMaster}
+		rs.closeConn = sc.Close
+	} else if opts.ClusterAddr != "" {
+		cc, err := cluster.NewWithOpts(cluster.Opts{
+			Addr:     opts.ClusterAddr,
+			PoolSize: opts.PoolSize,
+			Timeout:  opts.DialTimeout,
+			Dialer:   rs.dial,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to redis cluster %s: %s", opts.ClusterAddr, err)
+		}
+		rs.redisConn = cc
+		rs.redisClust = cc
+		rs.closeConn = cc.Close
+	} else {
+		rs.redisPool, err = pool.NewCustom("tcp", rs.RedisHost+":"+rs.RedisPort, opts.PoolSize, rs.dial)
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to redis: %s", err)
+		}
+		rs.redisConn = rs.redisPool
+		rs.closeConn = rs.redisPool.Empty
 	}
-	rs.redisConn = rc
-	seq, err := rs.redisConn.Cmd("GET", rs.RedisPrefix+"!seq").Str()
-	if err != nil || seq == "" {
-		err := rs.redisConn.Cmd("SET", rs.RedisPrefix+"!seq", "1").Err
+	if opts.ReadOnly {
+		rs.redisConn = readOnlyCmder{rs.redisConn}
+		err = rs.redisConn.Cmd("GET", rs.seqKey()).Err
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Unable to initialize redis '%s!seq': %s\n", rs.RedisPrefix, err)
-			os.Exit(1)
+			rs.closeConn()
+			return nil, fmt.Errorf("unable to read redis '%s!seq': %s", rs.RedisPrefix, err)
 		}
+		return rs, nil
+	}
+	// SETNX so that multiple servers starting at once will not reset the sequence.
+	err = rs.redisConn.Cmd("SETNX", rs.seqKey(), "1").Err
+	if err != nil {
+		rs.closeConn()
+		return nil, fmt.Errorf("unable to initialize redis '%s!seq': %s", rs.RedisPrefix, err)
+	}
+	if opts.HealthCheck > 0 && rs.redisPool != nil {
+		go rs.healthCheck()
 	}
 	return rs, nil
 }
 
+// codeKey returns the key for the URL, "qr:<ID>".
+func (rs *RedisStore) codeKey(id string) string {
+	return rs.RedisPrefix + ":" + rs.hashTag(id)
+}
+
+// countKey returns the key for the hit count, "qr^<ID>".
+func (rs *RedisStore) countKey(id string) string {
+	return rs.RedisPrefix + "^" + rs.hashTag(id)
+}
+
+// infoKey returns the key for the metadata, "qr@<ID>".
+func (rs *RedisStore) infoKey(id string) string {
+	return rs.RedisPrefix + "@" + rs.hashTag(id)
+}
+
+// seqKey returns the key for the sequence, "qr!seq".
+func (rs *RedisStore) seqKey() string {
+	return rs.RedisPrefix + "!" + rs.hashTag("seq")
+}
+
+// hashTag wraps the ID in {} in cluster mode so that all the keys for a code
+// hash to the same slot.  Outside of a cluster the keys are left as they have
+// always been so existing data is still found.
+func (rs *RedisStore) hashTag(id string) string {
+	if rs.Opts.ClusterAddr != "" {
+		return "{" + id + "}"
+	}
+	return id
+}
+
+// evalScript runs a Lua script.  A cluster picks the node from the first
+// argument which for EVAL is the script, so in cluster mode the script is sent
+// to the node that has keys[0].  All keys must hash to the same slot.
+func (rs *RedisStore) evalScript(script string, keys []string, args ...interface{}) *redis.Resp {
+	if rs.Opts.ReadOnly {
+		return redis.NewResp(ErrReadOnly)
+	}
+	cmdArgs := make([]interface{}, 0, 2+len(keys)+len(args))
+	cmdArgs = append(cmdArgs, script, len(keys))
+	for _, key := range keys {
+		cmdArgs = append(cmdArgs, key)
+	}
+	cmdArgs = append(cmdArgs, args...)
+	if rs.redisClust == nil {
+		return rs.redisConn.Cmd("EVAL", cmdArgs...)
+	}
+	conn, err := rs.redisClust.GetForKey(keys[0])
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	defer rs.redisClust.Put(conn)
+	return conn.Cmd("EVAL", cmdArgs...)
+}
+
+// readOnlyCmder passes on the commands that only read and returns ErrReadOnly for the rest.
+type readOnlyCmder struct {
+	conn redisCmder
+}
+
+// Cmd runs cmd if it only reads.
+func (ro readOnlyCmder) Cmd(cmd string, args ...interface{}) *redis.Resp {
+	switch strings.ToUpper(cmd) {
+	case "GET", "MGET", "EXISTS", "LRANGE", "LLEN", "HGET", "HGETALL", "SMEMBERS", "PING":
+		return ro.conn.Cmd(cmd, args...)
+	}
+	return redis.NewResp(ErrReadOnly)
+}
+
+// sentinelCmder runs each command on the current master as reported by Sentinel.
+// The sentinel.Client keeps a pool for the master and switches it on fail over.
+type sentinelCmder struct {
+	client *sentinel.Client
+	master string
+}
+
+// Cmd gets a connection to the master, runs the command and returns the connection.
+func (sc *sentinelCmder) Cmd(cmd string, args ...interface{}) *redis.Resp {
+	conn, err := sc.client.GetMaster(sc.master)
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	defer sc.client.PutMaster(sc.master, conn)
+	return conn.Cmd(cmd, args...)
+}
+
+// dial is the pool.DialFunc used to create new connections, with a timeout and AUTH.
+func (rs *RedisStore) dial(network, addr string) (*redis.Client, error) {
+	client, err := redis.DialTimeout(network, addr, rs.Opts.DialTimeout)
+	if err != nil {
+		fmt.Fprintf(rs.Log, "Error: unable to connect to redis %s: %s, %s\n", addr, err, godebug.LF())
+		return nil, err
+	}
+	if rs.RedisAuth != "" {
+		if err = client.Cmd("AUTH", rs.RedisAuth).Err; err != nil {
+			client.Close()
+			fmt.Fprintf(rs.Log, "Error: failed to authorize to redis %s: %s, %s\n", addr, err, godebug.LF())
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// Close stops the health check and closes all the connections.
+func (rs *RedisStore) Close() error {
+	rs.closeOnce.Do(func() {
+		close(rs.stop)
+		rs.closeConn()
+	})
+	return nil
+}
+
+// healthCheck runs until Close checking the idle connections in the pool with a PING.
+// A connection that fails is closed so that it will be replaced with a new one
+// instead of failing a request.  This is only used for a single server, the
+// Sentinel and Cluster clients replace connections that fail on their own.
+func (rs *RedisStore) healthCheck() {
+	ticker := time.NewTicker(rs.Opts.HealthCheck)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rs.stop:
+			return
+		case <-ticker.C:
+		}
+		nIdle := rs.redisPool.Avail()
+		for ii := 0; ii < nIdle; ii++ {
+			client, err := rs.redisPool.Get()
+			if err != nil {
+				fmt.Fprintf(rs.Log, "Error: redis health check: %s, %s\n", err, godebug.LF())
+				break
+			}
+			if err = client.Cmd("PING").Err; err != nil {
+				fmt.Fprintf(rs.Log, "Warning: redis health check, dropping connection: %s, %s\n", err, godebug.LF())
+				client.Close()
+				continue
+			}
+			rs.redisPool.Put(client)
+		}
+	}
+}
+
 // NextID returns the next higher integer that will be used to lookup the URL.  It is in base 36.
 func (rs *RedisStore) NextID() string {
-	nn, err := rs.redisConn.Cmd("INCR", rs.RedisPrefix+"!seq").Int()
+	nn, err := rs.redisConn.Cmd("INCR", rs.seqKey()).Int()
 	if err != nil {
 		fmt.Fprintf(rs.Log, "Error: %s, %s\n", err, godebug.LF())
 		return ""
@@ -73,7 +311,7 @@ func (rs *RedisStore) NextID() string {
 
 // getID returns the current sequence value in integer format.
 func (rs *RedisStore) getID() int64 {
-	nn, err := rs.redisConn.Cmd("GET", rs.RedisPrefix+"!seq").Int64()
+	nn, err := rs.redisConn.Cmd("GET", rs.seqKey()).Int64()
 	if err != nil {
 		fmt.Fprintf(rs.Log, "Error: %s, %s\n", err, godebug.LF())
 		return 0
@@ -85,12 +323,21 @@ func (rs *RedisStore) getID() int64 {
 	return nn
 }
 
-// setID takes the integer form of the seqeunce and sets it.
-func (rs *RedisStore) setID(newID int64) error {
+// bumpIDScript moves the sequence to max(cur,1+id).  This has to be done in
+// Redis with a script, a GET and then a SET from here could move the sequence
+// backwards if another server did an INCR in between.
+const bumpIDScript = `local cur = tonumber(redis.call('GET', KEYS[1]) or '0')
+if tonumber(ARGV[1]) >= cur then
+	redis.call('SET', KEYS[1], ARGV[1] + 1)
+end
+return cur`
+
+// bumpID takes the integer form of an ID and moves the sequence past it if necessary.
+func (rs *RedisStore) bumpID(id int64) error {
 	if db6 {
-		fmt.Printf("setID = %d AT: %s\n", newID, godebug.LF())
+		fmt.Printf("bumpID = %d AT: %s\n", id, godebug.LF())
 	}
-	err := rs.redisConn.Cmd("SET", rs.RedisPrefix+"!seq", fmt.Sprintf("%d", newID)).Err
+	err := rs.evalScript(bumpIDScript, []string{rs.seqKey()}, id).Err
 	if err != nil {
 		fmt.Fprintf(rs.Log, "Error: %s, %s\n", err, godebug.LF())
 		return err
@@ -98,21 +345,85 @@ func (rs *RedisStore) setID(newID int64) error {
 	return nil
 }
 
+// Seq returns the current value of "qr!seq".
+func (rs *RedisStore) Seq() (int64, error) {
+	return rs.redisConn.Cmd("GET", rs.seqKey()).Int64()
+}
+
+// SetSeq moves "qr!seq" up to n if it is less than n.
+func (rs *RedisStore) SetSeq(n int64) error {
+	return rs.bumpID(n - 1) // bumpID moves the sequence to id+1 if it is at or past the current value.
+}
+
+// setIfExistsScript sets KEYS[2], the count or info, only if the code in KEYS[1] exists.
+const setIfExistsScript = `if redis.call('EXISTS', KEYS[1]) == 1 then
+	redis.call('SET', KEYS[2], ARGV[1])
+	return 1
+end
+return 0`
+
+// SetCount sets the hit count for ID.  It is ErrNotFound if the code does not exist.
+func (rs *RedisStore) SetCount(ID string, n int) error {
+	found, err := rs.evalScript(setIfExistsScript, []string{rs.codeKey(ID), rs.countKey(ID)}, n).Int()
+	if err != nil {
+		return err
+	}
+	if found == 0 {
+		return fmt.Errorf("%w: %s", ErrNotFound, ID)
+	}
+	return nil
+}
+
+// FetchInfo returns the metadata for ID.  The URL and info keys are in the
+// same slot so one MGET reads both.
+func (rs *RedisStore) FetchInfo(ID string) (string, error) {
+	resp := rs.redisConn.Cmd("MGET", rs.codeKey(ID), rs.infoKey(ID))
+	if resp.Err != nil {
+		return "", resp.Err
+	}
+	vals, err := resp.Array()
+	if err != nil || len(vals) != 2 {
+		return "", fmt.Errorf("unexpected MGET reply: %v", err)
+	}
+	if vals[0].IsType(redis.Nil) {
+		return "", fmt.Errorf("%w: %s", ErrNotFound, ID)
+	}
+	if vals[1].IsType(redis.Nil) {
+		return "", nil
+	}
+	return vals[1].Str()
+}
+
+// SetInfo saves the metadata for ID.  It is ErrNotFound if the code does not exist.
+func (rs *RedisStore) SetInfo(ID string, info string) error {
+	found, err := rs.evalScript(setIfExistsScript, []string{rs.codeKey(ID), rs.infoKey(ID)}, info).Int()
+	if err != nil {
+		return err
+	}
+	if found == 0 {
+		return fmt.Errorf("%w: %s", ErrNotFound, ID)
+	}
+	return nil
+}
+
 // Insert writes out the `urlStr` into the `~/data` direcotry under the file name in `code`
 func (rs *RedisStore) Insert(urlStr string) (string, error) {
 	code := rs.NextID()
+	if code == "" {
+		return "", fmt.Errorf("unable to allocate a new ID")
+	}
 	return rs.insertInternal(urlStr, code)
 }
 
 // insertInternal is the implemntation of an insert without the generation of a new ID.
 func (rs *RedisStore) insertInternal(urlStr, code string) (string, error) {
-	err := rs.redisConn.Cmd("SET", rs.RedisPrefix+":"+code, urlStr).Err
+	err := rs.redisConn.Cmd("SET", rs.codeKey(code), urlStr).Err
 	if err != nil {
 		fmt.Fprintf(rs.Log, "Error: unable to update: %s\n", err)
 		return code, err
 	}
 	if rs.CountHits {
-		err := rs.redisConn.Cmd("SET", rs.RedisPrefix+"^"+code, "0").Err
+		err := rs.redisConn.Cmd("SET", rs.countKey(code), "0").Err
 		if err != nil {
 			fmt.Fprintf(rs.Log, "Error: unable to update count: %s\n", err)
 			return code, err
@@ -124,7 +435,7 @@ func (rs *RedisStore) insertInternal(urlStr, code string) (string, error) {
 // Update an existing key
 func (rs *RedisStore) Update(urlStr, code string) (ID string, err error) {
 	// TODO FIXME -- base 36 encode of ID?
-	err = rs.redisConn.Cmd("SET", rs.RedisPrefix+":"+code, urlStr).Err
+	err = rs.redisConn.Cmd("SET", rs.codeKey(code), urlStr).Err
 	if err != nil {
 		fmt.Fprintf(rs.Log, "Error: unable to write file: %s\n", err)
 		return code, err
@@ -134,7 +445,7 @@ func (rs *RedisStore) Update(urlStr, code string) (ID string, err error) {
 
 // Exists returns true if the ID exists in the database
 func (rs *RedisStore) Exists(ID string) (rv bool) {
-	tmp, err := rs.redisConn.Cmd("GET", rs.RedisPrefix+":"+ID).Str()
+	tmp, err := rs.redisConn.Cmd("GET", rs.codeKey(ID)).Str()
 	if err != nil || tmp == "" {
 		rv = false
 	} else {
@@ -148,26 +459,32 @@ func (rs *RedisStore) Exists(ID string) (rv bool) {
 
 // Fetch converts from a `code` into a `url` to be returned.
 func (rs *RedisStore) Fetch(code string) (string, error) {
-	urlBytes, err := rs.redisConn.Cmd("GET", rs.RedisPrefix+":"+code).Str()
-	if rs.CountHits {
-		_, err := rs.redisConn.Cmd("INCR", rs.RedisPrefix+"^"+code).Int()
-		if err != nil {
-			fmt.Fprintf(rs.Log, "Error: %s, %s\n", err, godebug.LF())
-		}
-	}
-	return string(urlBytes), err
+	return rs.fetch(code)
 }
 
-// Fetch converts from a `code` into a `url` to be returned.
+// FetchRaw converts from a `code` into a `url` to be returned.
 func (rs *RedisStore) FetchRaw(code string) (string, error) {
-	urlBytes, err := rs.redisConn.Cmd("GET", rs.RedisPrefix+":"+code).Str()
-	if rs.CountHits {
-		_, err := rs.redisConn.Cmd("INCR", rs.RedisPrefix+"^"+code).Int()
+	return rs.fetch(code)
+}
+
+// fetch gets the URL and if counting hits increments the count.  A code that
+// does not exist is ErrNotFound and is not counted.
+func (rs *RedisStore) fetch(code string) (string, error) {
+	resp := rs.redisConn.Cmd("GET", rs.codeKey(code))
+	if resp.IsType(redis.Nil) {
+		return "", ErrNotFound
+	}
+	urlStr, err := resp.Str()
+	if err != nil {
+		return "", err
+	}
+	if rs.CountHits && !rs.Opts.ReadOnly {
+		_, err := rs.redisConn.Cmd("INCR", rs.countKey(code)).Int()
 		if err != nil {
 			fmt.Fprintf(rs.Log, "Error: %s, %s\n", err, godebug.LF())
 		}
 	}
-	return string(urlBytes), err
+	return urlStr, nil
 }
 
 // ConnectToRedis create the connection to the Redis in memory store and returns it.
@@ -198,50 +515,22 @@ func ConnectToRedis(redisHost, redisPort, redisAuth string) (redisConn *redis.Cl
 // 1000 returend then you will need to call multiple times.
 func (rs *RedisStore) List(beg, end string) (dat []ListData, err error) {
 	var maxID int
-	var begI64, endI64 int64
-	maxID, err = rs.redisConn.Cmd("GET", rs.RedisPrefix+"!seq").Int()
+	maxID, err = rs.redisConn.Cmd("GET", rs.seqKey()).Int()
 	if err != nil {
-		fmt.Fprintf(rs.Log, "Fatal Error: %s, %s\n", err, godebug.LF())
-		os.Exit(2)
+		fmt.Fprintf(rs.Log, "Error: %s, %s\n", err, godebug.LF())
 		return
 	}
 
-	var begInt int
-	begI64, err = strconv.ParseInt(beg, 10, 64)
+	begInt, endInt, err := listRange(beg, end, int64(maxID))
 	if err != nil {
 		fmt.Fprintf(rs.Log, "Error: %s, %s\n", err, godebug.LF())
 		return
 	}
-	begInt = int(begI64)
-
-	var endInt int
-	// fmt.Printf("AT: %s\n", godebug.LF())
-	if end == "last" || end == "*" || end == "latest" {
-		// fmt.Printf("AT: %s\n", godebug.LF())
-		endInt = maxID
-	} else {
-		// fmt.Printf("AT: %s\n", godebug.LF())
-		endI64, err = strconv.ParseInt(end, 10, 64)
-		if err != nil {
-			// fmt.Printf("AT: %s\n", godebug.LF())
-			fmt.Fprintf(rs.Log, "Error: %s, %s\n", err, godebug.LF())
-			return
-		}
-		// fmt.Printf("AT: %s\n", godebug.LF())
-		endInt = int(endI64)
-	}
-	// fmt.Printf("AT: %s\n", godebug.LF())
-	err = nil
 
 	var nUse int
 	var dbURL string
 	// limit # returned to 1000 at a time.
 	dataRange := endInt - begInt + 1
-	if dataRange <= 0 {
-		fmt.Fprintf(rs.Log, "Error: dataRange is invalid, %d, %s\n", dataRange, godebug.LF())
-		err = fmt.Errorf("Invalid range for data, %d from end(%d)-beg(%d)+1", dataRange, endInt, begInt)
-		return
-	}
 	if dataRange > 1000 {
 		dataRange = 1000
 	}
@@ -256,9 +545,9 @@ func (rs *RedisStore) List(beg, end string) (dat []ListData, err error) {
 		}
 		key := strconv.FormatUint(uint64(ii), 36) // Base 36, take count of # of files add 1, this is the code.
 		if db4 {
-			fmt.Printf("GET %s\n", fmt.Sprintf("%s:%s", rs.RedisPrefix, key))
+			fmt.Printf("GET %s\n", rs.codeKey(key))
 		}
-		dbURL, err = rs.redisConn.Cmd("GET", fmt.Sprintf("%s:%s", rs.RedisPrefix, key)).Str()
+		dbURL, err = rs.redisConn.Cmd("GET", rs.codeKey(key)).Str()
 		if err != nil || dbURL == "" {
 			if db4 {
 				fmt.Printf("err: %s AT: %s\n", err, godebug.LF())
@@ -266,7 +555,7 @@ func (rs *RedisStore) List(beg, end string) (dat []ListData, err error) {
 			continue
 		} else {
 			if db4 {
-				fmt.Printf("GET %s -- success\n", fmt.Sprintf("%s:%s", rs.RedisPrefix, key))
+				fmt.Printf("GET %s -- success\n", rs.codeKey(key))
 			}
 		}
 
@@ -276,7 +565,7 @@ func (rs *RedisStore) List(beg, end string) (dat []ListData, err error) {
 		nUse = 0
 		if rs.CountHits {
 			key := strconv.FormatUint(uint64(ii), 36) // Base 36, take count of # of files add 1, this is the code.
-			nUse, err = rs.redisConn.Cmd("GET", fmt.Sprintf("%s^%s", rs.RedisPrefix, key)).Int()
+			nUse, err = rs.redisConn.Cmd("GET", rs.countKey(key)).Int()
 			if err != nil {
 				// fmt.Printf("AT: %s\n", godebug.LF())
 				fmt.Fprintf(rs.Log, "Ignored Error: %s, %s\n", err, godebug.LF())
@@ -327,9 +616,6 @@ func (rs *RedisStore) UpdateInsert(URL string, ID string) (ur UpdateRespItem) {
 		fmt.Printf("%sUpdateInsert(%s,%s)%s\n", MiscLib.ColorCyan, URL, ID, MiscLib.ColorReset)
 	}
 
-	// get current max ID in decimal.
-	cID := rs.getID()
-
 	// convert from ID - in B36 to decimal, update NextID = max(cur,1+id) if necessary.
 	IDint, err := strconv.ParseInt(ID, 36, 64) // Base 36, Parse the int into a number
 	if err != nil {
@@ -337,11 +623,10 @@ func (rs *RedisStore) UpdateInsert(URL string, ID string) (ur UpdateRespItem) {
 		ur.Msg = fmt.Sprintf("fail:%s", err)
 		return
 	}
-	if IDint >= cID {
-		if db6 {
-			fmt.Printf("IDint=%d AT: %s\n", IDint, godebug.LF())
-		}
-		rs.setID(IDint + 1)
+	if err = rs.bumpID(IDint); err != nil {
+		ur.ID = ID
+		ur.Msg = fmt.Sprintf("fail:%s", err)
+		return
 	}
 
 	if !rs.Exists(ID) {
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestRedisStore connects to the Redis in $QR_SHORT_TEST_REDIS (host:port), the
+// test is skipped if it is not set.  A prefix unique to the test is used so that
+// nothing else in the database is touched.
+//
+//	QR_SHORT_TEST_REDIS=127.0.0.1:6379 go test ./storage/
+func newTestRedisStore(t *testing.T, opts RedisOptions) *RedisStore {
+	addr := os.Getenv("QR_SHORT_TEST_REDIS")
+	if addr == "" && opts.SentinelAddr == "" && opts.ClusterAddr == "" {
+		t.Skip("QR_SHORT_TEST_REDIS is not set")
+	}
+	host, port := addr, "6379"
+	if ii := strings.LastIndex(addr, ":"); ii >= 0 {
+		host, port = addr[:ii], addr[ii+1:]
+	}
+	prefix := fmt.Sprintf("qrtest%d", time.Now().UnixNano())
+	data, err := NewRedisStore(host, port, os.Getenv("QR_SHORT_TEST_REDIS_AUTH"), prefix, true, opts, os.Stderr)
+	if err != nil {
+		t.Fatalf("NewRedisStore: %s", err)
+	}
+	rs := data.(*RedisStore)
+	t.Cleanup(func() { rs.Close() })
+	return rs
+}
+
+func TestRedisStoreClose(t *testing.T) {
+	rs := newTestRedisStore(t, RedisOptions{HealthCheck: 10 * time.Millisecond})
+	if _, err := rs.Insert("http://example.com/a"); err != nil {
+		t.Fatalf("Insert: %s", err)
+	}
+	time.Sleep(50 * time.Millisecond) // let the health check run
+	if err := rs.Close(); err != nil {
+		t.Errorf("Close: %s", err)
+	}
+	select {
+	case <-rs.stop:
+	default:
+		t.Errorf("Close did not stop the health check")
+	}
+	if err := rs.Close(); err != nil {
+		t.Errorf("second Close: %s", err)
+	}
+}
+
+// TestRedisStoreSentinelCluster runs the same checks through Sentinel and Cluster.
+// It uses $QR_SHORT_TEST_SENTINEL (host:port, master "mymaster") and
+// $QR_SHORT_TEST_CLUSTER (host:port of any node), a local multi-process setup is fine.
+func TestRedisStoreSentinelCluster(t *testing.T) {
+	tests := []struct {
+		name, env string
+		opts      func(addr string) RedisOptions
+	}{
+		{"sentinel", "QR_SHORT_TEST_SENTINEL", func(addr string) RedisOptions { return RedisOptions{SentinelAddr: addr} }},
+		{"cluster", "QR_SHORT_TEST_CLUSTER", func(addr string) RedisOptions { return RedisOptions{ClusterAddr: addr} }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr := os.Getenv(test.env)
+			if addr == "" {
+				t.Skipf("%s is not set", test.env)
+			}
+			rs := newTestRedisStore(t, test.opts(addr))
+			id, err := rs.Insert("http://example.com/a")
+			if err != nil {
+				t.Fatalf("Insert: %s", err)
+			}
+			if got, err := rs.Fetch(id); err != nil || got != "http://example.com/a" {
+				t.Errorf("Fetch(%s) = %q, %v", id, got, err)
+			}
+			ur := rs.UpdateInsert("http://example.com/b", "zz")
+			if ur.Msg != "success/insert" {
+				t.Errorf("UpdateInsert(zz) = %+v", ur)
+			}
+			if seq, err := rs.Seq(); err != nil || seq != 1296 {
+				t.Errorf("Seq() = %d, %v after UpdateInsert(zz), expected 1296", seq, err)
+			}
+			if test.name == "cluster" && rs.seqKey() != rs.RedisPrefix+"!{seq}" {
+				t.Errorf("seqKey() = %s, expected a hash tag in cluster mode", rs.seqKey())
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package storage
+
+// Copyright (C) Philip Schlump 2018-2019.
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+
+	"golang.org/x/text/language"
+)
+
+// Devices for ResolveRequest.Device and the keys of CodeMeta.DeviceURLs.
+const (
+	DeviceIOS     = "ios"
+	DeviceAndroid = "android"
+	DeviceDesktop = "desktop"
+)
+
+// ResolveRequest is what is known about a scan for Resolve.
+type ResolveRequest struct {
+	At     time.Time // time of the scan, zero is now
+	Hit    bool      // count the scan as a hit, false to check a code
+	Raw    bool      // FetchRaw rather than Fetch from the backend
+	Device string    // DeviceIOS, DeviceAndroid, DeviceDesktop or ""
+
+	AcceptLanguage string // the Accept-Language header
+	Variant        string // the variant this scanner got before, from a cookie
+}
+
+// Resolution is the result of Resolve.  Info is set for ErrExpired too so the
+// caller can find the ExpiredURL.
+type Resolution struct {
+	URL     string   // where the scan goes
+	Rule    string   // what chose the URL: "", "schedule", "device:ios", "lang:fr", "variant:b" etc.
+	Variant string   // the name of the variant, "" if there was none
+	Info    CodeInfo // the info for the code
+}
+
+// Resolve finds where a scan of ID goes.  A code that is disabled, deleted or
+// expired is ErrDisabled, ErrDeleted or ErrExpired.  An active scheduled
+// destination comes first, then a device rule, then a language rule, then an
+// A/B variant, then the URL.  A hit on a variant is counted in VariantCounts.
+func (a *V1Adapter) Resolve(ctx context.Context, ID string, rr ResolveRequest) (res Resolution, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if err = ValidID(ID); err != nil {
+		return
+	}
+	if rr.At.IsZero() {
+		rr.At = time.Now()
+	}
+	ci, err := a.fetchInfo(ID)
+	if err != nil {
+		return
+	}
+	res.Info = ci
+	switch {
+	case ci.Deleted != nil:
+		return res, fmt.Errorf("%w: %s", ErrDeleted, ID)
+	case ci.Disabled:
+		return res, fmt.Errorf("%w: %s", ErrDisabled, ID)
+	case ci.Expires != nil || ci.MaxScans > 0:
+		var ld ListData
+		if ci.MaxScans > 0 {
+			if ld, _, err = a.peek(ID); err != nil {
+				return
+			}
+		}
+		if ci.IsExpired(ld.Count, rr.At) {
+			return res, fmt.Errorf("%w: %s", ErrExpired, ID)
+		}
+	}
+
+	fx := func(ID string) (string, error) {
+		ld, _, err := a.peek(ID)
+		return ld.URL, err
+	}
+	switch {
+	case rr.Hit && rr.Raw:
+		fx = a.Data.FetchRaw
+	case rr.Hit:
+		fx = a.Data.Fetch
+	}
+	if res.URL, err = fx(ID); err != nil {
+		return res, backendError(err)
+	}
+	if res.URL == "" {
+		return res, fmt.Errorf("%w: %s", ErrNotFound, ID)
+	}
+
+	if se, found := ci.activeSchedule(rr.At); found {
+		res.URL, res.Rule = se.URL, "schedule"
+	} else if URL := ci.DeviceURLs[rr.Device]; URL != "" {
+		res.URL, res.Rule = URL, "device:"+rr.Device
+	} else if tag := matchLang(ci.LangURLs, rr.AcceptLanguage); tag != "" {
+		res.URL, res.Rule = ci.LangURLs[tag], "lang:"+tag
+	} else if v, found := pickVariant(ci.Variants, rr.Variant); found {
+		res.URL, res.Rule, res.Variant = v.URL, "variant:"+v.Name, v.Name
+		if rr.Hit {
+			// The scan is not failed if the count can not be saved.
+			a.updateInfo(ID, func(info *CodeInfo) error {
+				if info.VariantCounts == nil {
+					info.VariantCounts = make(map[string]int)
+				}
+				info.VariantCounts[v.Name]++
+				return nil
+			})
+		}
+	}
+	return
+}
+
+// randIntn is rand.Intn, tests replace it.
+var randIntn = rand.Intn
+
+// pickVariant returns the variant named sticky if there is one, otherwise one
+// chosen at random by weight.
+func pickVariant(variants []Variant, sticky string) (Variant, bool) {
+	total := 0
+	for _, v := range variants {
+		if v.Name == sticky {
+			return v, true
+		}
+		total += v.Weight
+	}
+	if total <= 0 {
+		return Variant{}, false
+	}
+	nn := randIntn(total)
+	for _, v := range variants {
+		if nn < v.Weight {
+			return v, true
+		}
+		nn -= v.Weight
+	}
+	return Variant{}, false
+}
+
+// validVariants checks that each variant has a unique name, a URL and a
+// weight above 0.
+func validVariants(variants []Variant) error {
+	seen := make(map[string]bool)
+	for _, v := range variants {
+		switch {
+		case v.Name == "" || v.URL == "":
+			return fmt.Errorf("%w: a variant needs a name and a URL", ErrInvalidRange)
+		case v.Weight <= 0:
+			return fmt.Errorf("%w: variant %q has weight %d, must be above 0", ErrInvalidRange, v.Name, v.Weight)
+		case seen[v.Name]:
+			return fmt.Errorf("%w: variant %q is used twice", ErrInvalidRange, v.Name)
+		}
+		seen[v.Name] = true
+	}
+	return nil
+}
+
+// matchLang returns the key in langURLs that is the best BCP 47 match for the
+// Accept-Language header, "" if none is a good match.
+func matchLang(langURLs map[string]string, acceptLanguage string) string {
+	if len(langURLs) == 0 || acceptLanguage == "" {
+		return ""
+	}
+	want, _, err := language.ParseAcceptLanguage(acceptLanguage)
+	if err != nil || len(want) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(langURLs))
+	for key := range langURLs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	// Und is first so that it is the answer when nothing matches.
+	have := []language.Tag{language.Und}
+	for _, key := range keys {
+		have = append(have, language.Make(key))
+	}
+	_, ii, conf := language.NewMatcher(have).Match(want...)
+	if ii == 0 || conf <= language.Low {
+		return ""
+	}
+	return keys[ii-1]
+}
+
+// canonicalLangs checks the language tags in langURLs and returns them in
+// canonical form, "EN-us" is "en-US".
+func canonicalLangs(langURLs map[string]string) (map[string]string, error) {
+	if langURLs == nil {
+		return nil, nil
+	}
+	rv := make(map[string]string, len(langURLs))
+	for key, URL := range langURLs {
+		tag, err := language.Parse(key)
+		if err != nil || tag == language.Und {
+			return nil, fmt.Errorf("%w: language %q is not a BCP 47 tag", ErrInvalidRange, key)
+		}
+		rv[tag.String()] = URL
+	}
+	return rv, nil
+}
@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestResolveDevice(t *testing.T) {
+	data, _ := NewMemoryStore(true, os.Stderr)
+	ds := AdaptV1(data)
+	ctx := context.Background()
+
+	id, _ := ds.Insert(ctx, "http://example.com/web")
+	err := ds.SetMeta(ctx, id, CodeMeta{DeviceURLs: map[string]string{
+		DeviceIOS:     "https://apps.apple.com/app/id1",
+		DeviceAndroid: "https://play.google.com/store/apps/details?id=x",
+	}})
+	if err != nil {
+		t.Fatalf("SetMeta: %s", err)
+	}
+	tests := []struct {
+		device, url, rule string
+	}{
+		{DeviceIOS, "https://apps.apple.com/app/id1", "device:ios"},
+		{DeviceAndroid, "https://play.google.com/store/apps/details?id=x", "device:android"},
+		{DeviceDesktop, "http://example.com/web", ""},
+		{"", "http://example.com/web", ""},
+	}
+	for _, test := range tests {
+		res, err := ds.Resolve(ctx, id, ResolveRequest{Device: test.device})
+		if err != nil || res.URL != test.url || res.Rule != test.rule {
+			t.Errorf("Resolve(%q) = %q %q, %v, expected %q %q", test.device, res.URL, res.Rule, err, test.url, test.rule)
+		}
+	}
+	if ld, _ := ds.Code(ctx, id); ld.Count != 0 {
+		t.Errorf("Count = %d, expected Resolve without Hit not to count", ld.Count)
+	}
+	if res, _ := ds.Resolve(ctx, id, ResolveRequest{Device: DeviceIOS, Hit: true}); res.URL != "https://apps.apple.com/app/id1" {
+		t.Errorf("Resolve with Hit = %q", res.URL)
+	}
+	if ld, _ := ds.Code(ctx, id); ld.Count != 1 {
+		t.Errorf("Count = %d, expected 1", ld.Count)
+	}
+
+	// A scheduled destination comes first.
+	until := time.Now().Add(time.Hour)
+	ds.AddSchedule(ctx, id, ScheduleEntry{URL: "http://example.com/soon", Until: &until})
+	if res, _ := ds.Resolve(ctx, id, ResolveRequest{Device: DeviceIOS}); res.URL != "http://example.com/soon" || res.Rule != "schedule" {
+		t.Errorf("Resolve with a schedule = %+v", res)
+	}
+
+	// Merge, "" removes a rule.
+	ds.SetMeta(ctx, id, CodeMeta{DeviceURLs: map[string]string{DeviceIOS: "", DeviceDesktop: "http://example.com/desk"}})
+	if ci, _ := ds.FetchInfo(ctx, id); len(ci.DeviceURLs) != 2 || ci.DeviceURLs[DeviceDesktop] != "http://example.com/desk" || ci.DeviceURLs[DeviceIOS] != "" {
+		t.Errorf("DeviceURLs after merge = %v", ci.DeviceURLs)
+	}
+	ds.SetMeta(ctx, id, CodeMeta{DeviceURLs: map[string]string{DeviceAndroid: "", DeviceDesktop: ""}})
+	if ci, _ := ds.FetchInfo(ctx, id); ci.DeviceURLs != nil {
+		t.Errorf("DeviceURLs after removing all = %v, expected nil", ci.DeviceURLs)
+	}
+	if err := ds.SetMeta(ctx, id, CodeMeta{DeviceURLs: map[string]string{"palm": "http://x"}}); !errors.Is(err, ErrInvalidRange) {
+		t.Errorf("SetMeta with device palm error = %v, expected ErrInvalidRange", err)
+	}
+}
+
+func TestResolveLanguage(t *testing.T) {
+	data, _ := NewMemoryStore(true, os.Stderr)
+	ds := AdaptV1(data)
+	ctx := context.Background()
+
+	id, _ := ds.Insert(ctx, "http://example.com/en")
+	err := ds.SetMeta(ctx, id, CodeMeta{LangURLs: map[string]string{
+		"fr":    "http://example.com/fr",
+		"DE":    "http://example.com/de",
+		"pt-br": "http://example.com/pt-BR",
+	}})
+	if err != nil {
+		t.Fatalf("SetMeta: %s", err)
+	}
+	if ci, _ := ds.FetchInfo(ctx, id); ci.LangURLs["de"] != "http://example.com/de" || ci.LangURLs["pt-BR"] != "http://example.com/pt-BR" {
+		t.Errorf("LangURLs = %v, expected canonical tags", ci.LangURLs)
+	}
+	tests := []struct {
+		accept, url, rule string
+	}{
+		{"fr-CA,fr;q=0.9,en;q=0.8", "http://example.com/fr", "lang:fr"},
+		{"de-AT", "http://example.com/de", "lang:de"},
+		{"pt-BR,pt;q=0.9", "http://example.com/pt-BR", "lang:pt-BR"},
+		{"ja,en;q=0.5", "http://example.com/en", ""},
+		{"en-US", "http://example.com/en", ""},
+		{"", "http://example.com/en", ""},
+		{"!!!", "http://example.com/en", ""},
+	}
+	for _, test := range tests {
+		res, err := ds.Resolve(ctx, id, ResolveRequest{AcceptLanguage: test.accept})
+		if err != nil || res.URL != test.url || res.Rule != test.rule {
+			t.Errorf("Resolve(%q) = %q %q, %v, expected %q %q", test.accept, res.URL, res.Rule, err, test.url, test.rule)
+		}
+	}
+
+	// A device rule comes first.
+	ds.SetMeta(ctx, id, CodeMeta{DeviceURLs: map[string]string{DeviceIOS: "http://example.com/ios"}})
+	if res, _ := ds.Resolve(ctx, id, ResolveRequest{Device: DeviceIOS, AcceptLanguage: "fr"}); res.URL != "http://example.com/ios" {
+		t.Errorf("Resolve(ios, fr) = %q, expected the device rule", res.URL)
+	}
+
+	ds.SetMeta(ctx, id, CodeMeta{LangURLs: map[string]string{"fr": ""}})
+	if ci, _ := ds.FetchInfo(ctx, id); len(ci.LangURLs) != 2 {
+		t.Errorf("LangURLs after removing fr = %v", ci.LangURLs)
+	}
+	if err := ds.SetMeta(ctx, id, CodeMeta{LangURLs: map[string]string{"not a tag!": "http://x"}}); !errors.Is(err, ErrInvalidRange) {
+		t.Errorf("SetMeta with a bad tag error = %v, expected ErrInvalidRange", err)
+	}
+}
+
+func TestResolveVariant(t *testing.T) {
+	data, _ := NewMemoryStore(true, os.Stderr)
+	ds := AdaptV1(data)
+	ctx := context.Background()
+
+	saved := randIntn
+	defer func() { randIntn = saved }()
+	var nn int
+	randIntn = func(n int) int { return nn % n }
+
+	id, _ := ds.Insert(ctx, "http://example.com/base")
+	variants := []Variant{{"a", "http://example.com/a", 1}, {"b", "http://example.com/b", 3}}
+	if err := ds.SetMeta(ctx, id, CodeMeta{Variants: variants}); err != nil {
+		t.Fatalf("SetMeta: %s", err)
+	}
+	for nn = 0; nn < 4; nn++ {
+		expect := "b"
+		if nn == 0 {
+			expect = "a"
+		}
+		res, err := ds.Resolve(ctx, id, ResolveRequest{Hit: true})
+		if err != nil || res.Variant != expect || res.URL != "http://example.com/"+expect || res.Rule != "variant:"+expect {
+			t.Errorf("Resolve with rand %d = %+v, %v, expected variant %s", nn, res, err, expect)
+		}
+	}
+
+	// The sticky variant is used whatever the dice say, an unknown one is ignored.
+	nn = 0
+	if res, _ := ds.Resolve(ctx, id, ResolveRequest{Hit: true, Variant: "b"}); res.Variant != "b" {
+		t.Errorf("Resolve with sticky b = %q", res.Variant)
+	}
+	if res, _ := ds.Resolve(ctx, id, ResolveRequest{Variant: "gone"}); res.Variant != "a" {
+		t.Errorf("Resolve with sticky gone = %q, expected a new pick", res.Variant)
+	}
+
+	ci, _ := ds.FetchInfo(ctx, id)
+	if ci.VariantCounts["a"] != 1 || ci.VariantCounts["b"] != 4 {
+		t.Errorf("VariantCounts = %v, expected a:1 b:4, the scan without Hit is not counted", ci.VariantCounts)
+	}
+
+	// The counts are not set by SetMeta and are kept when the variants change.
+	ds.SetMeta(ctx, id, CodeMeta{Variants: []Variant{}, VariantCounts: map[string]int{"a": 99}})
+	if ci, _ := ds.FetchInfo(ctx, id); ci.Variants != nil || ci.VariantCounts["a"] != 1 {
+		t.Errorf("after removing the variants CodeMeta = %+v", ci.CodeMeta)
+	}
+	if res, _ := ds.Resolve(ctx, id, ResolveRequest{}); res.URL != "http://example.com/base" || res.Variant != "" {
+		t.Errorf("Resolve with no variants = %+v", res)
+	}
+
+	bad := [][]Variant{
+		{{"a", "", 1}},
+		{{"", "http://x", 1}},
+		{{"a", "http://x", 0}},
+		{{"a", "http://x", 1}, {"a", "http://y", 1}},
+	}
+	for _, vv := range bad {
+		if err := ds.SetMeta(ctx, id, CodeMeta{Variants: vv}); !errors.Is(err, ErrInvalidRange) {
+			t.Errorf("SetMeta(%+v) error = %v, expected ErrInvalidRange", vv, err)
+		}
+	}
+}
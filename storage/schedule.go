@@ -0,0 +1,113 @@
+package storage
+
+// Copyright (C) Philip Schlump 2018-2019.
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ScheduleEntry is a destination that replaces the URL of a code from From
+// until Until.  Either can be nil for no start or no end.  If more than one
+// entry is active the one with the latest From wins, then the one added last.
+type ScheduleEntry struct {
+	N       int        `json:"N"` // 1, 2, 3 ... to cancel it
+	URL     string     `json:"URL"`
+	From    *time.Time `json:"From,omitempty"`
+	Until   *time.Time `json:"Until,omitempty"`
+	Created time.Time  `json:"Created"`
+	Actor   string     `json:"Actor,omitempty"`
+}
+
+// Active returns true if the entry applies at time at.
+func (se ScheduleEntry) Active(at time.Time) bool {
+	return (se.From == nil || !at.Before(*se.From)) && (se.Until == nil || at.Before(*se.Until))
+}
+
+// activeSchedule returns the entry that applies at time at.
+func (ci CodeInfo) activeSchedule(at time.Time) (rv ScheduleEntry, found bool) {
+	for _, se := range ci.Schedule {
+		if !se.Active(at) {
+			continue
+		}
+		if !found || rv.From == nil || (se.From != nil && !se.From.Before(*rv.From)) {
+			rv, found = se, true
+		}
+	}
+	return
+}
+
+// Schedule returns the scheduled destinations for ID in the order they were
+// added.
+func (a *V1Adapter) Schedule(ctx context.Context, ID string) ([]ScheduleEntry, error) {
+	ci, err := a.FetchInfo(ctx, ID)
+	if err != nil {
+		return nil, err
+	}
+	return ci.Schedule, nil
+}
+
+// AddSchedule adds a scheduled destination to ID.  Entries that have ended are
+// removed.  A locked or deleted code can not be scheduled, the error is
+// ErrLocked or ErrDeleted.
+func (a *V1Adapter) AddSchedule(ctx context.Context, ID string, se ScheduleEntry) (ScheduleEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return se, err
+	}
+	if err := ValidID(ID); err != nil {
+		return se, err
+	}
+	switch {
+	case se.URL == "":
+		return se, fmt.Errorf("%w: a scheduled destination needs a URL", ErrInvalidRange)
+	case se.From == nil && se.Until == nil:
+		return se, fmt.Errorf("%w: a scheduled destination needs a start or an end", ErrInvalidRange)
+	case se.From != nil && se.Until != nil && !se.From.Before(*se.Until):
+		return se, fmt.Errorf("%w: the start %s is not before the end %s", ErrInvalidRange, se.From.Format(time.RFC3339), se.Until.Format(time.RFC3339))
+	}
+	err := a.updateInfo(ID, func(ci *CodeInfo) error {
+		switch {
+		case ci.Deleted != nil:
+			return fmt.Errorf("%w: %s", ErrDeleted, ID)
+		case ci.Locked:
+			return fmt.Errorf("%w: %s, unlock it to schedule a change", ErrLocked, ID)
+		}
+		now := time.Now()
+		keep := ci.Schedule[:0]
+		for _, old := range ci.Schedule {
+			if old.Until == nil || old.Until.After(now) {
+				keep = append(keep, old)
+			}
+			if old.N >= se.N {
+				se.N = old.N + 1
+			}
+		}
+		if se.N == 0 {
+			se.N = 1
+		}
+		se.Created, se.Actor = now, ActorFrom(ctx)
+		ci.Schedule = append(keep, se)
+		return nil
+	})
+	return se, err
+}
+
+// CancelSchedule removes scheduled destination N from ID.
+func (a *V1Adapter) CancelSchedule(ctx context.Context, ID string, N int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := ValidID(ID); err != nil {
+		return err
+	}
+	return a.updateInfo(ID, func(ci *CodeInfo) error {
+		for ii, se := range ci.Schedule {
+			if se.N == N {
+				ci.Schedule = append(ci.Schedule[:ii], ci.Schedule[ii+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %s has no scheduled destination %d", ErrNotFound, ID, N)
+	})
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	data, _ := NewMemoryStore(true, os.Stderr)
+	ds := AdaptV1(data)
+	ctx := WithActor(context.Background(), "bob")
+
+	now := time.Now()
+	launch, end := now.Add(time.Hour), now.Add(48*time.Hour)
+	id, _ := ds.Insert(ctx, "http://example.com/product")
+	pre, err := ds.AddSchedule(ctx, id, ScheduleEntry{URL: "http://example.com/pre-launch", Until: &launch})
+	if err != nil || pre.N != 1 || pre.Actor != "bob" || pre.Created.IsZero() {
+		t.Fatalf("AddSchedule = %+v, %v", pre, err)
+	}
+	sale, err := ds.AddSchedule(ctx, id, ScheduleEntry{URL: "http://example.com/sale", From: &launch, Until: &end})
+	if err != nil || sale.N != 2 {
+		t.Fatalf("AddSchedule = %+v, %v", sale, err)
+	}
+
+	tests := []struct {
+		at  time.Time
+		url string
+	}{
+		{now, "http://example.com/pre-launch"},
+		{launch, "http://example.com/sale"},
+		{end, "http://example.com/product"},
+	}
+	for _, test := range tests {
+		if URL, err := ds.FetchAt(ctx, id, test.at); err != nil || URL != test.url {
+			t.Errorf("FetchAt(%s) = %q, %v, expected %q", test.at, URL, err, test.url)
+		}
+	}
+	if URL, _ := ds.Fetch(ctx, id); URL != "http://example.com/pre-launch" {
+		t.Errorf("Fetch = %q, expected the pre-launch page", URL)
+	}
+	if ld, _ := ds.Code(ctx, id); ld.Count != 1 {
+		t.Errorf("Count = %d, expected FetchAt not to count", ld.Count)
+	}
+
+	// A later start wins over an earlier one.
+	flash := launch.Add(time.Hour)
+	ds.AddSchedule(ctx, id, ScheduleEntry{URL: "http://example.com/flash", From: &flash})
+	if URL, _ := ds.FetchAt(ctx, id, flash); URL != "http://example.com/flash" {
+		t.Errorf("FetchAt(flash) = %q", URL)
+	}
+
+	if err := ds.CancelSchedule(ctx, id, 1); err != nil {
+		t.Fatalf("CancelSchedule: %s", err)
+	}
+	if URL, _ := ds.FetchAt(ctx, id, now); URL != "http://example.com/product" {
+		t.Errorf("FetchAt after cancel = %q", URL)
+	}
+	if sched, _ := ds.Schedule(ctx, id); len(sched) != 2 || sched[0].N != 2 || sched[1].N != 3 {
+		t.Errorf("Schedule = %+v", sched)
+	}
+	if err := ds.CancelSchedule(ctx, id, 1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("second CancelSchedule error = %v, expected ErrNotFound", err)
+	}
+
+	bad := []ScheduleEntry{
+		{From: &launch},
+		{URL: "http://example.com/x"},
+		{URL: "http://example.com/x", From: &end, Until: &launch},
+	}
+	for _, se := range bad {
+		if _, err := ds.AddSchedule(ctx, id, se); !errors.Is(err, ErrInvalidRange) {
+			t.Errorf("AddSchedule(%+v) error = %v, expected ErrInvalidRange", se, err)
+		}
+	}
+	ds.Lock(ctx, id)
+	if _, err := ds.AddSchedule(ctx, id, ScheduleEntry{URL: "http://example.com/x", From: &end}); !errors.Is(err, ErrLocked) {
+		t.Errorf("AddSchedule of a locked code error = %v, expected ErrLocked", err)
+	}
+}
@@ -0,0 +1,364 @@
+// Package storagetest has a test suite that every storage.PersistentData
+// backend must pass.  It is kept out of package storage so that "testing" is
+// not linked into the server, the same as net/http/httptest.
+package storagetest
+
+// Copyright (C) Philip Schlump 2018-2019.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/American-Certified-Brands/tools/qr-short/storage"
+)
+
+// RunConformance checks that a PersistentData implementation behaves the same
+// as the others.  Call it from a test for the backend, for example:
+//
+//	func TestBoltStore(t *testing.T) {
+//		storagetest.RunConformance(t, func(t *testing.T) storage.PersistentData {
+//			data, err := storage.NewBoltStore(filepath.Join(t.TempDir(), "qr.db"), true, os.Stderr)
+//			if err != nil {
+//				t.Fatal(err)
+//			}
+//			t.Cleanup(func() { data.Close() })
+//			return data
+//		})
+//	}
+//
+// newStore is called for each sub-test and must return an empty store with
+// CountHits turned on.
+func RunConformance(t *testing.T, newStore func(t *testing.T) storage.PersistentData) {
+	t.Run("NextID", func(t *testing.T) { conformNextID(t, newStore(t)) })
+	t.Run("InsertFetch", func(t *testing.T) { conformInsertFetch(t, newStore(t)) })
+	t.Run("Base36", func(t *testing.T) { conformBase36(t, newStore(t)) })
+	t.Run("UpdateInsert", func(t *testing.T) { conformUpdateInsert(t, newStore(t)) })
+	t.Run("List", func(t *testing.T) { conformList(t, newStore(t)) })
+	t.Run("Count", func(t *testing.T) { conformCount(t, newStore(t)) })
+	t.Run("SeqCount", func(t *testing.T) { conformSeqCount(t, newStore(t)) })
+	t.Run("Info", func(t *testing.T) { conformInfo(t, newStore(t)) })
+	t.Run("Lock", func(t *testing.T) { conformLock(t, newStore(t)) })
+	t.Run("Expiry", func(t *testing.T) { conformExpiry(t, newStore(t)) })
+	t.Run("Concurrent", func(t *testing.T) { conformConcurrent(t, newStore(t)) })
+}
+
+// conformNextID checks that IDs are base 36 and always go up.
+func conformNextID(t *testing.T, data storage.PersistentData) {
+	var prev int64
+	for ii := 0; ii < 50; ii++ {
+		id := data.NextID()
+		nn, err := strconv.ParseInt(id, 36, 64)
+		if err != nil {
+			t.Fatalf("NextID returned %q, not base 36: %s", id, err)
+		}
+		if nn <= prev {
+			t.Fatalf("NextID returned %s (%d) after %d, must increase", id, nn, prev)
+		}
+		prev = nn
+	}
+}
+
+// conformInsertFetch checks Insert, Exists, Fetch, FetchRaw and Update.
+func conformInsertFetch(t *testing.T, data storage.PersistentData) {
+	id, err := data.Insert("http://example.com/a?x=1")
+	if err != nil {
+		t.Fatalf("Insert: %s", err)
+	}
+	if !data.Exists(id) {
+		t.Errorf("Exists(%s) = false after Insert", id)
+	}
+	if got, err := data.Fetch(id); err != nil || got != "http://example.com/a?x=1" {
+		t.Errorf("Fetch(%s) = %q, %v", id, got, err)
+	}
+	if got, err := data.FetchRaw(id); err != nil || got != "http://example.com/a?x=1" {
+		t.Errorf("FetchRaw(%s) = %q, %v", id, got, err)
+	}
+	if code, err := data.Update("http://example.com/b", id); err != nil || code != id {
+		t.Errorf("Update(%s) = %q, %v", id, code, err)
+	}
+	if got, err := data.Fetch(id); err != nil || got != "http://example.com/b" {
+		t.Errorf("Fetch(%s) after Update = %q, %v", id, got, err)
+	}
+
+	missing := strconv.FormatUint(999999, 36)
+	if data.Exists(missing) {
+		t.Errorf("Exists(%s) = true for a code that was never set", missing)
+	}
+	if _, err := data.Fetch(missing); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Fetch(%s) error = %v, expected ErrNotFound", missing, err)
+	}
+
+	// Update is an upsert, a code that does not exist is created.
+	upsert := strconv.FormatUint(888888, 36)
+	if code, err := data.Update("http://example.com/c", upsert); err != nil || code != upsert {
+		t.Errorf("Update(%s) of a new code = %q, %v", upsert, code, err)
+	}
+	if got, err := data.Fetch(upsert); err != nil || got != "http://example.com/c" {
+		t.Errorf("Fetch(%s) after Update of a new code = %q, %v", upsert, got, err)
+	}
+}
+
+// conformBase36 checks that IDs set with UpdateInsert in base 36 come back from
+// List as the same number in decimal.
+func conformBase36(t *testing.T, data storage.PersistentData) {
+	for _, nn := range []int64{35, 36, 1295, 1296, 46655} {
+		id := strconv.FormatInt(nn, 36)
+		data.UpdateInsert(fmt.Sprintf("http://example.com/%d", nn), id)
+		dat, err := data.List(fmt.Sprintf("%d", nn), fmt.Sprintf("%d", nn+1))
+		if err != nil {
+			t.Fatalf("List(%d,%d): %s", nn, nn+1, err)
+		}
+		if len(dat) != 1 || dat[0].ID != fmt.Sprintf("%d", nn) || dat[0].URL != fmt.Sprintf("http://example.com/%d", nn) {
+			t.Errorf("List(%d,%d) = %+v, expected ID %d", nn, nn+1, dat, nn)
+		}
+	}
+}
+
+// conformUpdateInsert checks the insert/update messages, that ur.ID is set and
+// that the sequence is moved past the ID.
+func conformUpdateInsert(t *testing.T, data storage.PersistentData) {
+	ur := data.UpdateInsert("http://example.com/1", "zz")
+	if ur.ID != "zz" || ur.Msg != "success/insert" {
+		t.Errorf("UpdateInsert new = %+v, expected ID zz and success/insert", ur)
+	}
+	ur = data.UpdateInsert("http://example.com/2", "zz")
+	if ur.ID != "zz" || ur.Msg != "success/update" {
+		t.Errorf("UpdateInsert existing = %+v, expected ID zz and success/update", ur)
+	}
+	if got, err := data.Fetch("zz"); err != nil || got != "http://example.com/2" {
+		t.Errorf("Fetch(zz) = %q, %v", got, err)
+	}
+	nn, _ := strconv.ParseInt(data.NextID(), 36, 64)
+	if zz, _ := strconv.ParseInt("zz", 36, 64); nn <= zz {
+		t.Errorf("NextID after UpdateInsert(zz) = %d, must be > %d", nn, zz)
+	}
+	ur = data.UpdateInsert("http://example.com/3", "not-base-36")
+	if len(ur.Msg) < 5 || ur.Msg[:5] != "fail:" {
+		t.Errorf("UpdateInsert with bad ID = %+v, expected fail:", ur)
+	}
+}
+
+// conformList checks the beg/end handling of List.
+func conformList(t *testing.T, data storage.PersistentData) {
+	var ids []int64
+	for ii := 0; ii < 5; ii++ {
+		id, err := data.Insert(fmt.Sprintf("http://example.com/%d", ii))
+		if err != nil {
+			t.Fatalf("Insert: %s", err)
+		}
+		nn, _ := strconv.ParseInt(id, 36, 64)
+		ids = append(ids, nn)
+	}
+	for _, end := range []string{"last", "*", "latest"} {
+		dat, err := data.List("0", end)
+		if err != nil {
+			t.Fatalf("List(0,%s): %s", end, err)
+		}
+		if len(dat) != len(ids) {
+			t.Fatalf("List(0,%s) returned %d items, expected %d", end, len(dat), len(ids))
+		}
+		for ii, ld := range dat {
+			if ld.ID != fmt.Sprintf("%d", ids[ii]) {
+				t.Errorf("List(0,%s)[%d].ID = %s, expected %d", end, ii, ld.ID, ids[ii])
+			}
+		}
+	}
+	dat, err := data.List(fmt.Sprintf("%d", ids[1]), fmt.Sprintf("%d", ids[3]))
+	if err != nil || len(dat) != 2 {
+		t.Errorf("List(%d,%d) = %+v, %v, expected 2 items, end is not included", ids[1], ids[3], dat, err)
+	}
+	if _, err := data.List("5", "2"); err == nil {
+		t.Errorf("List(5,2) did not return an error")
+	}
+	if _, err := data.List("abc", "last"); err == nil {
+		t.Errorf("List(abc,last) did not return an error")
+	}
+}
+
+// conformCount checks that Fetch counts hits and List reports them.
+func conformCount(t *testing.T, data storage.PersistentData) {
+	a, _ := data.Insert("http://example.com/a")
+	b, _ := data.Insert("http://example.com/b")
+	for ii := 0; ii < 3; ii++ {
+		data.Fetch(a)
+	}
+	dat, err := data.List("0", "last")
+	if err != nil {
+		t.Fatalf("List: %s", err)
+	}
+	counts := make(map[string]int)
+	for _, ld := range dat {
+		counts[ld.ID] = ld.Count
+	}
+	aa, _ := strconv.ParseInt(a, 36, 64)
+	bb, _ := strconv.ParseInt(b, 36, 64)
+	if n := counts[fmt.Sprintf("%d", aa)]; n != 3 {
+		t.Errorf("Count for %s = %d, expected 3", a, n)
+	}
+	if n := counts[fmt.Sprintf("%d", bb)]; n != 0 {
+		t.Errorf("Count for %s = %d, expected 0", b, n)
+	}
+}
+
+// conformSeqCount checks Seq, SetSeq and SetCount, these are used to copy
+// one store to another.
+func conformSeqCount(t *testing.T, data storage.PersistentData) {
+	id := data.NextID()
+	nn, _ := strconv.ParseInt(id, 36, 64)
+	if seq, err := data.Seq(); err != nil || seq != nn {
+		t.Errorf("Seq() = %d, %v after NextID returned %d", seq, err, nn)
+	}
+	if err := data.SetSeq(500); err != nil {
+		t.Fatalf("SetSeq(500): %s", err)
+	}
+	if err := data.SetSeq(100); err != nil {
+		t.Fatalf("SetSeq(100): %s", err)
+	}
+	if seq, err := data.Seq(); err != nil || seq != 500 {
+		t.Errorf("Seq() = %d, %v after SetSeq(500), SetSeq(100), expected 500", seq, err)
+	}
+	if id := data.NextID(); id != strconv.FormatInt(501, 36) {
+		t.Errorf("NextID() = %s after SetSeq(500), expected %s", id, strconv.FormatInt(501, 36))
+	}
+
+	data.UpdateInsert("http://example.com/a", "a")
+	if err := data.SetCount("a", 42); err != nil {
+		t.Fatalf("SetCount(a,42): %s", err)
+	}
+	dat, err := data.List("10", "11")
+	if err != nil || len(dat) != 1 || dat[0].Count != 42 {
+		t.Errorf("List(10,11) = %+v, %v, expected a count of 42", dat, err)
+	}
+	if err := data.SetCount("b", 7); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("SetCount(b,7) of a code that does not exist = %v, expected ErrNotFound", err)
+	}
+	if data.Exists("b") {
+		t.Errorf("SetCount(b,7) created code b")
+	}
+}
+
+// conformInfo checks FetchInfo and SetInfo, and that the info is kept when
+// the URL is changed.
+func conformInfo(t *testing.T, data storage.PersistentData) {
+	id, err := data.Insert("http://example.com/a")
+	if err != nil {
+		t.Fatalf("Insert: %s", err)
+	}
+	if info, err := data.FetchInfo(id); err != nil || info != "" {
+		t.Errorf("FetchInfo(%s) of a new code = %q, %v, expected no info", id, info, err)
+	}
+	const info = `{"Owner":"bob","Tags":["a","b"]}`
+	if err := data.SetInfo(id, info); err != nil {
+		t.Fatalf("SetInfo(%s): %s", id, err)
+	}
+	if got, err := data.FetchInfo(id); err != nil || got != info {
+		t.Errorf("FetchInfo(%s) = %q, %v, expected %q", id, got, err, info)
+	}
+	data.Update("http://example.com/b", id)
+	data.UpdateInsert("http://example.com/c", id)
+	data.Fetch(id)
+	if got, err := data.FetchInfo(id); err != nil || got != info {
+		t.Errorf("FetchInfo(%s) after Update = %q, %v, expected %q", id, got, err, info)
+	}
+
+	if err := data.SetInfo("zzzz", info); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("SetInfo(zzzz) of a code that does not exist = %v, expected ErrNotFound", err)
+	}
+	if data.Exists("zzzz") {
+		t.Errorf("SetInfo(zzzz) created code zzzz")
+	}
+	if _, err := data.FetchInfo("zzzz"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("FetchInfo(zzzz) of a code that does not exist = %v, expected ErrNotFound", err)
+	}
+}
+
+// conformLock checks that the lock, which is kept in the info, is saved and
+// stops a change to the URL.
+func conformLock(t *testing.T, data storage.PersistentData) {
+	ctx := context.Background()
+	ds := storage.AdaptV1(data)
+	id, err := ds.Insert(ctx, "http://example.com/a")
+	if err != nil {
+		t.Fatalf("Insert: %s", err)
+	}
+	if err = ds.Lock(ctx, id); err != nil {
+		t.Fatalf("Lock(%s): %s", id, err)
+	}
+	if ci, err := storage.AdaptV1(data).FetchInfo(ctx, id); err != nil || !ci.Locked {
+		t.Errorf("FetchInfo(%s) after Lock = %+v, %v, expected Locked", id, ci.CodeMeta, err)
+	}
+	if ur, err := ds.UpdateInsert(ctx, "http://example.com/b", id); !errors.Is(err, storage.ErrLocked) {
+		t.Errorf("UpdateInsert(%s) of a locked code = %+v, %v, expected ErrLocked", id, ur, err)
+	}
+	if URL, _ := data.FetchRaw(id); URL != "http://example.com/a" {
+		t.Errorf("FetchRaw(%s) = %q, the locked code was changed", id, URL)
+	}
+	if err = ds.Unlock(ctx, id); err != nil {
+		t.Fatalf("Unlock(%s): %s", id, err)
+	}
+	if _, err = ds.Update(ctx, "http://example.com/b", id); err != nil {
+		t.Errorf("Update(%s) after Unlock: %s", id, err)
+	}
+}
+
+// conformExpiry checks that the expiry and scan quota, which are kept in the
+// info, stop a code.
+func conformExpiry(t *testing.T, data storage.PersistentData) {
+	ctx := context.Background()
+	ds := storage.AdaptV1(data)
+	past := time.Now().Add(-time.Minute)
+	a, _ := ds.Insert(ctx, "http://example.com/a")
+	b, _ := ds.Insert(ctx, "http://example.com/b")
+	if err := ds.SetMeta(ctx, a, storage.CodeMeta{Expires: &past}); err != nil {
+		t.Fatalf("SetMeta(%s): %s", a, err)
+	}
+	if err := ds.SetMeta(ctx, b, storage.CodeMeta{MaxScans: 1}); err != nil {
+		t.Fatalf("SetMeta(%s): %s", b, err)
+	}
+	if _, err := ds.Fetch(ctx, a); !errors.Is(err, storage.ErrExpired) {
+		t.Errorf("Fetch(%s) past Expires error = %v, expected ErrExpired", a, err)
+	}
+	if _, err := ds.Fetch(ctx, b); err != nil {
+		t.Errorf("Fetch(%s) first scan: %s", b, err)
+	}
+	if _, err := ds.Fetch(ctx, b); !errors.Is(err, storage.ErrExpired) {
+		t.Errorf("Fetch(%s) past MaxScans error = %v, expected ErrExpired", b, err)
+	}
+}
+
+// conformConcurrent checks that concurrent inserts get different IDs.
+func conformConcurrent(t *testing.T, data storage.PersistentData) {
+	const nWorkers, nEach = 10, 10
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	seen := make(map[string]bool)
+	for ww := 0; ww < nWorkers; ww++ {
+		wg.Add(1)
+		go func(ww int) {
+			defer wg.Done()
+			for ii := 0; ii < nEach; ii++ {
+				urlStr := fmt.Sprintf("http://example.com/%d/%d", ww, ii)
+				id, err := data.Insert(urlStr)
+				if err != nil {
+					t.Errorf("Insert: %s", err)
+					return
+				}
+				lock.Lock()
+				if seen[id] {
+					t.Errorf("ID %s was returned twice", id)
+				}
+				seen[id] = true
+				lock.Unlock()
+				if got, err := data.Fetch(id); err != nil || got != urlStr {
+					t.Errorf("Fetch(%s) = %q, %v, expected %q", id, got, err, urlStr)
+				}
+			}
+		}(ww)
+	}
+	wg.Wait()
+}
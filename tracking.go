@@ -0,0 +1,55 @@
+package main
+
+// Copyright (C) Philip Schlump 2018-2019.
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/American-Certified-Brands/tools/qr-short/storage"
+)
+
+// TrackingParams returns the tracking parameters for a scan of code id, the
+// ones for its Campaign in cfg.Campaigns and then its own Tracking.  These
+// variables in a value are replaced:
+//
+//	{id}		the code
+//	{campaign}	the Campaign
+//	{variant}	the A/B test variant
+//	{device}	ios, android or desktop
+//	{time}		time of the scan, RFC 3339 UTC
+//	{date}		date of the scan, 2006-01-02 UTC
+//	{unix}		time of the scan, seconds
+//
+// perScan is true if a value has the time, the URL is not the same for two
+// scans and it can not be cached.
+func TrackingParams(cfg *ConfigType, id string, res storage.Resolution, device string, now time.Time) (vals url.Values, perScan bool) {
+	ci := res.Info
+	if len(ci.Tracking) == 0 && len(cfg.Campaigns[ci.Campaign]) == 0 {
+		return nil, false
+	}
+	now = now.UTC()
+	rep := strings.NewReplacer(
+		"{id}", id,
+		"{campaign}", ci.Campaign,
+		"{variant}", res.Variant,
+		"{device}", device,
+		"{time}", now.Format(time.RFC3339),
+		"{date}", now.Format("2006-01-02"),
+		"{unix}", strconv.FormatInt(now.Unix(), 10),
+	)
+	vals = make(url.Values)
+	set := func(params map[string]string) {
+		for key, value := range params {
+			vals.Set(key, rep.Replace(value))
+			perScan = perScan || strings.Contains(value, "{time}") || strings.Contains(value, "{unix}")
+		}
+	}
+	if ci.Campaign != "" {
+		set(cfg.Campaigns[ci.Campaign])
+	}
+	set(ci.Tracking)
+	return vals, perScan
+}